@@ -0,0 +1,15 @@
+#!/bin/bash
+
+# This script is used by openvpn-admin to wrap the sourcing of the necessary variables (vars.local) and then
+# to regenerate the certificate revocation list (crl.pem) the same way ./revoke-full does. This is necessary because
+# I could not get a working solution to sourcing the vars.local file directly in the Go exec.Command call.
+
+source ./vars.local
+
+# Mirror revoke-full, which blanks these out so the pkcs11 section of the openssl config doesn't get in the way
+export KEY_CN=""
+export KEY_OU=""
+export KEY_NAME=""
+
+cd "$KEY_DIR"
+$OPENSSL ca -gencrl -out crl.pem -config "$KEY_CONFIG"
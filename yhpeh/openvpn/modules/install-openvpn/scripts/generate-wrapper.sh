@@ -3,6 +3,11 @@
 # This script is used by openvpn-admin to wrap the sourcing of the necessary variables (vars.local) and then
 # to pass the call along to the ./build-key script. This is necessary because I could not get a working
 # solution to sourcing the vars.local file directly in the Go exec.Command call.
+#
+# The optional second argument is the number of days the certificate should be valid for, in place of KEY_EXPIRE.
 
 source ./vars.local
-KEY_NAME="" ./build-key --batch $1
\ No newline at end of file
+if [[ -n "$2" ]]; then
+    export KEY_EXPIRE="$2"
+fi
+KEY_NAME="" ./build-key --batch $1
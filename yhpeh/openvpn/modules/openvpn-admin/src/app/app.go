@@ -4,6 +4,8 @@ import (
 	"github.com/urfave/cli"
 	"github.com/gruntwork-io/gruntwork-cli/errors"
 	"fmt"
+	"time"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
 )
 
 const LOGGER_NAME = "openvpn-admin"
@@ -13,6 +15,71 @@ const OPTION_AWS_REGION = "aws-region"
 const OPTION_DEBUG = "debug"
 const OPTION_REQUEST_URL = "request-url"
 const OPTION_REVOKE_URL = "revoke-url"
+const OPTION_PORTAL_LISTEN_ADDRESS = "portal-listen-address"
+const OPTION_PORTAL_OIDC_PUBLIC_KEY = "portal-oidc-public-key"
+const OPTION_PORTAL_ALB_ARN = "portal-alb-arn"
+const OPTION_PORTAL_OIDC_ISSUER = "portal-oidc-issuer"
+const OPTION_PORTAL_USERNAME_CLAIM = "portal-username-claim"
+const OPTION_PORTAL_ALLOWED_DOMAIN = "portal-allowed-domain"
+const OPTION_ALLOWED_GROUP = "allowed-group"
+const OPTION_DRY_RUN = "dry-run"
+const OPTION_MAX_REVOCATIONS = "max-revocations"
+const OPTION_REVOKE_UNKNOWN_USERS = "revoke-unknown-users"
+const OPTION_SYNC_IAM_INTERVAL = "sync-iam-interval"
+const OPTION_FROM_FILE = "from-file"
+const OPTION_REPORT = "report"
+const OPTION_OUTPUT_DIR = "output-dir"
+const OPTION_DESTINATION = "destination"
+const OPTION_KMS_KEY_ID = "kms-key-id"
+const OPTION_CRL_CHECK_INTERVAL = "crl-check-interval"
+const OPTION_CRL_WARNING_DAYS = "crl-warning-days"
+const OPTION_METRIC_NAMESPACE = "metric-namespace"
+const OPTION_MANAGEMENT_ADDRESS = "management-address"
+const OPTION_MANAGEMENT_PASSWORD_FILE = "management-password-file"
+const OPTION_STATUS_FILE = "status-file"
+const OPTION_JSON = "json"
+const OPTION_HISTORY_FILE = "history-file"
+const OPTION_SOURCE = "source"
+const OPTION_VERIFY = "verify"
+const OPTION_LOCK_TABLE = "lock-table"
+const OPTION_LOCK_LEASE_DURATION = "lock-lease-duration"
+const OPTION_LEADER_ONLY = "leader-only"
+const OPTION_PKI_STORAGE = "pki-storage"
+const OPTION_ENDPOINT_URL = "endpoint-url"
+const OPTION_MAX_RETRIES = "max-retries"
+const OPTION_MAX_RETRY_DELAY = "max-retry-delay"
+const OPTION_REQUEST_TIMEOUT = "request-timeout"
+const OPTION_HEALTH_LISTEN_ADDRESS = "health-listen-address"
+const OPTION_NO_WAIT = "no-wait"
+const OPTION_PROFILE = "profile"
+const OPTION_ROLE_ARN = "role-arn"
+const OPTION_EXTERNAL_ID = "external-id"
+const OPTION_MFA_SERIAL = "mfa-serial"
+const OPTION_RESULTS_DIR = "results-dir"
+const OPTION_RESULT_RETENTION = "result-retention"
+const OPTION_USERNAME_RULE = "username-rule"
+const OPTION_CONFIG = "config"
+const OPTION_SERVER = "server"
+const OPTION_ALL_SERVERS = "all-servers"
+const OPTION_QUEUE_TAGS = "queue-tags"
+const OPTION_DEVICE = "device"
+const OPTION_ALL_DEVICES = "all-devices"
+const OPTION_MAX_DEVICES = "max-devices"
+const OPTION_VALID_FOR = "valid-for"
+const OPTION_MAX_VALID_FOR = "max-valid-for"
+const OPTION_GROUP_MAX_VALID_FOR = "group-max-valid-for"
+const OPTION_EXPIRED_CLEANUP_INTERVAL = "expired-cleanup-interval"
+const OPTION_REQUIRE_APPROVAL = "require-approval"
+const OPTION_PENDING_DIR = "pending-dir"
+const OPTION_REASON = "reason"
+const OPTION_WEBHOOK_URL = "webhook-url"
+const OPTION_SLACK_WEBHOOK_URL = "slack-webhook-url"
+const OPTION_WEBHOOK_SPOOL_DIR = "webhook-spool-dir"
+const OPTION_EXPIRY_WARNING_DAYS = "expiry-warning-days"
+const OPTION_KEEP = "keep"
+
+// The management interface socket configured by init-openvpn
+const DEFAULT_MANAGEMENT_ADDRESS = "unix:/run/openvpn/management.sock"
 
 func CreateApp(version string) *cli.App {
 	app := cli.NewApp()
@@ -32,7 +99,7 @@ func CreateApp(version string) *cli.App {
 
 	usernameFlag := cli.StringFlag{
 		Name: OPTION_USERNAME,
-		Usage: "The username that the certificate is being requested for. Defaults to current IAM username when requesting a cert; required when revoking a cert.",
+		Usage: "The username that the certificate is being requested for. Defaults to the username of your AWS identity (an IAM user or an SSO or assumed role session) when requesting a cert; required when revoking a cert.",
 	}
 
 	timeoutFlag := cli.IntFlag{
@@ -57,38 +124,513 @@ func CreateApp(version string) *cli.App {
 		EnvVar: "OPENVPN_ADMIN_DEBUG",
 	}
 
+	portalListenAddressFlag := cli.StringFlag{
+		Name: OPTION_PORTAL_LISTEN_ADDRESS,
+		Usage: "If set, serve the self-service web portal on this address (e.g. :8080). The portal must sit behind an ALB with OIDC authentication enabled.",
+	}
+
+	portalOidcPublicKeyFlag := cli.StringFlag{
+		Name: OPTION_PORTAL_OIDC_PUBLIC_KEY,
+		Usage: "Path to a PEM encoded ECDSA public key to verify the x-amzn-oidc-data header set by the ALB with. By default, the key given by the token's kid is fetched from the ALB's public key endpoint for --aws-region. Pinning a key stops the portal from working once the ALB rotates it. Optional.",
+	}
+
+	portalAlbArnFlag := cli.StringFlag{
+		Name: OPTION_PORTAL_ALB_ARN,
+		Usage: "The ARN of the ALB in front of the web portal. If set, tokens signed by any other load balancer are rejected. Optional.",
+	}
+
+	portalOidcIssuerFlag := cli.StringFlag{
+		Name: OPTION_PORTAL_OIDC_ISSUER,
+		Usage: "The issuer of your identity provider (e.g. https://accounts.google.com). If set, tokens the ALB got from any other identity provider are rejected. Optional.",
+	}
+
+	portalUsernameClaimFlag := cli.StringFlag{
+		Name: OPTION_PORTAL_USERNAME_CLAIM,
+		Usage: "The OIDC claim the web portal derives usernames from. The value goes through the --username-rule rules.",
+		Value: "email",
+	}
+
+	portalAllowedDomainFlag := cli.StringSliceFlag{
+		Name: OPTION_PORTAL_ALLOWED_DOMAIN,
+		Usage: "Only let users whose --portal-username-claim is an address in this domain use the web portal. May be specified multiple times. Required if the --username-rule rules remove the domain.",
+	}
+
+	allowedGroupFlag := cli.StringSliceFlag{
+		Name: OPTION_ALLOWED_GROUP,
+		Usage: "An IAM group whose members may hold certificates. May be specified multiple times. If not set, any existing IAM user may hold a certificate.",
+	}
+
+	dryRunFlag := cli.BoolFlag{
+		Name: OPTION_DRY_RUN,
+		Usage: "Report which certificates would be revoked without revoking them",
+	}
+
+	maxRevocationsFlag := cli.IntFlag{
+		Name: OPTION_MAX_REVOCATIONS,
+		Usage: "Refuse to revoke anything if more than this many certificates would be revoked in one pass. Defaults to 5",
+		Value: 5,
+	}
+
+	revokeUnknownUsersFlag := cli.BoolFlag{
+		Name: OPTION_REVOKE_UNKNOWN_USERS,
+		Usage: "Also revoke certificates that don't belong to any IAM user. Without it, they are only reported, as they may belong to people who sign in through SSO.",
+	}
+
+	syncIamIntervalFlag := cli.DurationFlag{
+		Name: OPTION_SYNC_IAM_INTERVAL,
+		Usage: "If set, reconcile certificates with IAM users at this interval (e.g. 1h) while processing revocations. Optional.",
+	}
+
+	fromFileFlag := cli.StringFlag{
+		Name: OPTION_FROM_FILE,
+		Usage: "Path to a newline separated or CSV file of usernames. If set, the operation is run for every user in the file concurrently instead of for --username.",
+	}
+
+	reportFlag := cli.StringFlag{
+		Name: OPTION_REPORT,
+		Usage: "When used with --from-file, write a JSON report of the result for each user to this path. Optional.",
+	}
+
+	outputDirFlag := cli.StringFlag{
+		Name: OPTION_OUTPUT_DIR,
+		Usage: "The directory to write OpenVPN profiles (<username>.ovpn) into. Defaults to the current directory",
+		Value: ".",
+	}
+
+	crlDestinationFlag := cli.StringFlag{
+		Name: OPTION_DESTINATION,
+		Usage: "The S3 URI to publish the CRL to (e.g. s3://my-bucket/openvpn/crl.pem).",
+	}
+
+	kmsKeyIdFlag := cli.StringFlag{
+		Name: OPTION_KMS_KEY_ID,
+		Usage: "The ID of the KMS key to encrypt the uploaded object with. Optional.",
+	}
+
+	crlCheckIntervalFlag := cli.DurationFlag{
+		Name: OPTION_CRL_CHECK_INTERVAL,
+		Usage: "How often to check when the CRL's next update is due while processing revocations. Set to 0 to disable.",
+		Value: time.Hour,
+	}
+
+	crlWarningDaysFlag := cli.IntFlag{
+		Name: OPTION_CRL_WARNING_DAYS,
+		Usage: "Log a warning when the CRL's next update is fewer than this many days away. Defaults to 30",
+		Value: 30,
+	}
+
+	metricNamespaceFlag := cli.StringFlag{
+		Name: OPTION_METRIC_NAMESPACE,
+		Usage: "The CloudWatch namespace to publish metrics to. Set to an empty string to disable metrics.",
+		Value: "OpenVPN",
+	}
+
+	managementAddressFlag := cli.StringFlag{
+		Name: OPTION_MANAGEMENT_ADDRESS,
+		Usage: "The address of the OpenVPN management interface, as host:port or unix:<path> (e.g. unix:/run/openvpn/management.sock). If set, revoked users are disconnected immediately.",
+	}
+
+	managementPasswordFileFlag := cli.StringFlag{
+		Name: OPTION_MANAGEMENT_PASSWORD_FILE,
+		Usage: "Path to the file holding the OpenVPN management interface password, if one is configured. Optional.",
+	}
+
+	statusManagementAddressFlag := cli.StringFlag{
+		Name: OPTION_MANAGEMENT_ADDRESS,
+		Usage: "The address of the OpenVPN management interface, as host:port or unix:<path>.",
+		Value: DEFAULT_MANAGEMENT_ADDRESS,
+	}
+
+	statusFileFlag := cli.StringFlag{
+		Name: OPTION_STATUS_FILE,
+		Usage: "Read connected clients from this OpenVPN status file (status-version 2 or 3) instead of the management interface. Optional.",
+	}
+
+	jsonFlag := cli.BoolFlag{
+		Name: OPTION_JSON,
+		Usage: "Print the output as JSON",
+	}
+
+	historyFileFlag := cli.StringFlag{
+		Name: OPTION_HISTORY_FILE,
+		Usage: "The file where the client-connect and client-disconnect hooks record connections.",
+		Value: DEFAULT_HISTORY_FILE,
+	}
+
+	backupDestinationFlag := cli.StringFlag{
+		Name: OPTION_DESTINATION,
+		Usage: "The S3 URI to upload backups under (e.g. s3://my-bucket/backups).",
+	}
+
+	backupKmsKeyIdFlag := cli.StringFlag{
+		Name: OPTION_KMS_KEY_ID,
+		Usage: "The ID of the KMS key to encrypt the backup with.",
+	}
+
+	restoreSourceFlag := cli.StringFlag{
+		Name: OPTION_SOURCE,
+		Usage: "The S3 URI of the backup to restore, or of a prefix to restore the latest backup under.",
+	}
+
+	verifyFlag := cli.BoolFlag{
+		Name: OPTION_VERIFY,
+		Usage: "Check that the CA certificate matches the CA key and that the certificates, index, serial and CRL are consistent before restoring",
+	}
+
+	restoreDryRunFlag := cli.BoolFlag{
+		Name: OPTION_DRY_RUN,
+		Usage: "Download and check the backup without restoring any files",
+	}
+
+	lockTableFlag := cli.StringFlag{
+		Name: OPTION_LOCK_TABLE,
+		Usage: "The DynamoDB table used to lock the PKI across OpenVPN servers sharing the request queues. Optional.",
+	}
+
+	lockLeaseDurationFlag := cli.DurationFlag{
+		Name: OPTION_LOCK_LEASE_DURATION,
+		Usage: "How long a lock is held before another server may take it over, should its holder go away.",
+		Value: time.Minute,
+	}
+
+	leaderOnlyFlag := cli.BoolFlag{
+		Name: OPTION_LEADER_ONLY,
+		Usage: "Only consume requests while this server holds the leader lease in --lock-table, so other servers can run as hot standbys. Requires --pki-storage in S3.",
+	}
+
+	noWaitFlag := cli.BoolFlag{
+		Name: OPTION_NO_WAIT,
+		Usage: "Print a request ID and exit instead of waiting for the OpenVPN server. Get the profile later with 'openvpn-admin fetch <id>'.",
+	}
+
+	requireApprovalFlag := cli.BoolFlag{
+		Name: OPTION_REQUIRE_APPROVAL,
+		Usage: "Park new certificate requests until an administrator approves them with 'openvpn-admin approve'",
+	}
+
+	pendingDirFlag := cli.StringFlag{
+		Name: OPTION_PENDING_DIR,
+		Usage: "Where requests wait for approval when --require-approval is set",
+		Value: DEFAULT_PENDING_DIR,
+	}
+
+	reasonFlag := cli.StringFlag{
+		Name: OPTION_REASON,
+		Usage: "Why the request is denied. This is passed on to the requester.",
+	}
+
+	keepFlag := cli.BoolFlag{
+		Name: OPTION_KEEP,
+		Usage: "Keep the temporary directory with the PKI and the profiles on exit",
+	}
+
+	webhookUrlFlag := cli.StringSliceFlag{
+		Name: OPTION_WEBHOOK_URL,
+		Usage: "A URL to POST certificate events (issued, renewed, revoked, expiring, request denied) to as JSON. May be repeated.",
+	}
+
+	slackWebhookUrlFlag := cli.StringSliceFlag{
+		Name: OPTION_SLACK_WEBHOOK_URL,
+		Usage: "A Slack incoming webhook URL to post certificate events to as messages. May be repeated.",
+	}
+
+	webhookSpoolDirFlag := cli.StringFlag{
+		Name: OPTION_WEBHOOK_SPOOL_DIR,
+		Usage: "Where certificate events are kept until the webhooks have received them",
+		Value: DEFAULT_WEBHOOK_SPOOL_DIR,
+	}
+
+	expiryWarningDaysFlag := cli.IntFlag{
+		Name: OPTION_EXPIRY_WARNING_DAYS,
+		Usage: "Notify the webhooks of certificates that expire within this many days. 0 disables the notifications.",
+		Value: DEFAULT_EXPIRY_WARNING_DAYS,
+	}
+
+	resultsDirFlag := cli.StringFlag{
+		Name: OPTION_RESULTS_DIR,
+		Usage: "Where the results of requests made with --no-wait are stored until they are fetched",
+		Value: DEFAULT_RESULTS_DIR,
+	}
+
+	resultRetentionFlag := cli.DurationFlag{
+		Name: OPTION_RESULT_RETENTION,
+		Usage: "How long the results of requests made with --no-wait can be fetched",
+		Value: DEFAULT_RESULT_RETENTION,
+	}
+
+	healthListenAddressFlag := cli.StringFlag{
+		Name: OPTION_HEALTH_LISTEN_ADDRESS,
+		Usage: "If set, serve /healthz and /readyz on this address (e.g. :8081). /healthz fails on errors that retrying won't fix, such as a deleted queue.",
+	}
+
+	usernameRuleFlag := cli.StringSliceFlag{
+		Name: OPTION_USERNAME_RULE,
+		Usage: "A rule that turns identities into usernames: strip-domain, lowercase, strip-prefix:<prefix>, strip-suffix:<suffix>, replace:<old>:<new> or none. May be specified multiple times; rules apply in order. Defaults to none. Clients and servers must use the same rules.",
+	}
+
+	configFlag := cli.StringFlag{
+		Name: OPTION_CONFIG,
+		Usage: "The client config listing the OpenVPN servers for --server and --all-servers. Defaults to ~/" + DEFAULT_CLIENT_CONFIG_PATH,
+		EnvVar: "OPENVPN_ADMIN_CONFIG",
+	}
+
+	serverFlag := cli.StringFlag{
+		Name: OPTION_SERVER,
+		Usage: "Use the settings of this server in the client config (see --config), e.g. prod. Servers that aren't in the client config are found by the openvpn-admin:server tag on their queues.",
+	}
+
+	allServersFlag := cli.BoolFlag{
+		Name: OPTION_ALL_SERVERS,
+		Usage: "Run against every server in the client config (see --config), one after the other",
+	}
+
+	queueTagsFlag := cli.StringFlag{
+		Name: OPTION_QUEUE_TAGS,
+		Usage: "When looking up the queues, only use those with all of these tags, as comma separated key=value pairs (e.g. openvpn-admin:server=prod)",
+	}
+
+	deviceFlag := cli.StringFlag{
+		Name: OPTION_DEVICE,
+		Usage: "The device the certificate is for (e.g. laptop), so that a user can hold one for each of their devices. The certificate's name becomes <username>+<device>.",
+	}
+
+	allDevicesFlag := cli.BoolFlag{
+		Name: OPTION_ALL_DEVICES,
+		Usage: "Revoke the certificates of all of the user's devices",
+	}
+
+	maxDevicesFlag := cli.IntFlag{
+		Name: OPTION_MAX_DEVICES,
+		Usage: "The most valid certificates a user may hold at once, one per device. 0 means no limit.",
+		Value: DEFAULT_MAX_DEVICES,
+	}
+
+	validForFlag := cli.DurationFlag{
+		Name: OPTION_VALID_FOR,
+		Usage: "How long the certificate should be valid for (e.g. 72h), rounded up to whole days. Defaults to the server's default validity.",
+	}
+
+	maxValidForFlag := cli.DurationFlag{
+		Name: OPTION_MAX_VALID_FOR,
+		Usage: "The longest validity users may request with --valid-for, in whole days (e.g. 720h). Certificates are never valid for longer than KEY_EXPIRE in vars.local.",
+	}
+
+	groupMaxValidForFlag := cli.StringSliceFlag{
+		Name: OPTION_GROUP_MAX_VALID_FOR,
+		Usage: "The longest validity members of an IAM group may request, as <group>=<duration> (e.g. contractors=72h). Overrides --max-valid-for for members of the group. May be repeated.",
+	}
+
+	expiredCleanupIntervalFlag := cli.DurationFlag{
+		Name: OPTION_EXPIRED_CLEANUP_INTERVAL,
+		Usage: "How often to mark expired certificates as such in index.txt. 0 disables the cleanup.",
+		Value: DEFAULT_EXPIRED_CLEANUP_INTERVAL,
+	}
+
+	pkiStorageFlag := cli.StringFlag{
+		Name: OPTION_PKI_STORAGE,
+		Usage: "Where the PKI state is kept: local (the default) or an S3 URI such as s3://my-bucket/pki. Changes to S3 are encrypted with --kms-key-id.",
+		Value: PKI_STORAGE_LOCAL,
+	}
+
+	// These apply to every AWS API call, so every command accepts them, and they may also be given before the command
+	awsClientFlags := []cli.Flag{
+		cli.StringFlag{
+			Name: OPTION_ENDPOINT_URL,
+			Usage: "Send all AWS API requests to this URL instead of AWS, e.g. http://localhost:4566 for LocalStack. For development and tests.",
+			EnvVar: "OPENVPN_ADMIN_ENDPOINT_URL",
+		},
+		cli.IntFlag{
+			Name: OPTION_MAX_RETRIES,
+			Usage: "How often a throttled or failed AWS API request is retried, with exponential backoff",
+			Value: aws_helpers.DEFAULT_MAX_RETRIES,
+		},
+		cli.DurationFlag{
+			Name: OPTION_MAX_RETRY_DELAY,
+			Usage: "The longest delay between two retries of an AWS API request",
+			Value: aws_helpers.DEFAULT_MAX_RETRY_DELAY,
+		},
+		cli.StringFlag{
+			Name: OPTION_PROFILE,
+			Usage: "The named AWS profile to use. Profiles that assume a role, with or without MFA, are supported.",
+			EnvVar: "AWS_PROFILE",
+		},
+		cli.StringFlag{
+			Name: OPTION_ROLE_ARN,
+			Usage: "Assume this IAM role for all AWS API calls, e.g. when the queues live in a different account",
+		},
+		cli.StringFlag{
+			Name: OPTION_EXTERNAL_ID,
+			Usage: "The external ID to pass when assuming --role-arn, if its trust policy requires one",
+		},
+		cli.StringFlag{
+			Name: OPTION_MFA_SERIAL,
+			Usage: "The serial number or ARN of the MFA device required to assume --role-arn. You will be prompted for the token.",
+		},
+		cli.DurationFlag{
+			Name: OPTION_REQUEST_TIMEOUT,
+			Usage: "How long a single AWS API request may take. Must be longer than the 20s SQS long poll. Set to 0 for no limit.",
+			Value: aws_helpers.DEFAULT_REQUEST_TIMEOUT,
+		},
+	}
+	app.Flags = awsClientFlags
+
 	app.Commands = []cli.Command{
 		{
 			Name: "request",
 			Usage: "Request a new certificate for a user with OpenVPN",
 			Action: errors.WithPanicHandling(requestNewCertificate),
-			Flags: []cli.Flag{debugFlag, requestUrlFlag, revokeUrlFlag, usernameFlag, timeoutFlag, awsRegionFlag},
+			Flags: []cli.Flag{debugFlag, requestUrlFlag, revokeUrlFlag, usernameFlag, timeoutFlag, awsRegionFlag, fromFileFlag, reportFlag, outputDirFlag, noWaitFlag, usernameRuleFlag, configFlag, serverFlag, allServersFlag, queueTagsFlag, deviceFlag, validForFlag},
+		},
+		{
+			Name: "fetch",
+			Usage: "Get the profile requested with 'request --no-wait' by its request ID, e.g. openvpn-admin fetch <id>",
+			ArgsUsage: "<id>",
+			Action: errors.WithPanicHandling(fetchCertificate),
+			Flags: []cli.Flag{debugFlag, requestUrlFlag, timeoutFlag, awsRegionFlag, outputDirFlag, configFlag, serverFlag, queueTagsFlag},
+		},
+		{
+			Name: "pending",
+			Usage: "List the certificate requests waiting for approval on this OpenVPN server",
+			Action: errors.WithPanicHandling(listPendingRequests),
+			Flags: []cli.Flag{debugFlag, pendingDirFlag, jsonFlag},
+		},
+		{
+			Name: "approve",
+			Usage: "Approve a certificate request waiting for approval, e.g. openvpn-admin approve <id>",
+			ArgsUsage: "<id>",
+			Action: errors.WithPanicHandling(approveRequest),
+			Flags: []cli.Flag{debugFlag, pendingDirFlag},
+		},
+		{
+			Name: "deny",
+			Usage: "Deny a certificate request waiting for approval, e.g. openvpn-admin deny <id> --reason 'not on the on-call rota'",
+			ArgsUsage: "<id>",
+			Action: errors.WithPanicHandling(denyRequest),
+			Flags: []cli.Flag{debugFlag, pendingDirFlag, reasonFlag},
 		},
 		{
 			Name: "revoke",
 			Usage: "Revoke an existing OpenVPN certificate for a user",
 			Action: errors.WithPanicHandling(requestCertificateRevocation),
-			Flags: []cli.Flag{debugFlag, requestUrlFlag, revokeUrlFlag, usernameFlag, awsRegionFlag, timeoutFlag},
+			Flags: []cli.Flag{debugFlag, requestUrlFlag, revokeUrlFlag, usernameFlag, awsRegionFlag, timeoutFlag, fromFileFlag, reportFlag, usernameRuleFlag, configFlag, serverFlag, allServersFlag, queueTagsFlag, deviceFlag, allDevicesFlag},
 		},
 		{
 			Name: "process-requests",
 			Usage: "Listen for certificate requests and revocations and process those requests",
 			Action: errors.WithPanicHandling(processNewCertificateRequests),
-			Flags: []cli.Flag{debugFlag, requestUrlFlag, revokeUrlFlag, usernameFlag, awsRegionFlag, timeoutFlag},
+			Flags: []cli.Flag{debugFlag, requestUrlFlag, revokeUrlFlag, usernameFlag, awsRegionFlag, timeoutFlag, portalListenAddressFlag, portalOidcPublicKeyFlag, portalAlbArnFlag, portalOidcIssuerFlag, portalUsernameClaimFlag, portalAllowedDomainFlag, lockTableFlag, lockLeaseDurationFlag, leaderOnlyFlag, pkiStorageFlag, kmsKeyIdFlag, healthListenAddressFlag, resultsDirFlag, resultRetentionFlag, usernameRuleFlag, queueTagsFlag, maxDevicesFlag, maxValidForFlag, groupMaxValidForFlag, expiredCleanupIntervalFlag, requireApprovalFlag, pendingDirFlag, webhookUrlFlag, slackWebhookUrlFlag, webhookSpoolDirFlag, expiryWarningDaysFlag, managementAddressFlag, managementPasswordFileFlag},
 		},
 		{
 			Name: "process-revokes",
 			Usage: "Listen for certificate revocations and process those requests",
 			Action: errors.WithPanicHandling(processCertificateRevocationRequests),
-			Flags: []cli.Flag{debugFlag, requestUrlFlag, revokeUrlFlag, usernameFlag, awsRegionFlag, timeoutFlag},
+			Flags: []cli.Flag{debugFlag, requestUrlFlag, revokeUrlFlag, usernameFlag, awsRegionFlag, timeoutFlag, syncIamIntervalFlag, allowedGroupFlag, dryRunFlag, maxRevocationsFlag, revokeUnknownUsersFlag, crlCheckIntervalFlag, crlWarningDaysFlag, metricNamespaceFlag, managementAddressFlag, managementPasswordFileFlag, lockTableFlag, lockLeaseDurationFlag, leaderOnlyFlag, pkiStorageFlag, kmsKeyIdFlag, healthListenAddressFlag, usernameRuleFlag, queueTagsFlag, webhookUrlFlag, slackWebhookUrlFlag, webhookSpoolDirFlag},
+		},
+		{
+			Name: "sync-iam",
+			Usage: "Revoke the certificates of users that no longer exist in IAM or are not in an allowed IAM group",
+			Action: errors.WithPanicHandling(syncIamUsers),
+			Flags: []cli.Flag{debugFlag, awsRegionFlag, allowedGroupFlag, dryRunFlag, maxRevocationsFlag, revokeUnknownUsersFlag, lockTableFlag, lockLeaseDurationFlag, pkiStorageFlag, kmsKeyIdFlag, usernameRuleFlag, webhookUrlFlag, slackWebhookUrlFlag, webhookSpoolDirFlag, managementAddressFlag, managementPasswordFileFlag},
+		},
+		{
+			Name: "status",
+			Usage: "Show the clients connected to the OpenVPN server, flagging any whose certificate is revoked or expired",
+			Action: errors.WithPanicHandling(showStatus),
+			Flags: []cli.Flag{debugFlag, statusManagementAddressFlag, managementPasswordFileFlag, statusFileFlag, jsonFlag, awsRegionFlag, pkiStorageFlag},
+		},
+		{
+			Name: "list",
+			Usage: "List the user certificates issued by the OpenVPN server and when each user was last connected",
+			Action: errors.WithPanicHandling(listCertificates),
+			Flags: []cli.Flag{debugFlag, historyFileFlag, jsonFlag, awsRegionFlag, pkiStorageFlag},
+		},
+		{
+			Name: "history",
+			Usage: "Show the connection history and bandwidth usage of a user",
+			Action: errors.WithPanicHandling(showHistory),
+			Flags: []cli.Flag{debugFlag, usernameFlag, historyFileFlag, jsonFlag},
+		},
+		{
+			Name: "client-connect",
+			Usage: "Record a new connection. Invoked by OpenVPN through the client-connect directive.",
+			Action: errors.WithPanicHandling(clientConnectHook),
+			Flags: []cli.Flag{debugFlag, historyFileFlag},
+		},
+		{
+			Name: "client-disconnect",
+			Usage: "Record the end of a connection. Invoked by OpenVPN through the client-disconnect directive.",
+			Action: errors.WithPanicHandling(clientDisconnectHook),
+			Flags: []cli.Flag{debugFlag, historyFileFlag},
+		},
+		{
+			Name: "backup",
+			Usage: "Back up the PKI to S3 as a checksummed, KMS encrypted archive",
+			Action: errors.WithPanicHandling(backupPki),
+			Flags: []cli.Flag{debugFlag, awsRegionFlag, backupDestinationFlag, backupKmsKeyIdFlag, lockTableFlag, lockLeaseDurationFlag},
+		},
+		{
+			Name: "restore",
+			Usage: "Restore the PKI from a backup in S3",
+			Action: errors.WithPanicHandling(restorePki),
+			Flags: []cli.Flag{debugFlag, awsRegionFlag, restoreSourceFlag, verifyFlag, restoreDryRunFlag, lockTableFlag, lockLeaseDurationFlag, pkiStorageFlag, kmsKeyIdFlag},
+		},
+		{
+			Name: "doctor",
+			Usage: "Check the PKI on the OpenVPN server for problems and print how to fix them. Exits non-zero if any are found.",
+			Action: errors.WithPanicHandling(runDoctor),
+			Flags: []cli.Flag{debugFlag},
+		},
+		{
+			Name: "crl",
+			Usage: "Inspect and manage the certificate revocation list (CRL) on the OpenVPN server",
+			Subcommands: []cli.Command{
+				{
+					Name: "show",
+					Usage: "Show when the CRL was last updated, when it must next be updated and which certificates it revokes",
+					Action: errors.WithPanicHandling(showCrl),
+					Flags: []cli.Flag{debugFlag, awsRegionFlag, pkiStorageFlag},
+				},
+				{
+					Name: "regenerate",
+					Usage: "Regenerate the CRL from the certificate index, extending its next update",
+					Action: errors.WithPanicHandling(regenerateCrlCommand),
+					Flags: []cli.Flag{debugFlag, awsRegionFlag, lockTableFlag, lockLeaseDurationFlag, pkiStorageFlag, kmsKeyIdFlag},
+				},
+				{
+					Name: "publish",
+					Usage: "Upload the CRL to S3 for other consumers",
+					Action: errors.WithPanicHandling(publishCrl),
+					Flags: []cli.Flag{debugFlag, awsRegionFlag, crlDestinationFlag, kmsKeyIdFlag, pkiStorageFlag},
+				},
+			},
+		},
+		{
+			Name: "dev",
+			Usage: "Run a throwaway CA and OpenVPN server handlers in this process and a shell to run request, fetch, revoke and list against them. Needs no AWS resources.",
+			Action: errors.WithPanicHandling(runDevShell),
+			Flags: []cli.Flag{debugFlag, usernameRuleFlag, maxDevicesFlag, keepFlag},
 		},
 	}
 
+	app.Commands = withAwsClientFlags(app.Commands, awsClientFlags)
 	app.CommandNotFound = commandNotFound
 
 	return app
 }
 
+// Add the AWS client options to the given commands and their subcommands, and have them configure the AWS client
+func withAwsClientFlags(commands []cli.Command, awsClientFlags []cli.Flag) []cli.Command {
+	for i := range commands {
+		if len(commands[i].Subcommands) > 0 {
+			commands[i].Subcommands = withAwsClientFlags(commands[i].Subcommands, awsClientFlags)
+			continue
+		}
+		commands[i].Flags = append(commands[i].Flags, awsClientFlags...)
+		commands[i].Before = checkAwsClientOptions
+	}
+	return commands
+}
+
 func commandNotFound(cliContext *cli.Context, command string) {
 	fmt.Fprintf(cliContext.App.Writer, "Error: unrecognized command '%s'", command)
 }
@@ -99,3 +641,16 @@ var MissingUsername = fmt.Errorf("--%s cannot be empty", OPTION_USERNAME)
 var MissingAwsRegion = fmt.Errorf("--%s cannot be empty", OPTION_AWS_REGION)
 var MissingRequestUrl = fmt.Errorf("--%s cannot be empty", OPTION_REQUEST_URL)
 var MissingRevokeUrl = fmt.Errorf("--%s cannot be empty", OPTION_REVOKE_URL)
+var MissingDestination = fmt.Errorf("--%s cannot be empty", OPTION_DESTINATION)
+var MissingKmsKeyId = fmt.Errorf("--%s cannot be empty", OPTION_KMS_KEY_ID)
+var MissingRoleArn = fmt.Errorf("--%s and --%s require --%s", OPTION_EXTERNAL_ID, OPTION_MFA_SERIAL, OPTION_ROLE_ARN)
+var MissingRequestId = fmt.Errorf("Usage: openvpn-admin fetch <id>, where <id> is the request ID printed by 'request --%s'", OPTION_NO_WAIT)
+var MissingSource = fmt.Errorf("--%s cannot be empty", OPTION_SOURCE)
+var RequestTimeoutTooShort = fmt.Errorf("--%s must be longer than %s, as SQS long polls take that long", OPTION_REQUEST_TIMEOUT, SQS_LONG_POLL_DURATION)
+var MissingLockTable = fmt.Errorf("--%s requires --%s", OPTION_LEADER_ONLY, OPTION_LOCK_TABLE)
+var RequireApprovalWithLeaderOnly = fmt.Errorf("--%s can't be combined with --%s, as requests waiting for approval are kept on the server that received them, and a standby taking over wouldn't know about them", OPTION_REQUIRE_APPROVAL, OPTION_LEADER_ONLY)
+var LeaderOnlyWithLocalPki = fmt.Errorf("--%s requires --%s to be an S3 URI, as a standby taking over must serve the leader's PKI rather than its own", OPTION_LEADER_ONLY, OPTION_PKI_STORAGE)
+var DeviceAndAllDevices = fmt.Errorf("Only one of --%s and --%s may be set", OPTION_DEVICE, OPTION_ALL_DEVICES)
+var MissingPendingRequestId = fmt.Errorf("Usage: openvpn-admin approve|deny <id>, where <id> is a request ID listed by 'openvpn-admin pending'")
+var MissingReason = fmt.Errorf("--%s must be set, so the requester knows why their request was denied", OPTION_REASON)
+var MissingStatusSource = fmt.Errorf("One of --%s or --%s must be set", OPTION_MANAGEMENT_ADDRESS, OPTION_STATUS_FILE)
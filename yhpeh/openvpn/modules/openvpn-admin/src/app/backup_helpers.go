@@ -0,0 +1,333 @@
+package app
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+)
+
+// Bump this whenever the layout of the archive changes in a way older versions of openvpn-admin can't restore
+const BACKUP_FORMAT_VERSION = 1
+
+const BACKUP_MANIFEST_NAME = "manifest.json"
+const BACKUP_FILE_PREFIX = "openvpn-pki-"
+const BACKUP_FILE_SUFFIX = ".tar.gz"
+const BACKUP_CHECKSUM_SUFFIX = ".sha256"
+
+const OPENVPN_PATH = "/etc/openvpn"
+const CA_CERT_PATH = "/etc/openvpn/ca.crt"
+const CA_KEY_PATH = "/etc/openvpn/ca.key"
+const SERIAL_FILE_PATH = "/etc/openvpn/serial"
+const VARS_LOCAL_PATH = "/etc/openvpn-ca/vars.local"
+
+// The files in /etc/openvpn that make up the PKI. These are the same files init-openvpn restores from S3.
+var PKI_STATE_FILE_PATTERNS = []string{"*.crt", "*.key", "*.pem", "*.csr", "serial", "serial.old", "index.txt", "index.txt.old", "index.txt.attr", "index.txt.attr.old"}
+
+// Describes the contents of a backup archive. It is the first entry in the archive.
+type backupManifest struct {
+	FormatVersion int
+	CreatedAt     time.Time
+	Hostname      string
+	Files         []backupFile
+}
+
+type backupFile struct {
+	Path   string
+	Mode   os.FileMode
+	Size   int64
+	Sha256 string
+}
+
+// A backup archive read into memory. Files maps the absolute path of each file to its contents.
+type pkiBackup struct {
+	Manifest backupManifest
+	Files    map[string][]byte
+}
+
+// Return the paths of all PKI files on this server, sorted
+func collectBackupFiles() ([]string, error) {
+	paths, err := collectPkiStateFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	paths = append(paths, VARS_LOCAL_PATH)
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Return the paths of the files in /etc/openvpn that make up the PKI, i.e. everything easy-rsa creates or modifies
+func collectPkiStateFiles() ([]string, error) {
+	paths := []string{}
+
+	for _, pattern := range PKI_STATE_FILE_PATTERNS {
+		matches, err := filepath.Glob(filepath.Join(OPENVPN_PATH, pattern))
+		if err != nil {
+			return nil, errors.WithStackTrace(err)
+		}
+		paths = append(paths, matches...)
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Read all PKI files into memory, under the PKI lock, so that the backup doesn't catch a certificate being issued or
+// revoked halfway (e.g. with a serial that doesn't match index.txt)
+func readPkiForBackup() (pkiBackup, error) {
+	lock, err := lockPki()
+	if err != nil {
+		return pkiBackup{}, err
+	}
+	defer lock.Unlock()
+
+	paths, err := collectBackupFiles()
+	if err != nil {
+		return pkiBackup{}, err
+	}
+
+	return readBackupFiles(paths)
+}
+
+// Read the given files into memory so they can be verified and archived
+func readBackupFiles(paths []string) (pkiBackup, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return pkiBackup{}, errors.WithStackTrace(err)
+	}
+
+	backup := pkiBackup{
+		Manifest: backupManifest{FormatVersion: BACKUP_FORMAT_VERSION, CreatedAt: time.Now().UTC(), Hostname: hostname},
+		Files:    map[string][]byte{},
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return pkiBackup{}, errors.WithStackTrace(err)
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return pkiBackup{}, errors.WithStackTrace(err)
+		}
+
+		backup.Files[path] = contents
+		backup.Manifest.Files = append(backup.Manifest.Files, backupFile{
+			Path:   path,
+			Mode:   info.Mode().Perm(),
+			Size:   int64(len(contents)),
+			Sha256: sha256Hex(contents),
+		})
+	}
+
+	return backup, nil
+}
+
+// Write the backup as a gzipped tarball with the manifest as its first entry
+func createBackupArchive(backup pkiBackup) ([]byte, error) {
+	manifestJson, err := json.MarshalIndent(backup.Manifest, "", "  ")
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	archive := bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(&archive)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	writeEntry := func(name string, mode os.FileMode, contents []byte) error {
+		header := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(contents)), ModTime: backup.Manifest.CreatedAt}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return errors.WithStackTrace(err)
+		}
+		_, err := tarWriter.Write(contents)
+		return errors.WithStackTrace(err)
+	}
+
+	if err := writeEntry(BACKUP_MANIFEST_NAME, 0600, manifestJson); err != nil {
+		return nil, err
+	}
+
+	for _, file := range backup.Manifest.Files {
+		if err := writeEntry(strings.TrimPrefix(file.Path, "/"), file.Mode, backup.Files[file.Path]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	return archive.Bytes(), nil
+}
+
+// Read a backup archive, checking every file against the checksum recorded in the manifest
+func readBackupArchive(archive []byte) (pkiBackup, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return pkiBackup{}, errors.WithStackTraceAndPrefix(err, "Backup is not a gzipped archive")
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	backup := pkiBackup{Files: map[string][]byte{}}
+	hasManifest := false
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return pkiBackup{}, errors.WithStackTraceAndPrefix(err, "Backup archive is corrupt")
+		}
+
+		contents, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return pkiBackup{}, errors.WithStackTraceAndPrefix(err, "Backup archive is corrupt")
+		}
+
+		if header.Name == BACKUP_MANIFEST_NAME {
+			if err := json.Unmarshal(contents, &backup.Manifest); err != nil {
+				return pkiBackup{}, errors.WithStackTraceAndPrefix(err, "Unable to parse the backup manifest")
+			}
+			hasManifest = true
+			continue
+		}
+
+		path := "/" + header.Name
+		if !isRestorablePath(path) {
+			return pkiBackup{}, errors.WithStackTrace(InvalidBackup(fmt.Sprintf("unexpected file %s", header.Name)))
+		}
+		backup.Files[path] = contents
+	}
+
+	if !hasManifest {
+		return pkiBackup{}, errors.WithStackTrace(InvalidBackup("it has no " + BACKUP_MANIFEST_NAME))
+	}
+
+	if backup.Manifest.FormatVersion > BACKUP_FORMAT_VERSION {
+		return pkiBackup{}, errors.WithStackTrace(InvalidBackup(fmt.Sprintf("format version %d is newer than this version of openvpn-admin supports (%d)", backup.Manifest.FormatVersion, BACKUP_FORMAT_VERSION)))
+	}
+
+	for _, file := range backup.Manifest.Files {
+		contents, exists := backup.Files[file.Path]
+		if !exists {
+			return pkiBackup{}, errors.WithStackTrace(InvalidBackup(fmt.Sprintf("%s is listed in the manifest but missing from the archive", file.Path)))
+		}
+		if sha256Hex(contents) != file.Sha256 {
+			return pkiBackup{}, errors.WithStackTrace(InvalidBackup(fmt.Sprintf("checksum of %s does not match the manifest", file.Path)))
+		}
+	}
+
+	if len(backup.Files) != len(backup.Manifest.Files) {
+		return pkiBackup{}, errors.WithStackTrace(InvalidBackup("the archive contains files that are not listed in the manifest"))
+	}
+
+	return backup, nil
+}
+
+// Only files directly in /etc/openvpn and vars.local may be restored, so a tampered archive can't write elsewhere
+func isRestorablePath(path string) bool {
+	if filepath.Clean(path) != path {
+		return false
+	}
+	return filepath.Dir(path) == OPENVPN_PATH || path == VARS_LOCAL_PATH
+}
+
+// Check that the backup holds a usable PKI. Returns a description of each problem.
+func verifyBackup(backup pkiBackup) []string {
+	problems := []string{}
+	for _, finding := range checkPkiConsistency(backup.Files) {
+		problems = append(problems, finding.Problem)
+	}
+	return problems
+}
+
+// Put the files from the backup in place. Private keys are only readable by their owner, whatever the manifest says.
+func restoreBackup(backup pkiBackup) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	return changePki(func() error {
+		for _, file := range backup.Manifest.Files {
+			mode := file.Mode
+			if strings.HasSuffix(file.Path, ".key") {
+				mode = 0600
+			}
+
+			if err := replaceFile(file.Path, backup.Files[file.Path], mode); err != nil {
+				return err
+			}
+			logger.Debugf("Restored %s", file.Path)
+		}
+		return nil
+	})
+}
+
+// Write a file to a temporary file first and then rename it into place, so that OpenVPN never sees a partially written
+// file. The file gets the owner of the directory it is written into.
+func replaceFile(path string, contents []byte, mode os.FileMode) error {
+	directory := filepath.Dir(path)
+	if err := os.MkdirAll(directory, 0770); err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	temporaryPath := path + ".replacing"
+	if err := ioutil.WriteFile(temporaryPath, contents, mode); err != nil {
+		return errors.WithStackTrace(err)
+	}
+	if err := os.Chmod(temporaryPath, mode); err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	if info, err := os.Stat(directory); err == nil {
+		if owner, isUnix := info.Sys().(*syscall.Stat_t); isUnix {
+			if err := os.Chown(temporaryPath, int(owner.Uid), int(owner.Gid)); err != nil {
+				return errors.WithStackTrace(err)
+			}
+		}
+	}
+
+	return errors.WithStackTrace(os.Rename(temporaryPath, path))
+}
+
+// The name of the archive for a backup taken at the given time. Names sort in the order the backups were taken.
+func backupArchiveName(createdAt time.Time) string {
+	return BACKUP_FILE_PREFIX + createdAt.UTC().Format("20060102T150405Z") + BACKUP_FILE_SUFFIX
+}
+
+func sha256Hex(contents []byte) string {
+	checksum := sha256.Sum256(contents)
+	return hex.EncodeToString(checksum[:])
+}
+
+// Custom errors
+
+type InvalidBackup string
+
+func (err InvalidBackup) Error() string {
+	return fmt.Sprintf("Invalid PKI backup: %s", string(err))
+}
+
+type BackupVerificationFailed []string
+
+func (err BackupVerificationFailed) Error() string {
+	return fmt.Sprintf("PKI backup failed verification:\n  %s", strings.Join(err, "\n  "))
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/files"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/urfave/cli"
+)
+
+// The maximum number of requests a batch has in flight at once. Each one holds its own temporary response queue.
+const MAX_CONCURRENT_BATCH_REQUESTS = 10
+
+// The outcome of a single request or revocation in a batch submitted with --from-file
+type batchResult struct {
+	Username    string
+	Success     bool
+	ProfilePath string `json:",omitempty"`
+	RequestId   string `json:",omitempty"`
+	Error       string `json:",omitempty"`
+}
+
+// Read usernames from a newline separated or CSV file. Only the first column is used, so a CSV export with extra
+// columns works as-is. Blank lines, lines starting with # and a "username" header are skipped.
+func readUsernamesFromFile(path string) ([]string, error) {
+	contents, err := files.ReadFileAsString(path)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	usernames := []string{}
+	seen := map[string]bool{}
+
+	for lineNumber, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username := mapUsername(strings.Trim(strings.TrimSpace(strings.Split(line, ",")[0]), `"`))
+		if username == "" || strings.EqualFold(username, "username") || seen[username] {
+			continue
+		}
+
+		// Reject the whole file rather than sending requests for only some of its users
+		if err := checkUsername(username); err != nil {
+			return nil, errors.WithStackTraceAndPrefix(err, "%s, line %d", path, lineNumber+1)
+		}
+
+		seen[username] = true
+		usernames = append(usernames, username)
+	}
+
+	if len(usernames) == 0 {
+		return nil, errors.WithStackTrace(NoUsernamesInFile(path))
+	}
+
+	return usernames, nil
+}
+
+// Run the given operation for every username concurrently and collect the results in the same order as the usernames.
+// The operation fills in what it produced, i.e. the path of the profile it wrote or the ID of the request it submitted,
+// and runBatch the rest.
+func runBatch(usernames []string, operation func(username string) (batchResult, error)) []batchResult {
+	results := make([]batchResult, len(usernames))
+	slots := make(chan bool, MAX_CONCURRENT_BATCH_REQUESTS)
+
+	var waitGroup sync.WaitGroup
+	for i, username := range usernames {
+		waitGroup.Add(1)
+		go func(i int, username string) {
+			defer waitGroup.Done()
+			slots <- true
+			defer func() { <-slots }()
+
+			result, err := operation(username)
+			result.Username, result.Success = username, err == nil
+			results[i] = result
+			if err != nil {
+				results[i].Error = errors.Unwrap(err).Error()
+			}
+		}(i, username)
+	}
+	waitGroup.Wait()
+
+	return results
+}
+
+// Print a summary table of the batch results, write the machine-readable report if --report is set, and return an
+// error if any of the operations failed
+func reportBatchResults(cliContext *cli.Context, results []batchResult) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	failures := 0
+	table := tabwriter.NewWriter(cliContext.App.Writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "USERNAME\tRESULT\tDETAILS")
+	for _, result := range results {
+		if result.Success && result.RequestId != "" {
+			fmt.Fprintf(table, "%s\tsubmitted\trequest %s\n", result.Username, result.RequestId)
+		} else if result.Success {
+			fmt.Fprintf(table, "%s\tok\t%s\n", result.Username, result.ProfilePath)
+		} else {
+			failures++
+			fmt.Fprintf(table, "%s\tfailed\t%s\n", result.Username, result.Error)
+		}
+	}
+	table.Flush()
+
+	if reportPath := cliContext.String(OPTION_REPORT); reportPath != "" {
+		reportJson, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return errors.WithStackTrace(err)
+		}
+		if err := ioutil.WriteFile(reportPath, reportJson, 0644); err != nil {
+			return errors.WithStackTrace(err)
+		}
+		logger.Infof("Wrote batch report to %s", reportPath)
+	}
+
+	if failures > 0 {
+		return errors.WithStackTrace(BatchFailed{Failed: failures, Total: len(results)})
+	}
+
+	logger.Info("DONE")
+	return nil
+}
+
+// Custom errors
+
+type NoUsernamesInFile string
+
+func (err NoUsernamesInFile) Error() string {
+	return fmt.Sprintf("No usernames found in %s", string(err))
+}
+
+type BatchFailed struct {
+	Failed int
+	Total  int
+}
+
+func (err BatchFailed) Error() string {
+	return fmt.Sprintf("%d of %d operations failed", err.Failed, err.Total)
+}
@@ -2,12 +2,15 @@ package app
 
 import (
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 	"github.com/gruntwork-io/gruntwork-cli/errors"
 	"github.com/gruntwork-io/gruntwork-cli/logging"
 	"fmt"
 	"regexp"
 	"github.com/gruntwork-io/gruntwork-cli/files"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
 )
 
 type certificatePartData struct {
@@ -18,8 +21,163 @@ type certificatePartData struct {
 	Error           error
 }
 
-func generateCertificate(username string) (string, error) {
-	command := exec.Command("./generate-wrapper.sh", username)
+// Issue a new certificate with the given common name (a username, optionally with a device, see client.CertificateName) and
+// return the rendered OpenVPN client profile. validFor is the validity the request asked for, or 0 for the default (see
+// certificateValidityDays). This is the server-side issuance logic shared by the request queue and the web portal.
+func issueCertificate(commonName string, validFor time.Duration) (string, error) {
+	if err := checkCommonName(commonName); err != nil {
+		return "", err
+	}
+
+	days, err := certificateValidityDays(commonName, validFor)
+	if err != nil {
+		return "", err
+	}
+
+	var profile string
+	err = changePki(func() error {
+		entries, _, err := markExpiredCertificates()
+		if err != nil {
+			return err
+		}
+
+		if err := checkUsernameCollision(entries, commonName); err != nil {
+			return err
+		}
+
+		if hasValidCertificate(entries, commonName) {
+			return errors.WithStackTrace(fmt.Errorf("a valid certificate for %s already exists", commonName))
+		}
+
+		username, _ := client.SplitCertificateName(commonName)
+		if err := checkDeviceLimit(entries, username); err != nil {
+			return err
+		}
+
+		profile, err = generateCertificate(commonName, days)
+		return err
+	})
+	if err == nil {
+		notifyCertificateEvent(EVENT_CERTIFICATE_ISSUED, commonName, "", "")
+	}
+	return profile, err
+}
+
+// Revoke the valid certificate with the given common name and disconnect its active sessions (see
+// disconnectRevokedClients), returning how many were terminated. This is the server-side revocation logic shared by
+// the revocation queue, sync-iam and the web portal.
+func revokeUserCertificate(commonName string) (int, error) {
+	if err := checkCommonName(commonName); err != nil {
+		return 0, err
+	}
+
+	err := changePki(func() error {
+		entries, err := readWorkingIndex()
+		if err != nil {
+			return err
+		}
+
+		if !hasValidCertificate(entries, commonName) {
+			return errors.WithStackTrace(fmt.Errorf("a valid certificate for %s does not exist", commonName))
+		}
+
+		return revokeCertificate(commonName)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	notifyCertificateEvent(EVENT_CERTIFICATE_REVOKED, commonName, "", "")
+	return disconnectRevokedClients(commonName), nil
+}
+
+// Revoke the valid certificates of all of the given user's devices, including the one without a device, disconnect
+// their active sessions and return their common names and how many sessions were terminated
+func revokeAllUserCertificates(username string) ([]string, int, error) {
+	if err := checkUsername(username); err != nil {
+		return nil, 0, err
+	}
+
+	revoked := []string{}
+	err := changePki(func() error {
+		entries, err := readWorkingIndex()
+		if err != nil {
+			return err
+		}
+
+		certificates := validCertificatesOf(entries, username)
+		if len(certificates) == 0 {
+			return errors.WithStackTrace(fmt.Errorf("%s has no valid certificates", username))
+		}
+
+		for _, certificate := range certificates {
+			if err := revokeCertificate(certificate.CommonName); err != nil {
+				return err
+			}
+			revoked = append(revoked, certificate.CommonName)
+		}
+		return nil
+	})
+	if err != nil {
+		return revoked, 0, err
+	}
+
+	for _, commonName := range revoked {
+		notifyCertificateEvent(EVENT_CERTIFICATE_REVOKED, commonName, "", "")
+	}
+	return revoked, disconnectRevokedClients(revoked...), nil
+}
+
+// Revoke the current certificate with the given common name (if any) and issue a new one in its place, valid for the
+// default validity
+func renewCertificate(commonName string) (string, error) {
+	if err := checkCommonName(commonName); err != nil {
+		return "", err
+	}
+
+	days, err := certificateValidityDays(commonName, 0)
+	if err != nil {
+		return "", err
+	}
+
+	var profile string
+	err = changePki(func() error {
+		entries, _, err := markExpiredCertificates()
+		if err != nil {
+			return err
+		}
+
+		if err := checkUsernameCollision(entries, commonName); err != nil {
+			return err
+		}
+
+		if hasValidCertificate(entries, commonName) {
+			if err := revokeCertificate(commonName); err != nil {
+				return err
+			}
+		} else {
+			username, _ := client.SplitCertificateName(commonName)
+			if err := checkDeviceLimit(entries, username); err != nil {
+				return err
+			}
+		}
+
+		profile, err = generateCertificate(commonName, days)
+		return err
+	})
+	if err == nil {
+		notifyCertificateEvent(EVENT_CERTIFICATE_RENEWED, commonName, "", "")
+	}
+	return profile, err
+}
+
+// Generate a certificate for the given user, valid for the given number of days, or for KEY_EXPIRE days if that is 0
+func generateCertificate(username string, days int) (string, error) {
+	args := []string{username}
+	if days > 0 {
+		args = append(args, strconv.Itoa(days))
+	}
+	command := exec.Command("./generate-wrapper.sh", args...)
 	command.Dir = "/etc/openvpn-ca"
 
 	_, err := command.CombinedOutput()
@@ -27,6 +185,12 @@ func generateCertificate(username string) (string, error) {
 		return "", errors.WithStackTrace(err)
 	}
 
+	if days > 0 {
+		if err := checkIssuedValidity(username, days); err != nil {
+			return "", err
+		}
+	}
+
 	content, err := generateCertificateTemplate(username)
 	if err != nil {
 		return "", errors.WithStackTrace(err)
@@ -46,12 +210,17 @@ func generateCertificateTemplate(username string) (string, error) {
 		return "", data.Error
 	}
 
+	return renderProfile(template, data), nil
+}
+
+// Fill in the placeholders of an OpenVPN client profile template
+func renderProfile(template string, data certificatePartData) string {
 	template = strings.Replace(template, "__SERVER_ADDRESS__", data.IpAddress, -1)
 	template = strings.Replace(template, "__CA_CERTIFICATE__", data.CaCertificate, -1)
 	template = strings.Replace(template, "__CLIENT_CERTIFICATE__", data.UserCertificate, -1)
 	template = strings.Replace(template, "__CLIENT_KEY__", data.UserKey, -1)
 
-	return template, nil
+	return template
 }
 
 func getCertificatePartData(username string) certificatePartData {
@@ -111,14 +280,23 @@ func readTemplateFile() (string, error) {
 	return files.ReadFileAsString("/etc/openvpn/openvpn-client.ovpn")
 }
 
+// The profile is rendered during the change that issued the certificate, so its parts come from the working copy
 func readCaCert() (string, error) {
-	return files.ReadFileAsString("/etc/openvpn/ca.crt")
+	return readWorkingPkiFileAsString(CA_CERT_PATH)
 }
 
 func readUserCert(username string) (string, error) {
-	return files.ReadFileAsString("/etc/openvpn/" + username + ".crt")
+	path, err := userPkiPath(username, ".crt")
+	if err != nil {
+		return "", err
+	}
+	return readWorkingPkiFileAsString(path)
 }
 
 func readUserKey(username string) (string, error) {
-	return files.ReadFileAsString("/etc/openvpn/" + username + ".key")
+	path, err := userPkiPath(username, ".key")
+	if err != nil {
+		return "", err
+	}
+	return readWorkingPkiFileAsString(path)
 }
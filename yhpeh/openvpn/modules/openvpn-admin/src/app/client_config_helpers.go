@@ -0,0 +1,258 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/urfave/cli"
+)
+
+// Where the client config is read from if --config is not set, relative to the home directory
+const DEFAULT_CLIENT_CONFIG_PATH = ".openvpn-admin/config.json"
+
+// The client config lists the OpenVPN servers (e.g. one per environment) that request, revoke and fetch can talk to
+// with --server or --all-servers:
+//
+//	{
+//	  "servers": {
+//	    "stage": {"aws_region": "us-east-1", "queue_tags": {"openvpn-admin:server": "stage"}},
+//	    "prod": {"aws_region": "us-west-2", "profile": "prod", "role_arn": "arn:aws:iam::222222222222:role/vpn"}
+//	  }
+//	}
+type clientConfig struct {
+	Servers map[string]serverConfig `json:"servers"`
+}
+
+// The settings of a single server. Each one corresponds to the option of the same name, and settings that are left
+// empty fall back to the options given on the command line.
+type serverConfig struct {
+	AwsRegion  string            `json:"aws_region"`
+	Profile    string            `json:"profile"`
+	RoleArn    string            `json:"role_arn"`
+	ExternalId string            `json:"external_id"`
+	MfaSerial  string            `json:"mfa_serial"`
+	RequestUrl string            `json:"request_url"`
+	RevokeUrl  string            `json:"revoke_url"`
+	QueueTags  map[string]string `json:"queue_tags"`
+}
+
+// The settings of the server as options, by option name
+func (server serverConfig) options() map[string]string {
+	return map[string]string{
+		OPTION_AWS_REGION:  server.AwsRegion,
+		OPTION_PROFILE:     server.Profile,
+		OPTION_ROLE_ARN:    server.RoleArn,
+		OPTION_EXTERNAL_ID: server.ExternalId,
+		OPTION_MFA_SERIAL:  server.MfaSerial,
+		OPTION_REQUEST_URL: server.RequestUrl,
+		OPTION_REVOKE_URL:  server.RevokeUrl,
+		OPTION_QUEUE_TAGS:  formatQueueTags(server.QueueTags),
+	}
+}
+
+// Read the client config from --config or, if that is not set, from the default location. A missing config is only an
+// error if --config was set.
+func loadClientConfig(cliContext *cli.Context) (clientConfig, string, error) {
+	config := clientConfig{Servers: map[string]serverConfig{}}
+
+	path := cliContext.String(OPTION_CONFIG)
+	explicit := path != ""
+	if !explicit {
+		path = filepath.Join(os.Getenv("HOME"), DEFAULT_CLIENT_CONFIG_PATH)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return config, path, nil
+	}
+	if err != nil {
+		return config, path, errors.WithStackTrace(err)
+	}
+
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return config, path, errors.WithStackTraceAndPrefix(err, "Unable to parse %s", path)
+	}
+
+	// Server names end up in the file names of profiles
+	for name := range config.Servers {
+		if !usernamePattern.MatchString(name) {
+			return config, path, errors.WithStackTrace(InvalidServerName{Name: name, ConfigPath: path})
+		}
+	}
+
+	return config, path, nil
+}
+
+// Return the names of the servers selected with --server or --all-servers, in alphabetical order, along with their
+// settings. Returns no servers if neither is set.
+func getSelectedServers(cliContext *cli.Context) ([]string, map[string]serverConfig, error) {
+	serverName := cliContext.String(OPTION_SERVER)
+	allServers := cliContext.Bool(OPTION_ALL_SERVERS)
+
+	if serverName == "" && !allServers {
+		return nil, nil, nil
+	}
+	if serverName != "" && allServers {
+		return nil, nil, errors.WithStackTrace(ServerAndAllServers)
+	}
+
+	config, path, err := loadClientConfig(cliContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if allServers {
+		names := []string{}
+		for name := range config.Servers {
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			return nil, nil, errors.WithStackTrace(NoServersConfigured(path))
+		}
+		sort.Strings(names)
+		return names, config.Servers, nil
+	}
+
+	if _, exists := config.Servers[serverName]; !exists {
+		// Servers deployed by the openvpn-server module tag their queues with their name, so they can be used without
+		// a client config
+		if !usernamePattern.MatchString(serverName) {
+			return nil, nil, errors.WithStackTrace(InvalidServerName{Name: serverName, ConfigPath: path})
+		}
+		logging.GetLogger(LOGGER_NAME).Debugf("%s is not in %s, so looking for queues tagged %s=%s", serverName, path, QUEUE_TAG_SERVER, serverName)
+		config.Servers[serverName] = serverConfig{QueueTags: map[string]string{QUEUE_TAG_SERVER: serverName}}
+	}
+	return []string{serverName}, config.Servers, nil
+}
+
+// Run the given action once for each server selected with --server or --all-servers, with the settings of that server
+// applied to the options of the command, or just once, with the options as given, if neither is set. The action is
+// passed the name of the server, which is empty in the latter case. With --all-servers, a failure on one server doesn't
+// stop the others.
+func forEachServer(cliContext *cli.Context, action func(serverName string) error) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	names, servers, err := getSelectedServers(cliContext)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return action("")
+	}
+
+	// Settings a server leaves empty fall back to these
+	defaults := map[string]string{}
+	for name := range (serverConfig{}).options() {
+		if hasFlag(cliContext, name) {
+			defaults[name] = awsClientString(cliContext, name)
+		}
+	}
+
+	failed := []string{}
+	for _, name := range names {
+		logger.Infof("Using OpenVPN server %s", name)
+
+		err := useServer(cliContext, servers[name], defaults)
+		if err == nil {
+			err = action(name)
+		}
+
+		if err != nil {
+			if len(names) == 1 {
+				return err
+			}
+			logger.Errorf("Failed on OpenVPN server %s: %s", name, errors.Unwrap(err).Error())
+			failed = append(failed, name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.WithStackTrace(ServersFailed(failed))
+	}
+	return nil
+}
+
+// Apply the settings of the given server to the options of the command, and set up the AWS client for them
+func useServer(cliContext *cli.Context, server serverConfig, defaults map[string]string) error {
+	for name, value := range server.options() {
+		if !hasFlag(cliContext, name) {
+			continue
+		}
+		if value == "" {
+			value = defaults[name]
+		}
+		if err := cliContext.Set(name, value); err != nil {
+			return errors.WithStackTrace(err)
+		}
+		// The AWS client options may also have been given before the command, and whether an option was set is only
+		// looked up once, so replace the value there too rather than rely on the one after the command to win
+		if cliContext.GlobalIsSet(name) {
+			if err := cliContext.GlobalSet(name, value); err != nil {
+				return errors.WithStackTrace(err)
+			}
+		}
+	}
+
+	return checkAwsClientOptions(cliContext)
+}
+
+// Whether the command being run has the given option
+func hasFlag(cliContext *cli.Context, name string) bool {
+	for _, flag := range cliContext.Command.Flags {
+		if flag.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Format tags in the form --queue-tags takes them, sorted by key
+func formatQueueTags(tags map[string]string) string {
+	pairs := []string{}
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// The file name of the OpenVPN profile for the given user. Profiles for a server selected with --server or
+// --all-servers carry its name, so that the profiles of different servers don't overwrite each other.
+func profileFileName(username string, serverName string) string {
+	if serverName == "" {
+		return username + ".ovpn"
+	}
+	return username + "-" + serverName + ".ovpn"
+}
+
+// Custom errors
+
+var ServerAndAllServers = fmt.Errorf("Only one of --%s and --%s may be set", OPTION_SERVER, OPTION_ALL_SERVERS)
+
+type NoServersConfigured string
+
+func (err NoServersConfigured) Error() string {
+	return fmt.Sprintf("--%s requires servers to be configured in %s", OPTION_ALL_SERVERS, string(err))
+}
+
+type ServersFailed []string
+
+func (err ServersFailed) Error() string {
+	return fmt.Sprintf("Failed on OpenVPN servers: %s", strings.Join(err, ", "))
+}
+
+type InvalidServerName struct {
+	Name       string
+	ConfigPath string
+}
+
+func (err InvalidServerName) Error() string {
+	return fmt.Sprintf("Invalid server name %q in %s. Server names may only contain letters, digits and . _ @ -, starting with a letter or digit.", err.Name, err.ConfigPath)
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/urfave/cli"
+)
+
+// Archive the PKI (CA, certificates, index, serial, CRL and vars.local) and upload it to S3, encrypted with KMS. Each
+// backup is a new object named after the time it was taken, alongside a .sha256 file holding the archive's checksum.
+func backupPki(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	awsRegion, err := getAwsRegion(cliContext)
+	if err != nil {
+		return err
+	}
+
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	destination := cliContext.String(OPTION_DESTINATION)
+	if destination == "" {
+		return errors.WithStackTrace(MissingDestination)
+	}
+
+	kmsKeyId := cliContext.String(OPTION_KMS_KEY_ID)
+	if kmsKeyId == "" {
+		return errors.WithStackTrace(MissingKmsKeyId)
+	}
+
+	bucket, prefix, err := aws_helpers.ParseS3Uri(destination)
+	if err != nil {
+		return err
+	}
+
+	if err := configurePkiLease(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	backup, err := readPkiForBackup()
+	if err != nil {
+		return err
+	}
+
+	// A backup of a broken PKI is still better than no backup, so problems are only reported
+	for _, problem := range verifyBackup(backup) {
+		logger.Warnf("PKI problem: %s", problem)
+	}
+
+	archive, err := createBackupArchive(backup)
+	if err != nil {
+		return err
+	}
+
+	key := strings.TrimSuffix(prefix, "/") + "/" + backupArchiveName(backup.Manifest.CreatedAt)
+	logger.Infof("Uploading backup of %d files to s3://%s/%s", len(backup.Manifest.Files), bucket, key)
+
+	if err := awsClient.PutS3Object(awsRegion, bucket, key, archive, "application/gzip", kmsKeyId); err != nil {
+		return err
+	}
+
+	checksum := fmt.Sprintf("%s  %s\n", sha256Hex(archive), backupArchiveName(backup.Manifest.CreatedAt))
+	if err := awsClient.PutS3Object(awsRegion, bucket, key+BACKUP_CHECKSUM_SUFFIX, []byte(checksum), "text/plain", kmsKeyId); err != nil {
+		return err
+	}
+
+	logger.Info("DONE")
+	return nil
+}
+
+// Download a backup from S3 and put its files in place. The source is either the S3 URI of a backup archive, or a
+// prefix, in which case the latest backup under it is restored.
+func restorePki(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	awsRegion, err := getAwsRegion(cliContext)
+	if err != nil {
+		return err
+	}
+
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	source := cliContext.String(OPTION_SOURCE)
+	if source == "" {
+		return errors.WithStackTrace(MissingSource)
+	}
+
+	bucket, key, err := aws_helpers.ParseS3Uri(source)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasSuffix(key, BACKUP_FILE_SUFFIX) {
+		key, err = awsClient.FindLatestS3Object(awsRegion, bucket, key, BACKUP_FILE_SUFFIX)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Infof("Downloading backup s3://%s/%s", bucket, key)
+	archive, err := awsClient.GetS3Object(awsRegion, bucket, key)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := awsClient.GetS3Object(awsRegion, bucket, key+BACKUP_CHECKSUM_SUFFIX)
+	if err != nil {
+		logger.Warnf("Unable to download the checksum of the backup, so only the checksums of the files within it will be checked: %s", err.Error())
+	} else if fields := strings.Fields(string(checksum)); len(fields) == 0 || fields[0] != sha256Hex(archive) {
+		return errors.WithStackTrace(InvalidBackup("the checksum of the archive does not match " + key + BACKUP_CHECKSUM_SUFFIX))
+	}
+
+	backup, err := readBackupArchive(archive)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Backup of %s taken at %s contains %d files", backup.Manifest.Hostname, backup.Manifest.CreatedAt, len(backup.Manifest.Files))
+
+	if cliContext.Bool(OPTION_VERIFY) {
+		if problems := verifyBackup(backup); len(problems) > 0 {
+			return errors.WithStackTrace(BackupVerificationFailed(problems))
+		}
+		logger.Info("Backup passed verification")
+	}
+
+	if err := configurePkiLease(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	if err := configurePkiStorage(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	if cliContext.Bool(OPTION_DRY_RUN) {
+		for _, file := range backup.Manifest.Files {
+			logger.Infof("Would restore %s (%d bytes)", file.Path, file.Size)
+		}
+		return nil
+	}
+
+	if err := restoreBackup(backup); err != nil {
+		return err
+	}
+
+	logger.Infof("Restored %d files. Restart OpenVPN to load the restored PKI.", len(backup.Manifest.Files))
+	return nil
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/urfave/cli"
+)
+
+// Invoked by OpenVPN through the client-connect directive. OpenVPN passes the details of the connection in environment
+// variables; see the "Environmental Variables" section of the openvpn man page.
+//
+// NOTE: OpenVPN rejects the connection if this hook fails, so errors are logged rather than returned. Losing a history
+// record is better than locking users out.
+func clientConnectHook(cliContext *cli.Context) error {
+	record := historyRecord{
+		Event:          HISTORY_EVENT_CONNECT,
+		CommonName:     os.Getenv("common_name"),
+		RealAddress:    os.Getenv("trusted_ip"),
+		VirtualAddress: os.Getenv("ifconfig_pool_remote_ip"),
+		Time:           hookTime(),
+	}
+
+	recordHookEvent(cliContext, record)
+	return nil
+}
+
+// Invoked by OpenVPN through the client-disconnect directive
+func clientDisconnectHook(cliContext *cli.Context) error {
+	record := historyRecord{
+		Event:          HISTORY_EVENT_DISCONNECT,
+		CommonName:     os.Getenv("common_name"),
+		RealAddress:    os.Getenv("trusted_ip"),
+		VirtualAddress: os.Getenv("ifconfig_pool_remote_ip"),
+		Time:           time.Now(),
+		BytesReceived:  envInt("bytes_received"),
+		BytesSent:      envInt("bytes_sent"),
+		DurationSecs:   envInt("time_duration"),
+	}
+
+	recordHookEvent(cliContext, record)
+	return nil
+}
+
+func recordHookEvent(cliContext *cli.Context, record historyRecord) {
+	setLoggerLevel(cliContext)
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	if record.CommonName == "" {
+		logger.Warnf("Ignoring %s hook call without a common_name. Is openvpn-admin being run by OpenVPN?", record.Event)
+		return
+	}
+
+	err := appendHistoryRecord(cliContext.String(OPTION_HISTORY_FILE), record)
+	if err != nil {
+		logger.Errorf("Unable to record %s of %s: %s", record.Event, record.CommonName, err.Error())
+		return
+	}
+
+	logger.Debugf("Recorded %s of %s from %s", record.Event, record.CommonName, record.RealAddress)
+}
+
+// OpenVPN sets time_unix to the time the client connected
+func hookTime() time.Time {
+	if connectedAt := envInt("time_unix"); connectedAt > 0 {
+		return time.Unix(connectedAt, 0)
+	}
+	return time.Now()
+}
+
+func envInt(name string) int64 {
+	value, _ := strconv.ParseInt(os.Getenv(name), 10, 64)
+	return value
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	divisor, exponent := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		divisor *= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(divisor), "KMGTPE"[exponent])
+}
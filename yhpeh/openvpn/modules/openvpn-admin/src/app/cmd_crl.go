@@ -0,0 +1,193 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/urfave/cli"
+)
+
+const CRL_METRIC_NAME = "CrlDaysUntilNextUpdate"
+
+func showCrl(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	if err := configurePkiStorage(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	status, err := readCrlStatus()
+	if err != nil {
+		return err
+	}
+
+	writer := cliContext.App.Writer
+	fmt.Fprintf(writer, "Issuer:      %s\n", status.Issuer)
+	fmt.Fprintf(writer, "This update: %s\n", status.ThisUpdate.Format(time.RFC3339))
+	fmt.Fprintf(writer, "Next update: %s (%s)\n", status.NextUpdate.Format(time.RFC3339), describeTimeUntilNextUpdate(status))
+	fmt.Fprintf(writer, "Revoked:     %d certificates\n\n", len(status.Entries))
+
+	if len(status.Entries) > 0 {
+		table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "SERIAL\tUSERNAME\tREVOKED AT")
+		for _, entry := range status.Entries {
+			fmt.Fprintf(table, "%s\t%s\t%s\n", entry.Serial, entry.CommonName, entry.RevocationDate.Format(time.RFC3339))
+		}
+		table.Flush()
+	}
+
+	return nil
+}
+
+func regenerateCrlCommand(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	if err := configurePkiLease(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	if err := configurePkiStorage(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	logger.Info("Regenerating CRL")
+	if err := regenerateCrl(); err != nil {
+		return err
+	}
+
+	status, err := readCrlStatus()
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("CRL regenerated with %d entries, next update %s", len(status.Entries), status.NextUpdate.Format(time.RFC3339))
+	return nil
+}
+
+// Upload crl.pem to S3 so that other consumers (e.g. other VPN endpoints or auditors) can check revocations
+func publishCrl(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	awsRegion, err := getAwsRegion(cliContext)
+	if err != nil {
+		return err
+	}
+
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	destination := cliContext.String(OPTION_DESTINATION)
+	if destination == "" {
+		return errors.WithStackTrace(MissingDestination)
+	}
+
+	if err := configurePkiStorage(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	bucket, key, err := aws_helpers.ParseS3Uri(destination)
+	if err != nil {
+		return err
+	}
+
+	contents, err := readCrlFile()
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Publishing %s to %s", CRL_FILE_PATH, destination)
+	err = awsClient.PutS3Object(awsRegion, bucket, key, contents, "application/x-pem-file", cliContext.String(OPTION_KMS_KEY_ID))
+	if err != nil {
+		return err
+	}
+
+	logger.Info("DONE")
+	return nil
+}
+
+// Check the CRL's next update every interval, in the background, for the lifetime of the process-revokes daemon. Each
+// check publishes the number of days left as a CloudWatch metric, and logs a warning once it drops below the threshold.
+func startCrlExpiryCheck(cliContext *cli.Context, awsClient *aws_helpers.AwsClient) error {
+	interval := cliContext.Duration(OPTION_CRL_CHECK_INTERVAL)
+	if interval <= 0 {
+		return nil
+	}
+
+	awsRegion, err := getAwsRegion(cliContext)
+	if err != nil {
+		return err
+	}
+
+	warningThreshold := time.Duration(cliContext.Int(OPTION_CRL_WARNING_DAYS)) * 24 * time.Hour
+	namespace := cliContext.String(OPTION_METRIC_NAMESPACE)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	logging.GetLogger(LOGGER_NAME).Infof("Checking the CRL's next update every %s", interval)
+	go func() {
+		for {
+			checkCrlExpiry(awsClient, awsRegion, namespace, hostname, warningThreshold)
+			time.Sleep(interval)
+		}
+	}()
+
+	return nil
+}
+
+func checkCrlExpiry(awsClient *aws_helpers.AwsClient, awsRegion string, namespace string, hostname string, warningThreshold time.Duration) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	status, err := readCrlStatus()
+	if err != nil {
+		logger.Errorf("Unable to check CRL expiry: %s", err.Error())
+		return
+	}
+
+	remaining := status.TimeUntilNextUpdate()
+	if remaining <= 0 {
+		logger.Errorf("The CRL at %s expired on %s. OpenVPN will reject all clients until it is regenerated with 'openvpn-admin crl regenerate'.", CRL_FILE_PATH, status.NextUpdate.Format(time.RFC3339))
+	} else if remaining < warningThreshold {
+		logger.Warnf("The CRL at %s expires in %s, on %s. Regenerate it with 'openvpn-admin crl regenerate'.", CRL_FILE_PATH, describeTimeUntilNextUpdate(status), status.NextUpdate.Format(time.RFC3339))
+	} else {
+		logger.Debugf("The CRL at %s is valid until %s", CRL_FILE_PATH, status.NextUpdate.Format(time.RFC3339))
+	}
+
+	if namespace == "" {
+		return
+	}
+
+	err = awsClient.PutMetric(awsRegion, namespace, CRL_METRIC_NAME, remaining.Hours()/24, "None", map[string]string{"Host": hostname})
+	if err != nil {
+		logger.Errorf("Unable to publish %s metric: %s", CRL_METRIC_NAME, err.Error())
+	}
+}
+
+func describeTimeUntilNextUpdate(status crlStatus) string {
+	remaining := status.TimeUntilNextUpdate()
+	if remaining <= 0 {
+		return "EXPIRED"
+	}
+	return fmt.Sprintf("%d days", int(remaining.Hours()/24))
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/server"
+	"github.com/urfave/cli"
+)
+
+// The commands point at the dev server with these options, which only need to look like real ones
+const DEV_AWS_REGION = "dev"
+
+const DEV_PROMPT = "openvpn-admin dev> "
+
+// Run a throwaway CA and the request handlers in this process, and a shell that runs request, fetch, revoke and list
+// against them over an in-memory transport, without any AWS resources. For developing and demonstrating the request
+// flow.
+func runDevShell(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	if err := configureUsernameRules(cliContext); err != nil {
+		return err
+	}
+	if err := configureMaxDevices(cliContext); err != nil {
+		return err
+	}
+
+	dir, err := createDevDir()
+	if err != nil {
+		return err
+	}
+	if cliContext.Bool(OPTION_KEEP) {
+		defer logger.Infof("Kept the PKI and profiles in %s", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	authority, err := newDevAuthority(dir)
+	if err != nil {
+		return err
+	}
+
+	transport := client.NewMemoryTransport()
+	requestUrl, err := transport.CreateQueue(strings.TrimSuffix(REQUEST_QUEUE_NAME_PREFIX, "-"))
+	if err != nil {
+		return err
+	}
+	revokeUrl, err := transport.CreateQueue(strings.TrimSuffix(REVOCATION_QUEUE_NAME_PREFIX, "-"))
+	if err != nil {
+		return err
+	}
+
+	// Point the commands at the dev server for as long as the shell runs
+	previousPkiStore, previousTransport := pkiStore, clientTransport
+	pkiStore, clientTransport = devPkiStorage{Dir: dir}, transport
+	defer func() { pkiStore, clientTransport = previousPkiStore, previousTransport }()
+
+	handler := server.Handler{
+		Authority:   authority,
+		Results:     resultStore{Dir: filepath.Join(dir, "results"), Retention: DEFAULT_RESULT_RETENTION},
+		MapUsername: mapUsername,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := handler.Serve(ctx, transport, requestUrl, revokeUrl); err != nil {
+			logger.Errorf("The dev server stopped: %s", err.Error())
+		}
+	}()
+
+	writer := cliContext.App.Writer
+	fmt.Fprintf(writer, "Throwaway CA in %s. Profiles are written to %s.\n", dir, filepath.Join(dir, "profiles"))
+	fmt.Fprintln(writer, "Run request, fetch, revoke or list, e.g. 'request --username alice --device laptop'. Type exit or press Ctrl-D to quit.")
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Fprint(writer, DEV_PROMPT)
+		if !scanner.Scan() {
+			fmt.Fprintln(writer)
+			break
+		}
+
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			break
+		}
+
+		// The app prints the errors of the commands it runs, so only the shell's own need printing
+		err := runDevCommand(cliContext, args, requestUrl, revokeUrl, filepath.Join(dir, "profiles"))
+		if _, isUnsupported := errors.Unwrap(err).(UnsupportedDevCommand); isUnsupported {
+			fmt.Fprintln(cli.ErrWriter, err.Error())
+		}
+	}
+
+	return errors.WithStackTrace(scanner.Err())
+}
+
+// Run a command of the dev shell with a fresh app, with the options that point it at the dev server put before the
+// given ones, so the given ones win
+func runDevCommand(cliContext *cli.Context, args []string, requestUrl string, revokeUrl string, profilesDir string) error {
+	devArgs := []string{}
+	switch args[0] {
+	case "request", "fetch":
+		devArgs = []string{"--" + OPTION_AWS_REGION, DEV_AWS_REGION, "--" + OPTION_REQUEST_URL, requestUrl, "--" + OPTION_OUTPUT_DIR, profilesDir}
+		if args[0] == "request" {
+			devArgs = append(devArgs, "--"+OPTION_USERNAME, currentOperator())
+		}
+	case "revoke":
+		devArgs = []string{"--" + OPTION_AWS_REGION, DEV_AWS_REGION, "--" + OPTION_REVOKE_URL, revokeUrl, "--" + OPTION_USERNAME, currentOperator()}
+	case "list":
+	case "help":
+		fmt.Fprintln(cliContext.App.Writer, "Commands: request, fetch, revoke, list, exit. Run '<command> --help' for their options.")
+		return nil
+	default:
+		return errors.WithStackTrace(UnsupportedDevCommand(args[0]))
+	}
+
+	devApp := CreateApp(cliContext.App.Version)
+	devApp.Writer = cliContext.App.Writer
+	devApp.ErrWriter = cliContext.App.ErrWriter
+
+	return devApp.Run(append(append([]string{devApp.Name, args[0]}, devArgs...), args[1:]...))
+}
+
+// Custom errors
+
+type UnsupportedDevCommand string
+
+func (err UnsupportedDevCommand) Error() string {
+	return fmt.Sprintf("%s can't be run in the dev shell. Run request, fetch, revoke or list.", string(err))
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/urfave/cli"
+)
+
+// Check the PKI on this server for the problems that make certificate issuance or client connections fail, and print
+// what to do about each of them
+func runDoctor(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+
+	paths, err := collectBackupFiles()
+	if err != nil {
+		return err
+	}
+
+	pki, err := readBackupFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	modes := map[string]os.FileMode{}
+	for _, file := range pki.Manifest.Files {
+		modes[file.Path] = file.Mode
+	}
+
+	findings := checkPkiConsistency(pki.Files)
+	findings = append(findings, checkCrlNotExpired(pki.Files)...)
+	findings = append(findings, checkPrivateKeyPermissions(modes)...)
+
+	template, err := readTemplateFile()
+	if err != nil {
+		findings = append(findings, pkiFinding{
+			Problem: fmt.Sprintf("Unable to read %s: %s", CLIENT_TEMPLATE_PATH, errors.Unwrap(err).Error()),
+			Fix:     fmt.Sprintf("Copy the template from the install-openvpn module to %s", CLIENT_TEMPLATE_PATH),
+		})
+	} else {
+		findings = append(findings, checkClientTemplate(template)...)
+	}
+
+	writer := cliContext.App.Writer
+
+	if len(findings) == 0 {
+		fmt.Fprintf(writer, "Checked %d PKI files. No problems found.\n", len(paths))
+		return nil
+	}
+
+	for _, finding := range findings {
+		fmt.Fprintf(writer, "PROBLEM: %s\n    FIX: %s\n", finding.Problem, finding.Fix)
+	}
+	fmt.Fprintln(writer)
+
+	return errors.WithStackTrace(DoctorFoundProblems(len(findings)))
+}
+
+// Custom errors
+
+type DoctorFoundProblems int
+
+func (err DoctorFoundProblems) Error() string {
+	return fmt.Sprintf("Found %d problems with the PKI", int(err))
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"context"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/urfave/cli"
+)
+
+// Get the result of a request made with request --no-wait from the OpenVPN server and write the profile to disk
+func fetchCertificate(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+
+	requestId := cliContext.Args().First()
+	if requestId == "" {
+		return errors.WithStackTrace(MissingRequestId)
+	}
+
+	return forEachServer(cliContext, func(serverName string) error {
+		return fetchCertificateFromServer(cliContext, requestId, serverName)
+	})
+}
+
+func fetchCertificateFromServer(cliContext *cli.Context, requestId string, serverName string) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	awsRegion, err := getAwsRegion(cliContext)
+	if err != nil {
+		return err
+	}
+
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	requestUrl, err := getRequestUrl(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+
+	timeout, err := getTimeout(cliContext)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Fetching the result of request %s", requestId)
+	certificate, err := client.FetchCertificate(context.Background(), client.FetchOptions{
+		AwsRegion:  awsRegion,
+		RequestUrl: requestUrl,
+		Transport:  clientTransport,
+		AwsClient:  awsClient,
+		RequestId:  requestId,
+		Timeout:    timeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := createOvpnFile(cliContext.String(OPTION_OUTPUT_DIR), profileFileName(certificate.CommonName, serverName), certificate.Profile); err != nil {
+		return err
+	}
+
+	logger.Info("DONE")
+	return nil
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/urfave/cli"
+)
+
+// The sessions of a user along with their total usage, as printed by the history command
+type userHistory struct {
+	Username           string
+	Sessions           []connectionSession
+	TotalBytesReceived int64
+	TotalBytesSent     int64
+	TotalDuration      time.Duration
+}
+
+// Show when, from where and for how long a user has been connected to the OpenVPN server
+func showHistory(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+
+	username := cliContext.String(OPTION_USERNAME)
+	if username == "" {
+		return errors.WithStackTrace(MissingUsername)
+	}
+
+	records, err := readHistory(cliContext.String(OPTION_HISTORY_FILE))
+	if err != nil {
+		return err
+	}
+
+	history := userHistory{Username: username, Sessions: sessionsFromHistory(records, username)}
+	for _, session := range history.Sessions {
+		history.TotalBytesReceived += session.BytesReceived
+		history.TotalBytesSent += session.BytesSent
+		history.TotalDuration += sessionDuration(session)
+	}
+
+	writer := cliContext.App.Writer
+
+	if cliContext.Bool(OPTION_JSON) {
+		historyJson, err := json.MarshalIndent(history, "", "  ")
+		if err != nil {
+			return errors.WithStackTrace(err)
+		}
+		fmt.Fprintln(writer, string(historyJson))
+		return nil
+	}
+
+	if len(history.Sessions) == 0 {
+		fmt.Fprintf(writer, "No connections recorded for %s\n", username)
+		return nil
+	}
+
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "START\tEND\tDURATION\tSOURCE IP\tVIRTUAL IP\tBYTES IN\tBYTES OUT")
+	for _, session := range history.Sessions {
+		end := "(connected)"
+		if !session.End.IsZero() {
+			end = session.End.Format(time.RFC3339)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", session.Start.Format(time.RFC3339), end, sessionDuration(session), session.RealAddress, session.VirtualAddress, formatBytes(session.BytesReceived), formatBytes(session.BytesSent))
+	}
+	table.Flush()
+
+	fmt.Fprintf(writer, "\n%d sessions, %s connected, %s in, %s out\n", len(history.Sessions), history.TotalDuration, formatBytes(history.TotalBytesReceived), formatBytes(history.TotalBytesSent))
+	return nil
+}
+
+func sessionDuration(session connectionSession) time.Duration {
+	end := session.End
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(session.Start).Truncate(time.Second)
+}
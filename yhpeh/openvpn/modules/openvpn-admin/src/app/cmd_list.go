@@ -0,0 +1,103 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/urfave/cli"
+)
+
+// A user certificate in index.txt, as printed by the list command. Device is empty for a certificate without a device
+// (see client.CertificateName). LastSeen is nil if the certificate has never been used to connect.
+type certificateListing struct {
+	Username string
+	Device   string `json:",omitempty"`
+	Serial   string
+	Status   string
+	Expires  time.Time
+	LastSeen *time.Time
+}
+
+// List the user certificates issued by the OpenVPN server along with when each user was last connected
+func listCertificates(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	if err := configurePkiStorage(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	records, err := readHistory(cliContext.String(OPTION_HISTORY_FILE))
+	if err != nil {
+		return err
+	}
+	lastSeen := lastSeenByUser(records)
+
+	listings := []certificateListing{}
+	for _, entry := range entries {
+		if !entry.IsUserCertificate() {
+			continue
+		}
+
+		username, device := client.SplitCertificateName(entry.CommonName)
+		listing := certificateListing{Username: username, Device: device, Serial: entry.Serial, Status: certificateStatus(entry), Expires: entry.ExpirationDate}
+		if seen, hasBeenSeen := lastSeen[entry.CommonName]; hasBeenSeen {
+			listing.LastSeen = &seen
+		}
+		listings = append(listings, listing)
+	}
+
+	// Keep the certificates of each user's devices together, in the order they were issued
+	sort.SliceStable(listings, func(i, j int) bool {
+		if listings[i].Username != listings[j].Username {
+			return listings[i].Username < listings[j].Username
+		}
+		return listings[i].Device < listings[j].Device
+	})
+
+	writer := cliContext.App.Writer
+
+	if cliContext.Bool(OPTION_JSON) {
+		listingsJson, err := json.MarshalIndent(listings, "", "  ")
+		if err != nil {
+			return errors.WithStackTrace(err)
+		}
+		fmt.Fprintln(writer, string(listingsJson))
+		return nil
+	}
+
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "USERNAME\tDEVICE\tSERIAL\tSTATUS\tEXPIRES\tTIME LEFT\tLAST SEEN")
+	for _, listing := range listings {
+		seen := "never"
+		if listing.LastSeen != nil {
+			seen = listing.LastSeen.Format(time.RFC3339)
+		}
+		timeLeft := "-"
+		if listing.Status == "valid" {
+			timeLeft = describeTimeLeft(listing.Expires)
+		}
+		device := listing.Device
+		if device == "" {
+			device = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", listing.Username, device, listing.Serial, listing.Status, listing.Expires.Format(time.RFC3339), timeLeft, seen)
+	}
+	table.Flush()
+
+	return nil
+}
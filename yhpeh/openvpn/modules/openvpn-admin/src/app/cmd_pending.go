@@ -0,0 +1,97 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/urfave/cli"
+)
+
+// List the certificate requests waiting for approval on this OpenVPN server
+func listPendingRequests(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+
+	requests, err := pendingStore{Dir: cliContext.String(OPTION_PENDING_DIR)}.List()
+	if err != nil {
+		return err
+	}
+
+	writer := cliContext.App.Writer
+
+	if cliContext.Bool(OPTION_JSON) {
+		requestsJson, err := json.MarshalIndent(requests, "", "  ")
+		if err != nil {
+			return errors.WithStackTrace(err)
+		}
+		fmt.Fprintln(writer, string(requestsJson))
+		return nil
+	}
+
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tCERTIFICATE\tVALID FOR\tSUBMITTED\tSTATUS")
+	for _, request := range requests {
+		validFor := request.Request.ValidFor
+		if request.Renew {
+			validFor = "renewal"
+		} else if validFor == "" {
+			validFor = "default"
+		}
+
+		status := "pending"
+		if request.Decision != "" {
+			status = fmt.Sprintf("%s by %s, being processed", request.Decision, request.DecidedBy)
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", request.Request.RequestId, request.CommonName, validFor, request.SubmittedAt.Format(time.RFC3339), status)
+	}
+	table.Flush()
+
+	return nil
+}
+
+// Approve a certificate request. The process-requests daemon issues the certificate and notifies the requester.
+func approveRequest(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	requestId := cliContext.Args().First()
+	if requestId == "" {
+		return errors.WithStackTrace(MissingPendingRequestId)
+	}
+
+	request, err := decideOnRequest(pendingStore{Dir: cliContext.String(OPTION_PENDING_DIR)}, requestId, DECISION_APPROVED, "")
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Approved request %s for %s. The OpenVPN server will issue the certificate within %s.", requestId, request.CommonName, DECISION_CHECK_INTERVAL)
+	return nil
+}
+
+// Deny a certificate request. The process-requests daemon notifies the requester, along with the reason.
+func denyRequest(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	requestId := cliContext.Args().First()
+	if requestId == "" {
+		return errors.WithStackTrace(MissingPendingRequestId)
+	}
+
+	reason := cliContext.String(OPTION_REASON)
+	if reason == "" {
+		return errors.WithStackTrace(MissingReason)
+	}
+
+	request, err := decideOnRequest(pendingStore{Dir: cliContext.String(OPTION_PENDING_DIR)}, requestId, DECISION_DENIED, reason)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Denied request %s for %s. The OpenVPN server will notify the requester within %s.", requestId, request.CommonName, DECISION_CHECK_INTERVAL)
+	return nil
+}
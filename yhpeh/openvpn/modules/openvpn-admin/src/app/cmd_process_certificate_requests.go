@@ -1,12 +1,14 @@
 package app
 
 import (
+	"time"
+	"context"
 	"github.com/urfave/cli"
 	"encoding/json"
-	"github.com/gruntwork-io/gruntwork-cli/errors"
 	"github.com/gruntwork-io/gruntwork-cli/logging"
-	"fmt"
 	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/server"
 )
 
 // NOTE: This method runs in an infinite loop
@@ -20,7 +22,12 @@ func processNewCertificateRequests(cliContext *cli.Context) error {
 	}
 	logger.Debugf("Using AWS Region: %s", awsRegion)
 
-	requestUrl, err := getRequestUrl(cliContext)
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	requestUrl, err := getRequestUrl(cliContext, awsClient)
 	if err != nil {
 		return err
 	}
@@ -31,30 +38,92 @@ func processNewCertificateRequests(cliContext *cli.Context) error {
 		return err
 	}
 
+	err = configurePkiLease(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+
+	err = configureUsernameRules(cliContext)
+	if err != nil {
+		return err
+	}
+
+	err = configureMaxDevices(cliContext)
+	if err != nil {
+		return err
+	}
+
+	err = configureValidityLimits(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+
+	err = configureApprovals(cliContext)
+	if err != nil {
+		return err
+	}
+
+	configureSessionTermination(cliContext)
+
+	err = configureWebhooks(cliContext)
+	if err != nil {
+		return err
+	}
+
+	err = startPeriodicPkiSync(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+
+	leader, err := startLeaderElection(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+
+	startExpiredCertificateCleanup(cliContext, leader)
+	startWebhookDelivery()
+	startExpiryNotifications(cliContext, leader)
+
+	err = startWebPortal(cliContext)
+	if err != nil {
+		return err
+	}
+
+	results := resultStore{Dir: cliContext.String(OPTION_RESULTS_DIR), Retention: cliContext.Duration(OPTION_RESULT_RETENTION)}
+	startDecisionProcessing(awsClient, awsRegion, results, leader)
+	handler := newRequestHandler(results)
+
+	health := newDaemonHealth(requestUrl)
+	startHealthServer(cliContext, health)
+	receiver := &queueReceiver{AwsClient: awsClient, AwsRegion: awsRegion, QueueUrl: requestUrl, Timeout: timeout, Health: health}
+
 	for {
-		// Wait for a request to come in from a client on the requestQueue
-		receipt, request, err := waitForRequestMessage(awsRegion, requestUrl, timeout)
-		if err != nil {
-			if sleepOnFailedToReceiveMessages(err) {
-				continue
-			}
+		// Hot standbys leave the queue to the leader
+		if leader != nil && !leader.IsLeader() {
+			health.recordStandby()
+			time.Sleep(LEADER_STANDBY_INTERVAL)
+			continue
+		}
 
-			return err
+		// Wait for a request to come in from a client on the requestQueue
+		receipt, request, received := receiver.receive()
+		if !received {
+			continue
 		}
 
 		//Here if we encounter an error, we don't want to stop processing, we want to return the error to the caller
 		//via the SQS queue
-		responseQueue, certificate, err := processNewCertificateRequestMessage(awsRegion, receipt, request)
-		if err != nil {
-			logger.WithError(err)
+		responseQueue, response := processNewCertificateRequestMessage(handler, request)
+		if !response.Success {
+			logger.Errorf("Request failed: %s", response.ErrorMessage)
 		}
 
-		err = sendCertificateReply(awsRegion, responseQueue, certificate, err)
+		err = sendCertificateReply(awsClient, awsRegion, responseQueue, response)
 		if err != nil {
 			return err
 		}
 
-		err = aws_helpers.DeleteMessageFromQueue(awsRegion, requestUrl, receipt)
+		err = awsClient.DeleteMessageFromQueue(awsRegion, requestUrl, receipt)
 		if err != nil {
 			return err
 		}
@@ -65,59 +134,29 @@ func processNewCertificateRequests(cliContext *cli.Context) error {
 	return nil
 }
 
-func waitForRequestMessage(awsRegion string, responseQueue string, timeout int) (receipt string, message string, error error) {
-	receipt, message, err := aws_helpers.WaitForQueueMessage(awsRegion, responseQueue, timeout)
-	if err != nil {
-		return "", "", err
-	}
-
-	return receipt, message, nil
-}
-
-func processNewCertificateRequestMessage(awsRegion string, receipt string, message string) (string, string, error) {
-
-	request := CertificateRequest{}
+// Issue a certificate for the request in the given message, or look up the result of an earlier request when asked to
+// fetch one (see server.Handler). Returns the response queue and the response.
+func processNewCertificateRequestMessage(handler server.Handler, message string) (string, client.CertificateResponse) {
+	request := client.CertificateRequest{}
 	json.Unmarshal([]byte(message), &request)
 
-	certificateAlreadyExists, err := indexContainsValidCertificate(request.Username)
-	if err != nil {
-		return "", "", err
-	}
-
-	if (!certificateAlreadyExists) {
-		certificate, err := generateCertificate(request.Username)
-		if err != nil {
-			return request.ResponseQueue, "", err
-		}
-
-		return request.ResponseQueue, certificate, nil
-	} else {
-		var alreadyExistsError = fmt.Errorf("a valid certificate for %s already exists", request.Username)
-		return request.ResponseQueue, "", errors.WithStackTrace(alreadyExistsError)
-	}
-
+	return request.ResponseQueue, handler.HandleCertificateRequest(context.Background(), request)
 }
 
-func sendCertificateReply(awsRegion string, responseQueue string, certificate string, error error) error {
-
-	responseMessage := &CertificateResponse{}
-	responseMessage.Success = (error == nil)
-
-	if responseMessage.Success {
-		responseMessage.Body = certificate
-	} else {
-		responseMessage.ErrorMessage = error.Error()
+// Send the response to the requester. Requests made with --no-wait have no response queue, so there is nothing to send.
+func sendCertificateReply(awsClient *aws_helpers.AwsClient, awsRegion string, responseQueue string, response client.CertificateResponse) error {
+	if responseQueue == "" {
+		return nil
 	}
 
-	requestJson, err := json.Marshal(responseMessage)
+	requestJson, err := json.Marshal(response)
 	if err != nil {
 		return err
 	}
 
-	err = aws_helpers.SendMessageToQueue(awsRegion, responseQueue, string(requestJson))
+	err = awsClient.SendMessageToQueue(awsRegion, responseQueue, string(requestJson))
 	if err != nil {
 		return err
 	}
 	return nil
 }
-
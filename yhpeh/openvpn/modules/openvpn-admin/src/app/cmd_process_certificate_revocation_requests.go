@@ -1,12 +1,14 @@
 package app
 
 import (
+	"time"
+	"context"
 	"github.com/urfave/cli"
 	"encoding/json"
-	"github.com/gruntwork-io/gruntwork-cli/errors"
 	"github.com/gruntwork-io/gruntwork-cli/logging"
-	"fmt"
 	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/server"
 )
 
 // NOTE: This method runs in an infinite loop
@@ -20,7 +22,12 @@ func processCertificateRevocationRequests(cliContext *cli.Context) error {
 	}
 	logger.Debugf("Using AWS Region: %s", awsRegion)
 
-	revokeUrl, err := getRevokeUrl(cliContext)
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	revokeUrl, err := getRevokeUrl(cliContext, awsClient)
 	if err != nil {
 		return err
 	}
@@ -31,29 +38,77 @@ func processCertificateRevocationRequests(cliContext *cli.Context) error {
 		return err
 	}
 
+	err = configurePkiLease(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+
+	err = configureUsernameRules(cliContext)
+	if err != nil {
+		return err
+	}
+
+	err = configureWebhooks(cliContext)
+	if err != nil {
+		return err
+	}
+	startWebhookDelivery()
+
+	err = startPeriodicPkiSync(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+
+	leader, err := startLeaderElection(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+
+	err = startPeriodicIamSync(cliContext, awsClient, leader)
+	if err != nil {
+		return err
+	}
+
+	err = startCrlExpiryCheck(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+
+	configureSessionTermination(cliContext)
+
+	handler := newRequestHandler(nil)
+
+	health := newDaemonHealth(revokeUrl)
+	startHealthServer(cliContext, health)
+	receiver := &queueReceiver{AwsClient: awsClient, AwsRegion: awsRegion, QueueUrl: revokeUrl, Timeout: timeout, Health: health}
+
 	for {
+		// Hot standbys leave the queue to the leader
+		if leader != nil && !leader.IsLeader() {
+			health.recordStandby()
+			time.Sleep(LEADER_STANDBY_INTERVAL)
+			continue
+		}
+
 		// Wait for a request to come in from a client on the revokeQueue
-		receipt, revokeRequest, err := waitForMessage(awsRegion, revokeUrl, timeout)
-		if err != nil {
-			if sleepOnFailedToReceiveMessages(err) {
-				continue
-			}
-			return err
+		receipt, revokeRequest, received := receiver.receive()
+		if !received {
+			continue
 		}
 
 		//Here if we encounter an error, we don't want to stop processing, we want to return the error to the caller
 		//via the SQS queue
-		responseQueue, err := processRevokeRequest(awsRegion, receipt, revokeRequest)
+		responseQueue, sessionsTerminated, err := processRevokeRequest(handler, revokeRequest)
 		if err != nil {
 			logger.WithError(err)
 		}
 
-		err = sendRevokeReply(awsRegion, responseQueue, err)
+		err = sendRevokeReply(awsClient, awsRegion, responseQueue, sessionsTerminated, err)
 		if err != nil {
 			return err
 		}
 
-		err = aws_helpers.DeleteMessageFromQueue(awsRegion, revokeUrl, receipt)
+		err = awsClient.DeleteMessageFromQueue(awsRegion, revokeUrl, receipt)
 		if err != nil {
 			return err
 		}
@@ -63,35 +118,26 @@ func processCertificateRevocationRequests(cliContext *cli.Context) error {
 	return nil
 }
 
-func processRevokeRequest(awsRegion string, receipt string, message string) (string, error) {
-
-	revokeRequest := CertificateRevokeRequest{}
+// Revoke the certificate in the request in the given message, or all of the user's certificates if it asks for all
+// devices (see server.Handler). Returns the response queue and the number of active sessions that were terminated
+// (see disconnectRevokedClients).
+func processRevokeRequest(handler server.Handler, message string) (string, int, error) {
+	revokeRequest := client.CertificateRevokeRequest{}
 	json.Unmarshal([]byte(message), &revokeRequest)
 
-	certificateAlreadyExists, err := indexContainsValidCertificate(revokeRequest.Username)
-	if err != nil {
-		return revokeRequest.ResponseQueue, err
-	}
-
-	if (certificateAlreadyExists) {
-		err := revokeCertificate(revokeRequest.Username)
-		if err != nil {
-			return revokeRequest.ResponseQueue, err
-		}
-
-		return revokeRequest.ResponseQueue, nil
-	} else {
-		var doesNotExistError = fmt.Errorf("a valid certificate for %s does not exist", revokeRequest.Username)
-		return revokeRequest.ResponseQueue, errors.WithStackTrace(doesNotExistError)
-	}
+	authority := &pkiAuthority{}
+	handler.Authority = authority
 
+	_, err := handler.HandleRevokeRequest(context.Background(), revokeRequest)
+	return revokeRequest.ResponseQueue, authority.SessionsTerminated, err
 }
 
-func sendRevokeReply(awsRegion string, responseQueue string, error error) error {
+func sendRevokeReply(awsClient *aws_helpers.AwsClient, awsRegion string, responseQueue string, sessionsTerminated int, error error) error {
 	logger := logging.GetLogger(LOGGER_NAME)
 
-	responseMessage := &CertificateRevokeResponse{}
+	responseMessage := &client.CertificateRevokeResponse{}
 	responseMessage.Success = (error == nil)
+	responseMessage.SessionsTerminated = sessionsTerminated
 
 	if !responseMessage.Success {
 		responseMessage.ErrorMessage = error.Error()
@@ -104,7 +150,7 @@ func sendRevokeReply(awsRegion string, responseQueue string, error error) error
 
 	logger.Debugf("Sending revocation reply %s on %s", string(responseJson), responseQueue)
 
-	err = aws_helpers.SendMessageToQueue(awsRegion, responseQueue, string(responseJson))
+	err = awsClient.SendMessageToQueue(awsRegion, responseQueue, string(responseJson))
 	if err != nil {
 		return err
 	}
@@ -4,25 +4,26 @@ import (
 	"github.com/urfave/cli"
 	"github.com/gruntwork-io/gruntwork-cli/logging"
 	"fmt"
-	"encoding/json"
+	"context"
 	"github.com/gruntwork-io/gruntwork-cli/errors"
 	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 )
 
-type CertificateRequest struct {
-	Username      string
-	ResponseQueue string
-}
-
-type CertificateResponse struct {
-	Success      bool
-	Body         string
-	ErrorMessage string
-}
-
 func requestNewCertificate(cliContext *cli.Context) error {
 	setLoggerLevel(cliContext)
+	return forEachServer(cliContext, func(serverName string) error {
+		return requestNewCertificateFromServer(cliContext, serverName)
+	})
+}
+
+// Request a new certificate from the given server of the client config, or the one the options point at if serverName
+// is empty
+func requestNewCertificateFromServer(cliContext *cli.Context, serverName string) error {
 	logger := logging.GetLogger(LOGGER_NAME)
 
 	logger.Infof("Looking up AWS username")
@@ -32,98 +33,163 @@ func requestNewCertificate(cliContext *cli.Context) error {
 	}
 	logger.Debugf("Using AWS Region: %s", awsRegion)
 
-	username, err := getUsername(cliContext, true)
+	awsClient, err := newAwsClient(cliContext)
 	if err != nil {
 		return err
 	}
-	logger.Debugf("Using Username: %s", username)
 
-	logger.Infof("Looking up SQS queue")
-	requestUrl, err := getRequestUrl(cliContext)
-	if err != nil {
+	if err := configureUsernameRules(cliContext); err != nil {
 		return err
 	}
-	logger.Debugf("Using Request URL: %s", requestUrl)
 
-	timeout, err := getTimeout(cliContext)
-	if err != nil {
-		return err
+	fromFile := cliContext.String(OPTION_FROM_FILE)
+
+	var username string
+	if fromFile == "" {
+		username, err = getUsername(cliContext, awsClient, true)
+		if err != nil {
+			return err
+		}
+		logger.Debugf("Using Username: %s", username)
 	}
 
-	//Create a new response queue
-	responseQueue, err := createResponseQueue(awsRegion)
+	device, err := getDevice(cliContext, username)
 	if err != nil {
 		return err
 	}
-	defer deleteResponseQueue(awsRegion, responseQueue)
 
-	logger.Infof("Submitting request for new certificate to %s", responseQueue)
-	//Put a request for a new certificate on the requestQueue
-	err = sendRequest(awsRegion, requestUrl, username, responseQueue)
+	validFor, err := getValidFor(cliContext)
 	if err != nil {
 		return err
 	}
 
-	// Wait for a reply from OpenVPN server on the responseQueue
-	logger.Info("Waiting for response from OpenVPN server")
-	receipt, response, err := waitForMessage(awsRegion, responseQueue, timeout)
+	logger.Infof("Looking up SQS queue")
+	requestUrl, err := getRequestUrl(cliContext, awsClient)
 	if err != nil {
 		return err
 	}
+	logger.Debugf("Using Request URL: %s", requestUrl)
 
-	// Process the response
-	logger.Info("Response received from OpenVPN server")
-	err = processNewCertificateResponse(awsRegion, responseQueue, receipt, response, username)
+	timeout, err := getTimeout(cliContext)
 	if err != nil {
 		return err
 	}
 
-	logger.Info("DONE")
-	return nil
-}
+	outputDir := cliContext.String(OPTION_OUTPUT_DIR)
+	noWait := cliContext.Bool(OPTION_NO_WAIT)
+
+	if fromFile != "" {
+		usernames, err := readUsernamesFromFile(fromFile)
+		if err != nil {
+			return err
+		}
+
+		logger.Infof("Requesting certificates for %d users from %s", len(usernames), fromFile)
+		if noWait {
+			results := runBatch(usernames, func(username string) (batchResult, error) {
+				requestId, err := submitCertificateRequest(awsClient, awsRegion, requestUrl, username, device, validFor)
+				return batchResult{RequestId: requestId}, err
+			})
+			return reportBatchResults(cliContext, results)
+		}
 
-func sendRequest(awsRegion string, requestUrl string, username string, responseQueue string) error {
-	req := &CertificateRequest{
-		Username: username,
-		ResponseQueue:responseQueue,
+		results := runBatch(usernames, func(username string) (batchResult, error) {
+			profilePath, err := requestCertificateForUser(awsClient, awsRegion, requestUrl, username, device, validFor, timeout, outputDir, serverName)
+			return batchResult{ProfilePath: profilePath}, err
+		})
+
+		return reportBatchResults(cliContext, results)
+	}
+
+	if noWait {
+		requestId, err := submitCertificateRequest(awsClient, awsRegion, requestUrl, username, device, validFor)
+		if err != nil {
+			return err
+		}
+
+		fetchCommand := "openvpn-admin fetch " + requestId
+		if serverName != "" {
+			fetchCommand = fmt.Sprintf("openvpn-admin fetch --%s %s %s", OPTION_SERVER, serverName, requestId)
+		}
+		logger.Infof("Submitted request %s for %s. Run '%s' to get the profile once it is ready.", requestId, client.CertificateName(username, device), fetchCommand)
+		fmt.Fprintln(cliContext.App.Writer, requestId)
+		return nil
 	}
-	requestJson, _ := json.Marshal(req)
 
-	err := aws_helpers.SendMessageToQueue(awsRegion, requestUrl, string(requestJson))
+	_, err = requestCertificateForUser(awsClient, awsRegion, requestUrl, username, device, validFor, timeout, outputDir, serverName)
 	if err != nil {
 		return err
 	}
+
+	logger.Info("DONE")
 	return nil
 }
 
-func processNewCertificateResponse(awsRegion string, resonseQueue string, receipt string, message string, username string) error {
-	response := CertificateResponse{}
-	json.Unmarshal([]byte(message), &response)
+// Request a new certificate for the given user and device (which may be empty), valid for validFor (0 for the server's
+// default), and write the resulting OpenVPN profile into outputDir, named after the certificate and serverName (see
+// profileFileName). Returns the path of the profile.
+func requestCertificateForUser(awsClient *aws_helpers.AwsClient, awsRegion string, requestUrl string, username string, device string, validFor time.Duration, timeout int, outputDir string, serverName string) (string, error) {
+	logger := logging.GetLogger(LOGGER_NAME)
 
-	if (!response.Success) {
-		aws_helpers.DeleteMessageFromQueue(awsRegion, resonseQueue, receipt)
-		return errors.WithStackTrace(fmt.Errorf(response.ErrorMessage))
-	} else {
-		err := createOvpnFile(username, response.Body)
-		if err != nil {
-			return err
-		}
-		aws_helpers.DeleteMessageFromQueue(awsRegion, resonseQueue, receipt)
+	logger.Infof("Requesting a new certificate for %s on %s and waiting for the OpenVPN server", client.CertificateName(username, device), requestUrl)
+	certificate, err := client.RequestCertificate(context.Background(), client.RequestOptions{
+		AwsRegion:  awsRegion,
+		RequestUrl: requestUrl,
+		Transport:  clientTransport,
+		AwsClient:  awsClient,
+		Username:   username,
+		Device:     device,
+		ValidFor:   validFor,
+		Timeout:    timeout,
+		OnAwaitingApproval: func(requestId string) {
+			logger.Infof("Request %s for %s is waiting for approval by an administrator", requestId, client.CertificateName(username, device))
+		},
+	})
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	logger.Infof("Response received from OpenVPN server for %s", username)
+	return createOvpnFile(outputDir, profileFileName(certificate.CommonName, serverName), certificate.Profile)
+}
+
+// Submit a request for a new certificate for the given user without waiting for the response. The server stores the
+// result under the returned request ID, for fetch.
+func submitCertificateRequest(awsClient *aws_helpers.AwsClient, awsRegion string, requestUrl string, username string, device string, validFor time.Duration) (string, error) {
+	return client.SubmitCertificateRequest(context.Background(), client.RequestOptions{
+		AwsRegion:  awsRegion,
+		RequestUrl: requestUrl,
+		Transport:  clientTransport,
+		AwsClient:  awsClient,
+		Username:   username,
+		Device:     device,
+		ValidFor:   validFor,
+	})
 }
 
-func createOvpnFile(username string, contents string) (error) {
-	filename := "./" + username + ".ovpn"
+// Write the given profile into outputDir. Profiles contain the user's private key, so only the current user may read
+// them, and a directory created for them.
+func createOvpnFile(outputDir string, profileName string, contents string) (string, error) {
+	filename := filepath.Join(outputDir, profileName)
 
 	logger := logging.GetLogger(LOGGER_NAME)
 	logger.Info(fmt.Sprintf("Creating OpenVpn configuration file %s", filename))
 
-	err := ioutil.WriteFile(filename, []byte(contents), 0644)
+	err := os.MkdirAll(outputDir, 0700)
 	if err != nil {
-		return err
+		return "", errors.WithStackTrace(err)
 	}
 
-	return nil
-}
\ No newline at end of file
+	err = ioutil.WriteFile(filename, []byte(contents), 0600)
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+
+	// WriteFile keeps the mode of a file that already exists, such as a profile written by an older version
+	err = os.Chmod(filename, 0600)
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+
+	return filename, nil
+}
@@ -2,25 +2,23 @@ package app
 
 import (
 	"github.com/urfave/cli"
-	"fmt"
+	"context"
 	"github.com/gruntwork-io/gruntwork-cli/logging"
-	"encoding/json"
 	"github.com/gruntwork-io/gruntwork-cli/errors"
 	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
 )
 
-type CertificateRevokeRequest struct {
-	Username      string
-	ResponseQueue string
-}
-
-type CertificateRevokeResponse struct {
-	Success      bool
-	ErrorMessage string
-}
-
 func requestCertificateRevocation(cliContext *cli.Context) error {
 	setLoggerLevel(cliContext)
+	return forEachServer(cliContext, func(string) error {
+		return requestCertificateRevocationFromServer(cliContext)
+	})
+}
+
+// Request revocation from the server the options point at, which forEachServer sets up for a server of the client
+// config
+func requestCertificateRevocationFromServer(cliContext *cli.Context) error {
 	logger := logging.GetLogger(LOGGER_NAME)
 
 	awsRegion, err := getAwsRegion(cliContext)
@@ -29,81 +27,91 @@ func requestCertificateRevocation(cliContext *cli.Context) error {
 	}
 	logger.Debugf("Using AWS Region: %s", awsRegion)
 
-	username, err := getUsername(cliContext, false)
+	awsClient, err := newAwsClient(cliContext)
 	if err != nil {
 		return err
 	}
-	logger.Debugf("Using Username: %s", username)
 
-	logger.Info("Looking up SQS queue")
-	revokeUrl, err := getRevokeUrl(cliContext)
-	if err != nil {
+	if err := configureUsernameRules(cliContext); err != nil {
 		return err
 	}
-	logger.Debugf("Using Revoke URL: %s", revokeUrl)
 
-	timeout, err := getTimeout(cliContext)
-	if err != nil {
-		return err
+	fromFile := cliContext.String(OPTION_FROM_FILE)
+
+	var username string
+	if fromFile == "" {
+		username, err = getUsername(cliContext, awsClient, false)
+		if err != nil {
+			return err
+		}
+		logger.Debugf("Using Username: %s", username)
 	}
 
-	//Create a new response queue
-	logger.Info("Creating temporary SQS response queue")
-	responseQueue, err := createResponseQueue(awsRegion)
+	device, err := getDevice(cliContext, username)
 	if err != nil {
 		return err
 	}
-	defer deleteResponseQueue(awsRegion, responseQueue)
 
-	//Put a request for a new certificate revocation on the revokeQueue
-	logger.Infof("Requesting certificate revocation for %s on %s", username, revokeUrl)
-	err = sendRevoke(awsRegion, revokeUrl, username, responseQueue)
-	if err != nil {
-		return err
+	allDevices := cliContext.Bool(OPTION_ALL_DEVICES)
+	if allDevices && device != "" {
+		return errors.WithStackTrace(DeviceAndAllDevices)
 	}
 
-	// Wait for a reply from OpenVPN server on the responseQueue
-	logger.Info("Waiting for response from OpenVPN server")
-	receipt, response, err := waitForMessage(awsRegion, responseQueue, timeout)
+	logger.Info("Looking up SQS queue")
+	revokeUrl, err := getRevokeUrl(cliContext, awsClient)
 	if err != nil {
 		return err
 	}
+	logger.Debugf("Using Revoke URL: %s", revokeUrl)
 
-	// Process the response
-	logger.Info("Response received from OpenVPN server")
-	err = processRevokeResponse(awsRegion, responseQueue, receipt, response, username)
+	timeout, err := getTimeout(cliContext)
 	if err != nil {
 		return err
 	}
 
-	logger.Info("DONE")
-	return nil
-}
+	if fromFile != "" {
+		usernames, err := readUsernamesFromFile(fromFile)
+		if err != nil {
+			return err
+		}
 
-func sendRevoke(awsRegion string, revokeQueue string, username string, responseQueue string) error {
-	req := &CertificateRevokeRequest{
-		Username: username,
-		ResponseQueue:responseQueue,
+		logger.Infof("Requesting certificate revocation for %d users from %s", len(usernames), fromFile)
+		results := runBatch(usernames, func(username string) (batchResult, error) {
+			return batchResult{}, revokeCertificateForUser(awsClient, awsRegion, revokeUrl, username, device, allDevices, timeout)
+		})
+
+		return reportBatchResults(cliContext, results)
 	}
-	requestJson, _ := json.Marshal(req)
 
-	err := aws_helpers.SendMessageToQueue(awsRegion, revokeQueue, string(requestJson))
+	err = revokeCertificateForUser(awsClient, awsRegion, revokeUrl, username, device, allDevices, timeout)
 	if err != nil {
 		return err
 	}
+
+	logger.Info("DONE")
 	return nil
 }
 
-func processRevokeResponse(awsRegion string, responseQueue string, receipt string, message string, username string) error {
-	response := CertificateRevokeResponse{}
-	json.Unmarshal([]byte(message), &response)
+// Request revocation of the certificate of the given user and device (which may be empty), or of all of the user's
+// certificates, and wait for the result
+func revokeCertificateForUser(awsClient *aws_helpers.AwsClient, awsRegion string, revokeUrl string, username string, device string, allDevices bool, timeout int) error {
+	logger := logging.GetLogger(LOGGER_NAME)
 
-	if (!response.Success) {
-		aws_helpers.DeleteMessageFromQueue(awsRegion, responseQueue, receipt)
-		return errors.WithStackTrace(fmt.Errorf(response.ErrorMessage))
+	logger.Infof("Requesting certificate revocation for %s on %s and waiting for the OpenVPN server", client.CertificateName(username, device), revokeUrl)
+	revocation, err := client.RevokeCertificate(context.Background(), client.RevokeOptions{
+		AwsRegion:  awsRegion,
+		RevokeUrl:  revokeUrl,
+		Transport:  clientTransport,
+		AwsClient:  awsClient,
+		Username:   username,
+		Device:     device,
+		AllDevices: allDevices,
+		Timeout:    timeout,
+	})
+	if err != nil {
+		return err
 	}
 
-	aws_helpers.DeleteMessageFromQueue(awsRegion, responseQueue, receipt)
+	logger.Infof("Certificate for %s revoked. Terminated %d active sessions.", client.CertificateName(username, device), revocation.SessionsTerminated)
 	return nil
 }
-
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/urfave/cli"
+)
+
+// Show the clients connected to the OpenVPN server right now
+func showStatus(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	if err := configurePkiStorage(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	clients, err := readConnectedClients(cliContext)
+	if err != nil {
+		return err
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	annotateCertificateStatus(clients, entries)
+
+	writer := cliContext.App.Writer
+
+	if cliContext.Bool(OPTION_JSON) {
+		clientsJson, err := json.MarshalIndent(clients, "", "  ")
+		if err != nil {
+			return errors.WithStackTrace(err)
+		}
+		fmt.Fprintln(writer, string(clientsJson))
+		return nil
+	}
+
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "USERNAME\tREAL ADDRESS\tVIRTUAL IP\tBYTES IN\tBYTES OUT\tCONNECTED SINCE\tCERTIFICATE")
+	for _, client := range clients {
+		certificateStatus := client.CertificateStatus
+		if certificateStatus != "valid" {
+			certificateStatus = fmt.Sprintf("%s (!)", certificateStatus)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", client.CommonName, client.RealAddress, client.VirtualAddress, client.BytesReceived, client.BytesSent, client.ConnectedSince.Format(time.RFC3339), certificateStatus)
+	}
+	table.Flush()
+
+	return nil
+}
+
+func readConnectedClients(cliContext *cli.Context) ([]connectedClient, error) {
+	if statusFile := cliContext.String(OPTION_STATUS_FILE); statusFile != "" {
+		return readConnectedClientsFromStatusFile(statusFile)
+	}
+
+	managementAddress := cliContext.String(OPTION_MANAGEMENT_ADDRESS)
+	if managementAddress == "" {
+		return nil, errors.WithStackTrace(MissingStatusSource)
+	}
+
+	return readConnectedClientsFromManagement(managementAddress, cliContext.String(OPTION_MANAGEMENT_PASSWORD_FILE))
+}
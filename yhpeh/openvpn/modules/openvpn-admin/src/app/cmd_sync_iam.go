@@ -0,0 +1,282 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/urfave/cli"
+)
+
+// A certificate whose owner no longer has access according to IAM, and what sync-iam did about it. Certificates of
+// people without an IAM user, such as SSO users, are only reported (Unknown) unless --revoke-unknown-users is set.
+type iamSyncResult struct {
+	CommonName string
+	Serial     string
+	Reason     string
+	Unknown    bool
+	Revoked    bool
+	Error      error
+}
+
+type iamSyncOptions struct {
+	AwsClient          *aws_helpers.AwsClient
+	AwsRegion          string
+	AllowedGroups      []string
+	DryRun             bool
+	MaxRevocations     int
+	RevokeUnknownUsers bool
+}
+
+// Whether sync-iam revokes the certificate of this result
+func (result iamSyncResult) ShouldRevoke(options iamSyncOptions) bool {
+	return !result.Unknown || options.RevokeUnknownUsers
+}
+
+func syncIamUsers(cliContext *cli.Context) error {
+	setLoggerLevel(cliContext)
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	awsClient, err := newAwsClient(cliContext)
+	if err != nil {
+		return err
+	}
+
+	options, err := getIamSyncOptions(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("Using AWS Region: %s", options.AwsRegion)
+
+	if err := configurePkiLease(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	if err := configureUsernameRules(cliContext); err != nil {
+		return err
+	}
+
+	if err := configurePkiStorage(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	if err := configureWebhooks(cliContext); err != nil {
+		return err
+	}
+	defer flushWebhooks()
+
+	configureSessionTermination(cliContext)
+
+	results, err := reconcileIamUsers(options)
+	printIamSyncReport(cliContext.App.Writer, results, options)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if result.Error != nil {
+			return errors.WithStackTrace(IamSyncFailed(len(results)))
+		}
+	}
+
+	logger.Info("DONE")
+	return nil
+}
+
+// Run the IAM reconciliation every interval, in the background, for the lifetime of the process-revokes daemon. This is
+// a no-op if --sync-iam-interval is not set. If leader is not nil, standbys skip the reconciliation.
+func startPeriodicIamSync(cliContext *cli.Context, awsClient *aws_helpers.AwsClient, leader *leaderElection) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	interval := cliContext.Duration(OPTION_SYNC_IAM_INTERVAL)
+	if interval <= 0 {
+		return nil
+	}
+
+	options, err := getIamSyncOptions(cliContext, awsClient)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			if leader != nil && !leader.IsLeader() {
+				time.Sleep(interval)
+				continue
+			}
+
+			logger.Infof("Reconciling certificates with IAM users")
+			results, err := reconcileIamUsers(options)
+			if err != nil {
+				logger.Errorf("IAM reconciliation failed: %s", err.Error())
+			}
+			for _, result := range results {
+				if !result.ShouldRevoke(options) {
+					logger.Infof("Not revoking certificate for %s (%s). Pass --%s to revoke it.", result.CommonName, result.Reason, OPTION_REVOKE_UNKNOWN_USERS)
+				} else if result.Error != nil {
+					logger.Errorf("Unable to revoke certificate for %s (%s): %s", result.CommonName, result.Reason, result.Error.Error())
+				} else if result.Revoked {
+					logger.Infof("Revoked certificate for %s (%s)", result.CommonName, result.Reason)
+				} else {
+					logger.Infof("Would revoke certificate for %s (%s)", result.CommonName, result.Reason)
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+
+	return nil
+}
+
+func getIamSyncOptions(cliContext *cli.Context, awsClient *aws_helpers.AwsClient) (iamSyncOptions, error) {
+	awsRegion, err := getAwsRegion(cliContext)
+	if err != nil {
+		return iamSyncOptions{}, err
+	}
+
+	return iamSyncOptions{
+		AwsClient:          awsClient,
+		AwsRegion:          awsRegion,
+		AllowedGroups:      cliContext.StringSlice(OPTION_ALLOWED_GROUP),
+		DryRun:             cliContext.Bool(OPTION_DRY_RUN),
+		MaxRevocations:     cliContext.Int(OPTION_MAX_REVOCATIONS),
+		RevokeUnknownUsers: cliContext.Bool(OPTION_REVOKE_UNKNOWN_USERS),
+	}, nil
+}
+
+// Compare the valid certificates in index.txt with the IAM users in the account and revoke the certificates of users
+// that are no longer a member of any of the allowed groups. Certificates without any IAM user behind them are only
+// revoked with RevokeUnknownUsers, as they may belong to people who sign in through SSO. If more than MaxRevocations
+// certificates would be revoked, nothing is revoked at all, as that usually means IAM is misconfigured (e.g. a typo in
+// a group name) rather than that half the company just left.
+func reconcileIamUsers(options iamSyncOptions) ([]iamSyncResult, error) {
+	results, err := findCertificatesWithoutIamAccess(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.DryRun {
+		return results, nil
+	}
+
+	count := 0
+	for _, result := range results {
+		if result.ShouldRevoke(options) {
+			count++
+		}
+	}
+	if count > options.MaxRevocations {
+		return results, errors.WithStackTrace(TooManyRevocations{Count: count, Max: options.MaxRevocations})
+	}
+
+	for i := range results {
+		if !results[i].ShouldRevoke(options) {
+			continue
+		}
+		_, results[i].Error = revokeUserCertificate(results[i].CommonName)
+		results[i].Revoked = results[i].Error == nil
+	}
+
+	return results, nil
+}
+
+func findCertificatesWithoutIamAccess(options iamSyncOptions) ([]iamSyncResult, error) {
+	entries, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	iamUsers, err := options.AwsClient.ListIamUserNames(options.AwsRegion)
+	if err != nil {
+		return nil, err
+	}
+	for i := range iamUsers {
+		iamUsers[i] = mapUsername(iamUsers[i])
+	}
+	existingUsers := toSet(iamUsers)
+
+	var allowedUsers map[string]bool
+	if len(options.AllowedGroups) > 0 {
+		allowedUsers = map[string]bool{}
+		for _, group := range options.AllowedGroups {
+			members, err := options.AwsClient.ListIamGroupMemberNames(options.AwsRegion, group)
+			if err != nil {
+				return nil, err
+			}
+			for _, member := range members {
+				allowedUsers[mapUsername(member)] = true
+			}
+		}
+	}
+
+	results := []iamSyncResult{}
+	for _, entry := range entries {
+		if !entry.IsValid() || !entry.IsUserCertificate() {
+			continue
+		}
+
+		// The certificates of all of a user's devices go with the user
+		username, _ := client.SplitCertificateName(entry.CommonName)
+		if !existingUsers[username] {
+			results = append(results, iamSyncResult{CommonName: entry.CommonName, Serial: entry.Serial, Reason: "no IAM user", Unknown: true})
+		} else if allowedUsers != nil && !allowedUsers[username] {
+			results = append(results, iamSyncResult{CommonName: entry.CommonName, Serial: entry.Serial, Reason: "not a member of an allowed group"})
+		}
+	}
+
+	return results, nil
+}
+
+func printIamSyncReport(writer io.Writer, results []iamSyncResult, options iamSyncOptions) {
+	if len(results) == 0 {
+		fmt.Fprintln(writer, "All valid certificates belong to IAM users with access.")
+		return
+	}
+
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "USERNAME\tSERIAL\tREASON\tACTION")
+	for _, result := range results {
+		action := "skipped"
+		if !result.ShouldRevoke(options) {
+			action = fmt.Sprintf("skipped (pass --%s to revoke)", OPTION_REVOKE_UNKNOWN_USERS)
+		} else if options.DryRun {
+			action = "would revoke"
+		} else if result.Revoked {
+			action = "revoked"
+		} else if result.Error != nil {
+			action = fmt.Sprintf("failed: %s", errors.Unwrap(result.Error).Error())
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", result.CommonName, result.Serial, result.Reason, action)
+	}
+	table.Flush()
+}
+
+func toSet(values []string) map[string]bool {
+	set := map[string]bool{}
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// Custom errors
+
+type TooManyRevocations struct {
+	Count int
+	Max   int
+}
+
+func (err TooManyRevocations) Error() string {
+	return fmt.Sprintf("Refusing to revoke %d certificates in one pass as that exceeds --%s (%d). Check the report and re-run with a higher limit if this is intended.", err.Count, OPTION_MAX_REVOCATIONS, err.Max)
+}
+
+type IamSyncFailed int
+
+func (err IamSyncFailed) Error() string {
+	return fmt.Sprintf("Failed to revoke some of the %d certificates without IAM access. See the report above for details.", int(err))
+}
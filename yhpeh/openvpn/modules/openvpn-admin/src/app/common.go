@@ -1,50 +1,21 @@
 package app
 
 import (
-	"regexp"
-	"fmt"
 	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
 	"net/http"
-	"strings"
 	"time"
 	"github.com/gruntwork-io/gruntwork-cli/logging"
-	"github.com/gruntwork-io/gruntwork-cli/files"
+	"github.com/gruntwork-io/gruntwork-cli/errors"
 	"io/ioutil"
 )
 
-func createResponseQueue(awsRegion string) (string, error) {
-	queueUrl, err := aws_helpers.CreateRandomQueue(awsRegion, "openvpn-response")
-	if err != nil {
-		return "", err
-	}
-	return queueUrl, nil
-}
-
-func deleteResponseQueue(awsRegion string, responseQueue string) (error) {
-	err := aws_helpers.DeleteQueue(awsRegion, responseQueue)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func waitForMessage(awsRegion string, queue string, timeout int) (string, string, error) {
-	receipt, message, err := aws_helpers.WaitForQueueMessage(awsRegion, queue, timeout)
-	if err != nil {
-		return "", "", err
-	}
-
-	return receipt, message, nil
-}
-
 func indexContainsValidCertificate(username string) (bool, error) {
-	indexFile, err := files.ReadFileAsString("/etc/openvpn/index.txt")
+	entries, err := readIndex()
 	if err != nil {
 		return false, err
 	}
 
-	pattern := fmt.Sprintf("V\\s+.*(CN=%s)", username)
-	return regexp.MatchString(pattern, indexFile)
+	return hasValidCertificate(entries, username), nil
 }
 
 func getIpAddress() (string, error) {
@@ -68,12 +39,67 @@ func getIpAddress() (string, error) {
 	return ipaddress, nil
 }
 
-func sleepOnFailedToReceiveMessages(err error) bool {
+// Backoff bounds for retrying a request processing daemon's queue after receiving from it failed
+const RECEIVE_MIN_BACKOFF = time.Second
+const RECEIVE_MAX_BACKOFF = 2 * time.Minute
+
+// Receives the messages of a request processing daemon. Receive errors never stop the daemon: transient ones (throttling,
+// network errors, expired credentials) are retried with jittered exponential backoff, and fatal ones (a missing queue,
+// credentials that stay invalid after a refresh) are retried at the same pace but also reported through the health
+// endpoints, so they get noticed rather than ending in a silent exit.
+type queueReceiver struct {
+	AwsClient *aws_helpers.AwsClient
+	AwsRegion string
+	QueueUrl  string
+	Timeout   int
+	Health    *daemonHealth
+
+	failures     int
+	authFailures int
+}
+
+// Wait for the next message. Returns false if none arrived (including after an error), in which case the caller should
+// simply call receive again.
+func (receiver *queueReceiver) receive() (string, string, bool) {
 	logger := logging.GetLogger(LOGGER_NAME)
-	if strings.Contains(err.Error(), "Failed to receive messages") {
-		logger.Warn(fmt.Sprintf("%s, sleeping for 30 seconds before retrying", err.Error()))
-		time.Sleep(time.Second * 30)
-		return true
+
+	receipt, message, err := receiver.AwsClient.WaitForQueueMessage(receiver.AwsRegion, receiver.QueueUrl, receiver.Timeout)
+	if err == nil {
+		receiver.succeeded()
+		return receipt, message, true
+	}
+
+	fatal := false
+	switch errors.Unwrap(err).(type) {
+	case aws_helpers.QueueReceiveTimeout:
+		logger.Debugf("No messages on %s within %d seconds", receiver.QueueUrl, receiver.Timeout)
+		receiver.succeeded()
+		return "", "", false
+	case aws_helpers.QueueAuthFailed:
+		// The first failure may just be expired credentials (e.g. a rotated instance profile), so look them up again
+		receiver.authFailures++
+		fatal = receiver.authFailures > 1
+		receiver.AwsClient.RefreshCredentials(receiver.AwsRegion)
+	case aws_helpers.QueueMissing:
+		fatal = true
 	}
-	return false
-}
\ No newline at end of file
+
+	delay := aws_helpers.BackoffDelay(RECEIVE_MIN_BACKOFF, RECEIVE_MAX_BACKOFF, receiver.failures)
+	receiver.failures++
+	receiver.Health.recordFailure(err, fatal)
+
+	if fatal {
+		logger.Errorf("%s. Retrying in %s.", err.Error(), delay)
+	} else {
+		logger.Warnf("%s. Retrying in %s.", err.Error(), delay)
+	}
+
+	time.Sleep(delay)
+	return "", "", false
+}
+
+func (receiver *queueReceiver) succeeded() {
+	receiver.failures = 0
+	receiver.authFailures = 0
+	receiver.Health.recordSuccess()
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+)
+
+const CRL_FILE_PATH = "/etc/openvpn/crl.pem"
+
+// The decoded contents of crl.pem. OpenVPN runs with crl-verify, so once NextUpdate passes, every client is rejected.
+type crlStatus struct {
+	Issuer     string
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	Entries    []crlEntry
+}
+
+type crlEntry struct {
+	Serial         string
+	CommonName     string
+	RevocationDate time.Time
+}
+
+func (status crlStatus) TimeUntilNextUpdate() time.Duration {
+	return status.NextUpdate.Sub(time.Now())
+}
+
+func readCrlFile() ([]byte, error) {
+	contents, err := pkiStore.ReadFile(CRL_FILE_PATH)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+	return contents, nil
+}
+
+func readCrl() (*pkix.CertificateList, error) {
+	contents, err := readCrlFile()
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := x509.ParseCRL(contents)
+	if err != nil {
+		return nil, errors.WithStackTraceAndPrefix(err, "Unable to parse %s", CRL_FILE_PATH)
+	}
+
+	return crl, nil
+}
+
+// Decode the CRL and resolve the common name of each revoked serial from index.txt
+func readCrlStatus() (crlStatus, error) {
+	crl, err := readCrl()
+	if err != nil {
+		return crlStatus{}, err
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return crlStatus{}, err
+	}
+
+	commonNamesBySerial := map[string]string{}
+	for _, entry := range entries {
+		commonNamesBySerial[entry.Serial] = entry.CommonName
+	}
+
+	status := crlStatus{
+		Issuer:     crl.TBSCertList.Issuer.String(),
+		ThisUpdate: crl.TBSCertList.ThisUpdate,
+		NextUpdate: crl.TBSCertList.NextUpdate,
+	}
+
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		serial := formatSerial(revoked.SerialNumber)
+		status.Entries = append(status.Entries, crlEntry{
+			Serial:         serial,
+			CommonName:     commonNamesBySerial[serial],
+			RevocationDate: revoked.RevocationTime,
+		})
+	}
+
+	return status, nil
+}
+
+// Regenerate crl.pem from index.txt. This also pushes the next update out by default_crl_days.
+func regenerateCrl() error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	return changePki(func() error {
+		logger.Debugf("Running ./gencrl-wrapper.sh")
+		command := exec.Command("./gencrl-wrapper.sh")
+		command.Dir = "/etc/openvpn-ca"
+
+		output, err := command.CombinedOutput()
+		if err != nil {
+			return errors.WithStackTraceAndPrefix(err, "Unable to regenerate CRL: %s", strings.TrimSpace(string(output)))
+		}
+
+		return nil
+	})
+}
+
+// Format a serial the way OpenSSL writes it to index.txt: upper case hex, padded to a whole number of bytes
+func formatSerial(serial *big.Int) string {
+	hex := fmt.Sprintf("%X", serial)
+	if len(hex)%2 == 1 {
+		hex = "0" + hex
+	}
+	return hex
+}
@@ -0,0 +1,308 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+)
+
+// How long certificates of the throwaway CA of openvpn-admin dev are valid for if the request doesn't say
+const DEV_DEFAULT_VALIDITY = 365 * DAY
+
+const DEV_SERVER_ADDRESS = "127.0.0.1"
+
+const DEV_PROFILE_TEMPLATE = `client
+dev tun
+proto udp
+remote __SERVER_ADDRESS__ 1194
+resolv-retry infinite
+nobind
+persist-key
+persist-tun
+remote-cert-tls server
+verb 3
+<ca>
+__CA_CERTIFICATE__</ca>
+<cert>
+__CLIENT_CERTIFICATE__</cert>
+<key>
+__CLIENT_KEY__</key>
+`
+
+// The transport the request, fetch and revoke commands use, or nil for SQS. openvpn-admin dev points them at its
+// in-memory server.
+var clientTransport client.Transport
+
+// A throwaway certificate authority for openvpn-admin dev. Rather than running easy-rsa in /etc/openvpn-ca, it signs
+// certificates itself and keeps them, along with an index.txt in the format easy-rsa maintains, in a directory of its
+// own. It applies the same naming policy and device limit as the real PKI.
+type devAuthority struct {
+	Dir string
+
+	mutex  sync.Mutex
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+// Create a CA in the given directory
+func newDevAuthority(dir string) (*devAuthority, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "openvpn-admin dev CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * DAY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	authority := &devAuthority{Dir: dir, caCert: caCert, caKey: caKey, serial: 1}
+	if err := authority.writeFile(filepath.Base(CA_CERT_PATH), pemBlock("CERTIFICATE", caDer)); err != nil {
+		return nil, err
+	}
+	if err := authority.writeFile(filepath.Base(INDEX_FILE_PATH), ""); err != nil {
+		return nil, err
+	}
+	return authority, nil
+}
+
+func (authority *devAuthority) IssueCertificate(commonName string, validFor time.Duration) (string, error) {
+	if err := checkCommonName(commonName); err != nil {
+		return "", err
+	}
+	if validFor < 0 {
+		return "", errors.WithStackTrace(InvalidValidity(validFor))
+	}
+	if validFor == 0 {
+		validFor = DEV_DEFAULT_VALIDITY
+	}
+
+	authority.mutex.Lock()
+	defer authority.mutex.Unlock()
+
+	entries, err := authority.readIndex()
+	if err != nil {
+		return "", err
+	}
+	if err := checkUsernameCollision(entries, commonName); err != nil {
+		return "", err
+	}
+	if hasValidCertificate(entries, commonName) {
+		return "", errors.WithStackTrace(fmt.Errorf("a valid certificate for %s already exists", commonName))
+	}
+	username, _ := client.SplitCertificateName(commonName)
+	if err := checkDeviceLimit(entries, username); err != nil {
+		return "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+
+	// Like easy-rsa, issue certificates for whole days
+	now := time.Now()
+	authority.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(authority.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now,
+		NotAfter:     now.Add((validFor + DAY - 1) / DAY * DAY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, authority.caCert, &key.PublicKey, authority.caKey)
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+
+	data := certificatePartData{
+		IpAddress:       DEV_SERVER_ADDRESS,
+		CaCertificate:   pemBlock("CERTIFICATE", authority.caCert.Raw),
+		UserCertificate: pemBlock("CERTIFICATE", certDer),
+		UserKey:         pemBlock("EC PRIVATE KEY", keyDer),
+	}
+	if err := authority.writeFile(commonName+".crt", data.UserCertificate); err != nil {
+		return "", err
+	}
+	if err := authority.writeFile(commonName+".key", data.UserKey); err != nil {
+		return "", err
+	}
+
+	entries = append(entries, indexEntry{
+		Status:         INDEX_STATUS_VALID,
+		ExpirationDate: template.NotAfter,
+		Serial:         fmt.Sprintf("%02X", authority.serial),
+		Subject:        "/CN=" + commonName,
+		CommonName:     commonName,
+	})
+	if err := authority.writeIndex(entries); err != nil {
+		return "", err
+	}
+
+	return renderProfile(DEV_PROFILE_TEMPLATE, data), nil
+}
+
+func (authority *devAuthority) RevokeCertificate(commonName string) error {
+	if err := checkCommonName(commonName); err != nil {
+		return err
+	}
+
+	authority.mutex.Lock()
+	defer authority.mutex.Unlock()
+
+	entries, err := authority.readIndex()
+	if err != nil {
+		return err
+	}
+	if !hasValidCertificate(entries, commonName) {
+		return errors.WithStackTrace(fmt.Errorf("a valid certificate for %s does not exist", commonName))
+	}
+
+	return authority.writeIndex(revokeIndexEntries(entries, []string{commonName}))
+}
+
+func (authority *devAuthority) RevokeAllCertificates(username string) ([]string, error) {
+	if err := checkUsername(username); err != nil {
+		return nil, err
+	}
+
+	authority.mutex.Lock()
+	defer authority.mutex.Unlock()
+
+	entries, err := authority.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := []string{}
+	for _, certificate := range validCertificatesOf(entries, username) {
+		revoked = append(revoked, certificate.CommonName)
+	}
+	if len(revoked) == 0 {
+		return nil, errors.WithStackTrace(fmt.Errorf("%s has no valid certificates", username))
+	}
+
+	return revoked, authority.writeIndex(revokeIndexEntries(entries, revoked))
+}
+
+func (authority *devAuthority) readIndex() ([]indexEntry, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(authority.Dir, filepath.Base(INDEX_FILE_PATH)))
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+	return parseIndex(string(contents))
+}
+
+func (authority *devAuthority) writeIndex(entries []indexEntry) error {
+	lines := []string{}
+	for _, entry := range entries {
+		lines = append(lines, formatIndexLine(entry))
+	}
+	return authority.writeFile(filepath.Base(INDEX_FILE_PATH), strings.Join(lines, ""))
+}
+
+func (authority *devAuthority) writeFile(name string, contents string) error {
+	return errors.WithStackTrace(ioutil.WriteFile(filepath.Join(authority.Dir, name), []byte(contents), 0600))
+}
+
+// Mark the valid certificates with the given common names as revoked
+func revokeIndexEntries(entries []indexEntry, commonNames []string) []indexEntry {
+	now := time.Now()
+	for i := range entries {
+		for _, commonName := range commonNames {
+			if entries[i].Status == INDEX_STATUS_VALID && entries[i].CommonName == commonName {
+				entries[i].Status = INDEX_STATUS_REVOKED
+				entries[i].RevocationDate = now
+			}
+		}
+	}
+	return entries
+}
+
+// Format an entry the way OpenSSL writes it to index.txt. See parseIndexLine.
+func formatIndexLine(entry indexEntry) string {
+	revocationDate := ""
+	if !entry.RevocationDate.IsZero() {
+		revocationDate = formatIndexTime(entry.RevocationDate)
+	}
+	return strings.Join([]string{entry.Status, formatIndexTime(entry.ExpirationDate), revocationDate, entry.Serial, "unknown", entry.Subject}, "\t") + "\n"
+}
+
+func formatIndexTime(value time.Time) string {
+	return value.UTC().Format("060102150405Z")
+}
+
+func pemBlock(blockType string, der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+}
+
+// Reads the PKI of the throwaway CA of openvpn-admin dev, so that e.g. list works against it. Its PKI files live in
+// Dir under the same names as in /etc/openvpn. Changes only happen through devAuthority.
+type devPkiStorage struct {
+	Dir string
+}
+
+func (storage devPkiStorage) ReadFile(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(storage.Dir, filepath.Base(path)))
+	return contents, errors.WithStackTrace(err)
+}
+
+func (storage devPkiStorage) ReadWorkingFile(path string) ([]byte, error) {
+	return storage.ReadFile(path)
+}
+
+func (storage devPkiStorage) Sync() error {
+	return nil
+}
+
+func (storage devPkiStorage) Change(change func() error, checkLock func() error) error {
+	return change()
+}
+
+// Create the temporary directory openvpn-admin dev keeps its PKI, results and profiles in
+func createDevDir() (string, error) {
+	dir, err := ioutil.TempDir("", "openvpn-admin-dev-")
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+	for _, subdir := range []string{"results", "profiles"} {
+		if err := os.Mkdir(filepath.Join(dir, subdir), 0700); err != nil {
+			return "", errors.WithStackTrace(err)
+		}
+	}
+	return dir, nil
+}
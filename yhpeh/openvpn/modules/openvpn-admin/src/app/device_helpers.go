@@ -0,0 +1,83 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/urfave/cli"
+)
+
+const DEFAULT_MAX_DEVICES = 5
+
+// Device names go through the same paths as usernames (see usernamePattern), but may not contain @
+var devicePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// How many valid certificates a user may hold at once, counting the one without a device. 0 means no limit. See
+// configureMaxDevices.
+var maxDevicesPerUser = DEFAULT_MAX_DEVICES
+
+// Set up the device limit given by --max-devices
+func configureMaxDevices(cliContext *cli.Context) error {
+	maxDevices := cliContext.Int(OPTION_MAX_DEVICES)
+	if maxDevices < 0 {
+		return errors.WithStackTrace(InvalidMaxDevices(maxDevices))
+	}
+
+	maxDevicesPerUser = maxDevices
+	return nil
+}
+
+func checkDevice(device string) error {
+	if !devicePattern.MatchString(device) {
+		return errors.WithStackTrace(InvalidDevice(device))
+	}
+	return nil
+}
+
+// Return the valid certificates of the given user, across all of their devices
+func validCertificatesOf(entries []indexEntry, username string) []indexEntry {
+	certificates := []indexEntry{}
+	for _, entry := range entries {
+		if entryUsername, _ := client.SplitCertificateName(entry.CommonName); entry.Status == INDEX_STATUS_VALID && entryUsername == username {
+			certificates = append(certificates, entry)
+		}
+	}
+	return certificates
+}
+
+// Make sure the given user may hold one more certificate
+func checkDeviceLimit(entries []indexEntry, username string) error {
+	if maxDevicesPerUser == 0 {
+		return nil
+	}
+
+	if held := len(validCertificatesOf(entries, username)); held >= maxDevicesPerUser {
+		return errors.WithStackTrace(DeviceLimitReached{Username: username, MaxDevices: maxDevicesPerUser})
+	}
+	return nil
+}
+
+// Custom errors
+
+type InvalidDevice string
+
+func (err InvalidDevice) Error() string {
+	return fmt.Sprintf("%q is not a valid device name: it must start with a letter or digit and may only contain letters, digits and . _ -", string(err))
+}
+
+type InvalidMaxDevices int
+
+func (err InvalidMaxDevices) Error() string {
+	return fmt.Sprintf("--%s must be 0 (no limit) or more, but was %d", OPTION_MAX_DEVICES, int(err))
+}
+
+type DeviceLimitReached struct {
+	Username   string
+	MaxDevices int
+}
+
+func (err DeviceLimitReached) Error() string {
+	return fmt.Sprintf("%s already holds %d certificates, which is the most one user may hold. Revoke the certificate of a device that is no longer used first.", err.Username, err.MaxDevices)
+}
@@ -5,11 +5,16 @@ import (
 	"github.com/gruntwork-io/gruntwork-cli/errors"
 	valid "github.com/asaskevich/govalidator"
 	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
 	"github.com/sirupsen/logrus"
 	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 )
 
+// Queues that predate the openvpn-admin tags (see discoverQueues) are still found by these name prefixes
 const REQUEST_QUEUE_NAME_PREFIX = "openvpn-requests-"
 const REVOCATION_QUEUE_NAME_PREFIX = "openvpn-revocations-"
 
@@ -20,6 +25,64 @@ func setLoggerLevel(cliContext *cli.Context) () {
 	}
 }
 
+// SQS long polls (see aws_helpers.WaitForQueueMessage) keep a request open for up to this long
+const SQS_LONG_POLL_DURATION = 20 * time.Second
+
+// Create the long-lived AWS client all AWS API calls of a command go through, from the AWS client options. These may be
+// given before or after the command, and the latter win.
+func newAwsClient(cliContext *cli.Context) (*aws_helpers.AwsClient, error) {
+	options := aws_helpers.DefaultClientOptions()
+	options.EndpointUrl = awsClientString(cliContext, OPTION_ENDPOINT_URL)
+	options.MaxRetries = awsClientInt(cliContext, OPTION_MAX_RETRIES)
+	options.MaxRetryDelay = awsClientDuration(cliContext, OPTION_MAX_RETRY_DELAY)
+	options.RequestTimeout = awsClientDuration(cliContext, OPTION_REQUEST_TIMEOUT)
+	options.Profile = awsClientString(cliContext, OPTION_PROFILE)
+	options.RoleArn = awsClientString(cliContext, OPTION_ROLE_ARN)
+	options.ExternalId = awsClientString(cliContext, OPTION_EXTERNAL_ID)
+	options.MfaSerial = awsClientString(cliContext, OPTION_MFA_SERIAL)
+
+	if options.RoleArn == "" && (options.ExternalId != "" || options.MfaSerial != "") {
+		return nil, errors.WithStackTrace(MissingRoleArn)
+	}
+
+	if options.RequestTimeout > 0 && options.RequestTimeout <= SQS_LONG_POLL_DURATION {
+		return nil, errors.WithStackTrace(RequestTimeoutTooShort)
+	}
+	if options.MaxRetryDelay < options.MinRetryDelay {
+		options.MinRetryDelay = options.MaxRetryDelay
+	}
+
+	return aws_helpers.NewAwsClient(options), nil
+}
+
+// Check the AWS client options before a command runs, so that invalid ones are reported before it does anything
+func checkAwsClientOptions(cliContext *cli.Context) error {
+	_, err := newAwsClient(cliContext)
+	return err
+}
+
+// The value of an AWS client option given after the command, else of one given before it, else the default
+func awsClientString(cliContext *cli.Context, name string) string {
+	if !cliContext.IsSet(name) && cliContext.GlobalIsSet(name) {
+		return cliContext.GlobalString(name)
+	}
+	return cliContext.String(name)
+}
+
+func awsClientInt(cliContext *cli.Context, name string) int {
+	if !cliContext.IsSet(name) && cliContext.GlobalIsSet(name) {
+		return cliContext.GlobalInt(name)
+	}
+	return cliContext.Int(name)
+}
+
+func awsClientDuration(cliContext *cli.Context, name string) time.Duration {
+	if !cliContext.IsSet(name) && cliContext.GlobalIsSet(name) {
+		return cliContext.GlobalDuration(name)
+	}
+	return cliContext.Duration(name)
+}
+
 func getAwsRegion(cliContext *cli.Context) (string, error) {
 	awsRegion := cliContext.String(OPTION_AWS_REGION)
 	if awsRegion == "" {
@@ -28,7 +91,7 @@ func getAwsRegion(cliContext *cli.Context) (string, error) {
 	return awsRegion, nil
 }
 
-func getUsername(cliContext *cli.Context, allowSearch bool) (string, error) {
+func getUsername(cliContext *cli.Context, awsClient *aws_helpers.AwsClient, allowSearch bool) (string, error) {
 	var userName string
 	var err error
 
@@ -37,10 +100,10 @@ func getUsername(cliContext *cli.Context, allowSearch bool) (string, error) {
 		return "", errors.WithStackTrace(err)
 	}
 
-	userName = cliContext.String(OPTION_USERNAME)
+	userName = mapUsername(cliContext.String(OPTION_USERNAME))
 	if userName == "" && allowSearch {
-		// if userName flag is empty, try to get from IAM user
-		userName, err = aws_helpers.GetIamUserName(awsRegion)
+		// if userName flag is empty, derive it from the caller's AWS identity
+		userName, err = resolveCallerUsername(awsClient, awsRegion)
 		if err != nil {
 			return "", errors.WithStackTrace(err)
 		}
@@ -54,15 +117,49 @@ func getUsername(cliContext *cli.Context, allowSearch bool) (string, error) {
 		return "", errors.WithStackTrace(MissingUsername)
 	}
 
+	// Catch names the server would reject before sending a request and waiting for the answer
+	if err := checkUsername(userName); err != nil {
+		return "", err
+	}
+
 	return userName, nil
 }
 
+// Return the device given by --device, if any, checked against the naming policy along with the given username, which
+// may be empty
+func getDevice(cliContext *cli.Context, username string) (string, error) {
+	device := cliContext.String(OPTION_DEVICE)
+	if device == "" {
+		return "", nil
+	}
+
+	if err := checkDevice(device); err != nil {
+		return "", err
+	}
+	if username != "" {
+		if err := checkCommonName(client.CertificateName(username, device)); err != nil {
+			return "", err
+		}
+	}
+
+	return device, nil
+}
+
+// Return the validity given by --valid-for, or 0 if it is not set
+func getValidFor(cliContext *cli.Context) (time.Duration, error) {
+	validFor := cliContext.Duration(OPTION_VALID_FOR)
+	if validFor < 0 {
+		return 0, errors.WithStackTrace(InvalidValidity(validFor))
+	}
+	return validFor, nil
+}
+
 func getTimeout(cliContext *cli.Context) (int, error) {
 	timeout := cliContext.Int(OPTION_TIMEOUT)
 	return timeout, nil
 }
 
-func getRequestUrl(cliContext *cli.Context) (string, error) {
+func getRequestUrl(cliContext *cli.Context, awsClient *aws_helpers.AwsClient) (string, error) {
 	var url string
 	var err error
 
@@ -77,8 +174,8 @@ func getRequestUrl(cliContext *cli.Context) (string, error) {
 
 	if url == "" {
 		logger.Debug("Locating Request URL in " + awsRegion)
-		// if url flag is empty, try to get it automatically based on naming conventions
-		url, err = getQueueUrl(awsRegion, REQUEST_QUEUE_NAME_PREFIX, OPTION_REQUEST_URL)
+		// if url flag is empty, try to find it by its tags
+		url, err = getQueueUrl(cliContext, awsClient, awsRegion, QUEUE_ROLE_REQUESTS, REQUEST_QUEUE_NAME_PREFIX, OPTION_REQUEST_URL)
 		if err != nil {
 			return "", errors.WithStackTrace(err)
 		}
@@ -97,7 +194,7 @@ func getRequestUrl(cliContext *cli.Context) (string, error) {
 	return url, nil
 }
 
-func getRevokeUrl(cliContext *cli.Context) (string, error) {
+func getRevokeUrl(cliContext *cli.Context, awsClient *aws_helpers.AwsClient) (string, error) {
 	var url string
 	var err error
 
@@ -112,8 +209,8 @@ func getRevokeUrl(cliContext *cli.Context) (string, error) {
 	if url == "" {
 		logger.Debugf("Locating Revoke URL in %s", awsRegion)
 
-		// if url flag is empty, try to get it automatically based on naming conventions
-		url, err = getQueueUrl(awsRegion, REVOCATION_QUEUE_NAME_PREFIX, OPTION_REVOKE_URL)
+		// if url flag is empty, try to find it by its tags
+		url, err = getQueueUrl(cliContext, awsClient, awsRegion, QUEUE_ROLE_REVOCATIONS, REVOCATION_QUEUE_NAME_PREFIX, OPTION_REVOKE_URL)
 		if err != nil {
 			return "", errors.WithStackTrace(err)
 		}
@@ -132,32 +229,90 @@ func getRevokeUrl(cliContext *cli.Context) (string, error) {
 	return url, nil
 }
 
-func getQueueUrl(awsRegion string, queueNamePrefix string, argName string) (string, error) {
-	queueUrls, err := aws_helpers.FindQueuesWithNamePrefix(awsRegion, queueNamePrefix)
+// Find the queue with the given role (see discoverQueues). If several servers' queues match, ask which one to use on a
+// terminal, and fail otherwise.
+func getQueueUrl(cliContext *cli.Context, awsClient *aws_helpers.AwsClient, awsRegion string, role string, legacyPrefix string, argName string) (string, error) {
+	queueTags, err := getQueueTags(cliContext)
 	if err != nil {
 		return "", err
 	}
-	if len(queueUrls) == 0 {
-		return "", errors.WithStackTrace(NoQueuesFoundWithPrefix(queueNamePrefix))
+
+	queues, err := discoverQueues(awsClient, awsRegion, role, legacyPrefix, queueTags)
+	if err != nil {
+		return "", err
 	}
-	if len(queueUrls) > 1 {
-		return "", errors.WithStackTrace(MultipleQueuesFoundWithPrefix{Prefix: queueNamePrefix, QueueUrls: queueUrls, ArgName: argName})
+
+	switch len(queues) {
+	case 0:
+		return "", errors.WithStackTrace(NoQueuesFound{Role: role, Prefix: legacyPrefix, Tags: cliContext.String(OPTION_QUEUE_TAGS)})
+	case 1:
+		return queues[0].Url, nil
+	}
+
+	if !isTerminal(os.Stdin) {
+		return "", errors.WithStackTrace(MultipleQueuesFound{Role: role, Queues: queues, ArgName: argName})
 	}
-	return queueUrls[0], nil
+	return chooseQueue(cliContext, role, queues)
+}
+
+// Parse --queue-tags, a comma separated list of key=value pairs
+func getQueueTags(cliContext *cli.Context) (map[string]string, error) {
+	queueTags := map[string]string{}
+
+	value := cliContext.String(OPTION_QUEUE_TAGS)
+	if value == "" {
+		return queueTags, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		keyAndValue := strings.SplitN(pair, "=", 2)
+		if len(keyAndValue) != 2 || strings.TrimSpace(keyAndValue[0]) == "" {
+			return nil, errors.WithStackTrace(InvalidQueueTags(value))
+		}
+		queueTags[strings.TrimSpace(keyAndValue[0])] = strings.TrimSpace(keyAndValue[1])
+	}
+
+	return queueTags, nil
+}
+
+func hasAllTags(tags map[string]string, wanted map[string]string) bool {
+	for key, value := range wanted {
+		if actual, exists := tags[key]; !exists || actual != value {
+			return false
+		}
+	}
+	return true
 }
 
 // Custom errors
 
-type NoQueuesFoundWithPrefix string
-func (err NoQueuesFoundWithPrefix) Error() string {
-	return fmt.Sprintf("Could not find any SQS queues with the name prefix '%s'.", string(err))
+type NoQueuesFound struct {
+	Role   string
+	Prefix string
+	Tags   string
+}
+func (err NoQueuesFound) Error() string {
+	message := fmt.Sprintf("Could not find any SQS queues tagged %s=%s, or untagged ones with the name prefix '%s'", QUEUE_TAG_ROLE, err.Role, err.Prefix)
+	if err.Tags != "" {
+		message += fmt.Sprintf(", with the tags %s", err.Tags)
+	}
+	return message + "."
+}
+
+type MultipleQueuesFound struct {
+	Role    string
+	Queues  []discoveredQueue
+	ArgName string
+}
+func (err MultipleQueuesFound) Error() string {
+	queues := []string{}
+	for _, queue := range err.Queues {
+		queues = append(queues, queue.String())
+	}
+	return fmt.Sprintf("Found %d %s queues: %s. Pick the server with --%s <name>, which works with any %s tag even if the server isn't in the client config, or with --%s or --%s.", len(err.Queues), err.Role, strings.Join(queues, ", "), OPTION_SERVER, QUEUE_TAG_SERVER, OPTION_QUEUE_TAGS, err.ArgName)
 }
 
-type MultipleQueuesFoundWithPrefix struct {
-	Prefix    string
-	QueueUrls []string
-	ArgName   string
+type InvalidQueueTags string
+func (err InvalidQueueTags) Error() string {
+	return fmt.Sprintf("Invalid --%s %s. Expected comma separated key=value pairs, e.g. openvpn-admin:server=prod.", OPTION_QUEUE_TAGS, string(err))
 }
-func (err MultipleQueuesFoundWithPrefix) Error() string {
-	return fmt.Sprintf("Expected to find exactly one queue with prefix '%s' but found %d: %v. Please specify which queue URL to use using the %s argument.", err.Prefix, len(err.QueueUrls), err.QueueUrls, err.ArgName)
-}
\ No newline at end of file
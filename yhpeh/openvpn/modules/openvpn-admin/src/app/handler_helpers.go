@@ -0,0 +1,39 @@
+package app
+
+import (
+	"time"
+
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/server"
+)
+
+// The certificate authority of the daemons: the easy-rsa PKI installed by the install-openvpn module
+type pkiAuthority struct {
+	// How many active sessions the revocations made through this authority have terminated
+	SessionsTerminated int
+}
+
+func (authority *pkiAuthority) IssueCertificate(commonName string, validFor time.Duration) (string, error) {
+	return issueCertificate(commonName, validFor)
+}
+
+func (authority *pkiAuthority) RevokeCertificate(commonName string) error {
+	sessionsTerminated, err := revokeUserCertificate(commonName)
+	authority.SessionsTerminated += sessionsTerminated
+	return err
+}
+
+func (authority *pkiAuthority) RevokeAllCertificates(username string) ([]string, error) {
+	revoked, sessionsTerminated, err := revokeAllUserCertificates(username)
+	authority.SessionsTerminated += sessionsTerminated
+	return revoked, err
+}
+
+// The handler the daemons process requests with, which keeps results in the given store, if any, and holds requests for
+// approval if --require-approval is set (see configureApprovals)
+func newRequestHandler(results server.ResultStore) server.Handler {
+	handler := server.Handler{Authority: &pkiAuthority{}, Results: results, MapUsername: mapUsername}
+	if approvals != nil {
+		handler.Approvals = *approvals
+	}
+	return handler
+}
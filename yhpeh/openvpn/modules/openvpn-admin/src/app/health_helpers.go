@@ -0,0 +1,113 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/urfave/cli"
+)
+
+// The state of a request processing daemon's queue, as served by the health endpoints
+type daemonHealth struct {
+	mutex sync.Mutex
+
+	Queue               string    `json:"queue"`
+	Healthy             bool      `json:"healthy"`
+	Ready               bool      `json:"ready"`
+	Standby             bool      `json:"standby"`
+	LastReceive         time.Time `json:"last_receive"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+}
+
+func newDaemonHealth(queueUrl string) *daemonHealth {
+	return &daemonHealth{Queue: queueUrl, Healthy: true}
+}
+
+// A receive call succeeded (which includes timing out on an idle queue)
+func (health *daemonHealth) recordSuccess() {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.Healthy = true
+	health.Ready = true
+	health.Standby = false
+	health.LastReceive = time.Now()
+	health.ConsecutiveFailures = 0
+	health.LastError = ""
+}
+
+// This server is a hot standby (see --leader-only), so it doesn't receive from the queue, but is ready to take over
+func (health *daemonHealth) recordStandby() {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.Healthy = true
+	health.Ready = true
+	health.Standby = true
+	health.ConsecutiveFailures = 0
+	health.LastError = ""
+}
+
+// A receive call failed. A fatal failure (e.g. the queue was deleted) won't go away by retrying, so the daemon is
+// reported unhealthy until it recovers.
+func (health *daemonHealth) recordFailure(err error, fatal bool) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.Ready = false
+	health.ConsecutiveFailures++
+	health.LastError = err.Error()
+	if fatal {
+		health.Healthy = false
+	}
+}
+
+// Serve /healthz (liveness: fails on fatal errors such as a missing queue or credentials that stay invalid) and /readyz
+// (readiness: fails while receiving from the queue fails) in the background if --health-listen-address is set.
+// Otherwise, this is a no-op.
+func startHealthServer(cliContext *cli.Context, health *daemonHealth) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	listenAddress := cliContext.String(OPTION_HEALTH_LISTEN_ADDRESS)
+	if listenAddress == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", health.handler(func() bool { return health.Healthy }))
+	mux.HandleFunc("/readyz", health.handler(func() bool { return health.Ready }))
+
+	server := &http.Server{Addr: listenAddress, Handler: mux}
+
+	go func() {
+		logger.Infof("Serving health endpoints on %s", listenAddress)
+		if err := server.ListenAndServe(); err != nil {
+			logger.Errorf("Health endpoints stopped: %s", err.Error())
+		}
+	}()
+}
+
+// Respond with the health as JSON, with status 200 if check passes and 503 otherwise
+func (health *daemonHealth) handler(check func() bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		health.mutex.Lock()
+		passed := check()
+		body, err := json.MarshalIndent(health, "", "  ")
+		health.mutex.Unlock()
+
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if !passed {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writer.Write(body)
+	}
+}
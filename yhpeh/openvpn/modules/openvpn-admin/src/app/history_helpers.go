@@ -0,0 +1,154 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+)
+
+// The connection hooks run as nobody, so the history lives in a directory of its own that nobody may write to. See
+// init-openvpn.
+const DEFAULT_HISTORY_FILE = "/var/lib/openvpn-admin/history/history.jsonl"
+
+const HISTORY_EVENT_CONNECT = "connect"
+const HISTORY_EVENT_DISCONNECT = "disconnect"
+
+// A single connect or disconnect event, written by the client-connect and client-disconnect hooks. The history file
+// holds one JSON encoded record per line and is only ever appended to.
+type historyRecord struct {
+	Event          string
+	CommonName     string
+	RealAddress    string
+	VirtualAddress string
+	Time           time.Time
+	BytesReceived  int64 `json:",omitempty"`
+	BytesSent      int64 `json:",omitempty"`
+	DurationSecs   int64 `json:",omitempty"`
+}
+
+// A VPN session reconstructed from the history. End is zero for sessions that are still active (or whose disconnect
+// was never recorded, e.g. because the server crashed).
+type connectionSession struct {
+	CommonName     string
+	RealAddress    string
+	VirtualAddress string
+	Start          time.Time
+	End            time.Time
+	BytesReceived  int64
+	BytesSent      int64
+}
+
+func appendHistoryRecord(path string, record historyRecord) error {
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+	defer file.Close()
+
+	// A single write of a short line to a file opened with O_APPEND is not interleaved with writes from other hooks
+	_, err = file.Write(append(recordJson, '\n'))
+	return errors.WithStackTrace(err)
+}
+
+// Read all records from the history file. A missing file just means nobody has connected yet.
+func readHistory(path string) ([]historyRecord, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []historyRecord{}, nil
+	}
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+	defer file.Close()
+
+	records := []historyRecord{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		record := historyRecord{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			// Skip a partially written line rather than making the whole history unreadable
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, errors.WithStackTrace(scanner.Err())
+}
+
+// Pair up connect and disconnect records into sessions, oldest first. If commonName is not empty, only sessions of
+// that user are returned.
+func sessionsFromHistory(records []historyRecord, commonName string) []connectionSession {
+	sessions := []connectionSession{}
+	open := map[string]int{}
+
+	for _, record := range records {
+		if commonName != "" && record.CommonName != commonName {
+			continue
+		}
+
+		key := record.CommonName + "|" + record.RealAddress
+
+		switch record.Event {
+		case HISTORY_EVENT_CONNECT:
+			open[key] = len(sessions)
+			sessions = append(sessions, connectionSession{
+				CommonName:     record.CommonName,
+				RealAddress:    record.RealAddress,
+				VirtualAddress: record.VirtualAddress,
+				Start:          record.Time,
+			})
+		case HISTORY_EVENT_DISCONNECT:
+			index, isOpen := open[key]
+			if !isOpen {
+				// The connect was not recorded (e.g. the hooks were enabled mid-session), so derive it from the duration
+				index = len(sessions)
+				sessions = append(sessions, connectionSession{
+					CommonName:     record.CommonName,
+					RealAddress:    record.RealAddress,
+					VirtualAddress: record.VirtualAddress,
+					Start:          record.Time.Add(-time.Duration(record.DurationSecs) * time.Second),
+				})
+			}
+			delete(open, key)
+			sessions[index].End = record.Time
+			sessions[index].BytesReceived = record.BytesReceived
+			sessions[index].BytesSent = record.BytesSent
+		}
+	}
+
+	return sessions
+}
+
+// Return the last time each user was connected: the end of their most recent session, or now if they are connected
+func lastSeenByUser(records []historyRecord) map[string]time.Time {
+	lastSeen := map[string]time.Time{}
+	for _, session := range sessionsFromHistory(records, "") {
+		seen := session.End
+		if seen.IsZero() {
+			seen = time.Now()
+		}
+		if seen.After(lastSeen[session.CommonName]) {
+			lastSeen[session.CommonName] = seen
+		}
+	}
+	return lastSeen
+}
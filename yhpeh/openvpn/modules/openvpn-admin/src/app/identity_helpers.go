@@ -0,0 +1,158 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/urfave/cli"
+)
+
+const USERNAME_RULE_NONE = "none"
+const USERNAME_RULE_STRIP_DOMAIN = "strip-domain"
+const USERNAME_RULE_LOWERCASE = "lowercase"
+const USERNAME_RULE_STRIP_PREFIX = "strip-prefix:"
+const USERNAME_RULE_STRIP_SUFFIX = "strip-suffix:"
+const USERNAME_RULE_REPLACE = "replace:"
+
+// Used if --username-rule is not set. Names are used as they are, so that existing certificates, whose names may well be
+// email addresses, keep matching their owners. Rules such as strip-domain are opt-in.
+var DEFAULT_USERNAME_RULES = []string{USERNAME_RULE_NONE}
+
+// A rule that turns an identity (e.g. an SSO session name or an OIDC claim) into a certificate username
+type usernameRule func(string) string
+
+// The rules every username goes through, on the client (request, revoke) as well as on the server (process-requests,
+// process-revokes, sync-iam and the web portal), so both sides agree on the name of a certificate. See
+// configureUsernameRules.
+var usernameRules = mustParseUsernameRules(DEFAULT_USERNAME_RULES)
+
+// Set up the username rules given by --username-rule, or the defaults if there are none
+func configureUsernameRules(cliContext *cli.Context) error {
+	specs := cliContext.StringSlice(OPTION_USERNAME_RULE)
+	if len(specs) == 0 {
+		specs = DEFAULT_USERNAME_RULES
+	}
+
+	rules, err := parseUsernameRules(specs)
+	if err != nil {
+		return err
+	}
+
+	usernameRules = rules
+	return nil
+}
+
+// Apply the username rules, in order, to the given name
+func mapUsername(name string) string {
+	for _, rule := range usernameRules {
+		name = rule(name)
+	}
+	return strings.TrimSpace(name)
+}
+
+func parseUsernameRules(specs []string) ([]usernameRule, error) {
+	rules := []usernameRule{}
+
+	for _, spec := range specs {
+		switch {
+		case spec == USERNAME_RULE_NONE:
+			continue
+		case spec == USERNAME_RULE_STRIP_DOMAIN:
+			rules = append(rules, func(name string) string { return strings.SplitN(name, "@", 2)[0] })
+		case spec == USERNAME_RULE_LOWERCASE:
+			rules = append(rules, strings.ToLower)
+		case strings.HasPrefix(spec, USERNAME_RULE_STRIP_PREFIX):
+			prefix := strings.TrimPrefix(spec, USERNAME_RULE_STRIP_PREFIX)
+			rules = append(rules, func(name string) string { return strings.TrimPrefix(name, prefix) })
+		case strings.HasPrefix(spec, USERNAME_RULE_STRIP_SUFFIX):
+			suffix := strings.TrimPrefix(spec, USERNAME_RULE_STRIP_SUFFIX)
+			rules = append(rules, func(name string) string { return strings.TrimSuffix(name, suffix) })
+		case strings.HasPrefix(spec, USERNAME_RULE_REPLACE) && strings.Count(spec, ":") == 2:
+			parts := strings.Split(spec, ":")
+			old, replacement := parts[1], parts[2]
+			rules = append(rules, func(name string) string { return strings.Replace(name, old, replacement, -1) })
+		default:
+			return nil, errors.WithStackTrace(InvalidUsernameRule(spec))
+		}
+	}
+
+	return rules, nil
+}
+
+func mustParseUsernameRules(specs []string) []usernameRule {
+	rules, err := parseUsernameRules(specs)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// Look up the username of the caller from their AWS credentials with sts:GetCallerIdentity, which works for IAM users
+// as well as for SSO and other assumed role sessions, and apply the username rules
+func resolveCallerUsername(awsClient *aws_helpers.AwsClient, awsRegion string) (string, error) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	arn, err := awsClient.GetCallerIdentityArn(awsRegion)
+	if err != nil {
+		return "", err
+	}
+	logger.Debugf("Caller identity: %s", arn)
+
+	identity, err := usernameFromArn(arn)
+	if err != nil {
+		return "", err
+	}
+
+	username := mapUsername(identity)
+	if username == "" {
+		return "", errors.WithStackTrace(UnsupportedIdentity(arn))
+	}
+
+	logger.Debugf("Derived username %s from %s", username, identity)
+	return username, nil
+}
+
+// Derive the name of a person from the ARN returned by sts:GetCallerIdentity:
+//
+//	arn:aws:iam::111111111111:user/engineering/alice                                -> alice
+//	arn:aws:sts::111111111111:assumed-role/AWSReservedSSO_Admin_0123/alice@acme.com -> alice@acme.com
+//	arn:aws:sts::111111111111:federated-user/alice                                  -> alice
+//
+// For assumed roles, this is the session name, which SSO sets to the user's SSO username.
+func usernameFromArn(arn string) (string, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return "", errors.WithStackTrace(UnsupportedIdentity(arn))
+	}
+
+	resource := strings.Split(parts[5], "/")
+	last := resource[len(resource)-1]
+
+	switch {
+	case parts[2] == "iam" && resource[0] == "user" && len(resource) >= 2:
+		return last, nil
+	case parts[2] == "sts" && resource[0] == "assumed-role" && len(resource) == 3:
+		return last, nil
+	case parts[2] == "sts" && resource[0] == "federated-user" && len(resource) == 2:
+		return last, nil
+	default:
+		return "", errors.WithStackTrace(UnsupportedIdentity(arn))
+	}
+}
+
+// Custom errors
+
+type InvalidUsernameRule string
+
+func (err InvalidUsernameRule) Error() string {
+	return fmt.Sprintf("Invalid --%s %s. Use one of %s, %s, %s, %s<prefix>, %s<suffix> or %s<old>:<new>.", OPTION_USERNAME_RULE, string(err), USERNAME_RULE_NONE, USERNAME_RULE_STRIP_DOMAIN, USERNAME_RULE_LOWERCASE, USERNAME_RULE_STRIP_PREFIX, USERNAME_RULE_STRIP_SUFFIX, USERNAME_RULE_REPLACE)
+}
+
+type UnsupportedIdentity string
+
+func (err UnsupportedIdentity) Error() string {
+	return fmt.Sprintf("Unable to derive a username from %s. Pass --%s instead.", string(err), OPTION_USERNAME)
+}
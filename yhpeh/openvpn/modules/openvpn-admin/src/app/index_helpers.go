@@ -0,0 +1,182 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+)
+
+const INDEX_FILE_PATH = "/etc/openvpn/index.txt"
+
+const INDEX_STATUS_VALID = "V"
+const INDEX_STATUS_REVOKED = "R"
+const INDEX_STATUS_EXPIRED = "E"
+
+// Common names used by init-openvpn for the server's own certificate and for the dummy certificate it revokes to
+// initialize the CRL. These never belong to a user.
+var SERVER_COMMON_NAMES = []string{"server", "dummy"}
+
+// A single line of the OpenSSL CA database (index.txt) maintained by easy-rsa. Each line is tab separated and has the
+// form: status, expiration date, revocation date (only set for revoked certs), serial, filename, subject.
+type indexEntry struct {
+	Status         string
+	ExpirationDate time.Time
+	RevocationDate time.Time
+	Serial         string
+	Subject        string
+	CommonName     string
+}
+
+func (entry indexEntry) IsValid() bool {
+	return entry.Status == INDEX_STATUS_VALID && time.Now().Before(entry.ExpirationDate)
+}
+
+func (entry indexEntry) IsRevoked() bool {
+	return entry.Status == INDEX_STATUS_REVOKED
+}
+
+func (entry indexEntry) IsExpired() bool {
+	return entry.Status == INDEX_STATUS_EXPIRED || (entry.Status == INDEX_STATUS_VALID && !time.Now().Before(entry.ExpirationDate))
+}
+
+func (entry indexEntry) IsUserCertificate() bool {
+	for _, name := range SERVER_COMMON_NAMES {
+		if entry.CommonName == name {
+			return false
+		}
+	}
+	return true
+}
+
+// A human readable status for the certificate: valid, revoked or expired
+func certificateStatus(entry indexEntry) string {
+	switch {
+	case entry.IsRevoked():
+		return "revoked"
+	case entry.IsExpired():
+		return "expired"
+	default:
+		return "valid"
+	}
+}
+
+func readIndex() ([]indexEntry, error) {
+	contents, err := readPkiFileAsString(INDEX_FILE_PATH)
+	if err != nil {
+		return nil, err
+	}
+	return parseIndex(contents)
+}
+
+// Like readIndex, but reads the working copy. Only use this during a change (see changePki).
+func readWorkingIndex() ([]indexEntry, error) {
+	contents, err := readWorkingPkiFileAsString(INDEX_FILE_PATH)
+	if err != nil {
+		return nil, err
+	}
+	return parseIndex(contents)
+}
+
+func parseIndex(contents string) ([]indexEntry, error) {
+	entries := []indexEntry{}
+
+	for lineNumber, line := range strings.Split(contents, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		entry, err := parseIndexLine(line)
+		if err != nil {
+			return nil, errors.WithStackTrace(InvalidIndexLine{LineNumber: lineNumber + 1, Line: line, Err: err})
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func parseIndexLine(line string) (indexEntry, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 6 {
+		return indexEntry{}, fmt.Errorf("expected 6 tab separated fields but found %d", len(fields))
+	}
+
+	expirationDate, err := parseIndexTime(fields[1])
+	if err != nil {
+		return indexEntry{}, err
+	}
+
+	entry := indexEntry{
+		Status:         fields[0],
+		ExpirationDate: expirationDate,
+		Serial:         fields[3],
+		Subject:        fields[5],
+		CommonName:     subjectField(fields[5], "CN"),
+	}
+
+	// The revocation field may carry a reason after the date, e.g. 180101000000Z,keyCompromise
+	if revocation := strings.Split(fields[2], ",")[0]; revocation != "" {
+		entry.RevocationDate, err = parseIndexTime(revocation)
+		if err != nil {
+			return indexEntry{}, err
+		}
+	}
+
+	return entry, nil
+}
+
+// OpenSSL writes UTCTime (YYMMDDHHMMSSZ) for dates before 2050 and GeneralizedTime (YYYYMMDDHHMMSSZ) after that
+func parseIndexTime(value string) (time.Time, error) {
+	if len(value) == len("20060102150405Z") {
+		return time.Parse("20060102150405Z", value)
+	}
+	return time.Parse("060102150405Z", value)
+}
+
+// Extract a single field (e.g. CN) from an OpenSSL one-line subject such as /C=US/ST=CA/CN=jane/emailAddress=jane@x.com
+func subjectField(subject string, name string) string {
+	for _, part := range strings.Split(subject, "/") {
+		keyAndValue := strings.SplitN(part, "=", 2)
+		if len(keyAndValue) == 2 && keyAndValue[0] == name {
+			return keyAndValue[1]
+		}
+	}
+	return ""
+}
+
+// Whether the index has a certificate for exactly the given common name that hasn't been revoked. Unlike IsValid, this
+// also counts certificates that have expired but not been marked as such, since the CA database still treats them as
+// valid.
+func hasValidCertificate(entries []indexEntry, commonName string) bool {
+	for _, entry := range entries {
+		if entry.Status == INDEX_STATUS_VALID && entry.CommonName == commonName {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the most recently issued index entry for the given common name, or nil if there is none
+func latestIndexEntryFor(entries []indexEntry, commonName string) *indexEntry {
+	var latest *indexEntry
+	for i := range entries {
+		if entries[i].CommonName == commonName {
+			latest = &entries[i]
+		}
+	}
+	return latest
+}
+
+// Custom errors
+
+type InvalidIndexLine struct {
+	LineNumber int
+	Line       string
+	Err        error
+}
+
+func (err InvalidIndexLine) Error() string {
+	return fmt.Sprintf("Unable to parse line %d of %s (%s): %v", err.LineNumber, INDEX_FILE_PATH, err.Line, err.Err)
+}
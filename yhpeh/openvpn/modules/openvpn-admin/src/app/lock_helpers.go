@@ -0,0 +1,318 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/urfave/cli"
+)
+
+// The name of the distributed lock taken around every operation that modifies the PKI
+const PKI_LOCK_NAME = "pki"
+
+// The name of the lease held by the server whose process-requests and process-revokes consume the queues
+const LEADER_LOCK_NAME = "leader"
+
+const LOCK_RETRY_INTERVAL = time.Second
+
+// How often a standby checks whether it has become the leader
+const LEADER_STANDBY_INTERVAL = 5 * time.Second
+
+// The file operations that modify the PKI lock on this server, so that they are serialized across processes (e.g.
+// process-requests, process-revokes and a backup run by cron)
+const PKI_LOCK_FILE_PATH = "/etc/openvpn-ca/.pki.lock"
+
+// Serializes operations that modify the PKI within this process, as the easy-rsa scripts are not safe to run
+// concurrently (e.g. when the web portal and the request queue both issue certificates at the same time). Other
+// processes on this server are kept out by a lock on PKI_LOCK_FILE_PATH, and other servers by pkiLease.
+var pkiLock sync.Mutex
+
+// If set (see configurePkiLease), operations that modify the PKI also take a lease in DynamoDB, so that they are
+// serialized across every OpenVPN server sharing the request queues
+var pkiLease *distributedLock
+
+// A lease-based lock stored in a DynamoDB table, shared between OpenVPN servers
+type distributedLock struct {
+	AwsClient     *aws_helpers.AwsClient
+	AwsRegion     string
+	TableName     string
+	Name          string
+	Owner         string
+	LeaseDuration time.Duration
+}
+
+// Return the named lock, or nil if no lock table was configured
+func getDistributedLock(cliContext *cli.Context, awsClient *aws_helpers.AwsClient, name string) (*distributedLock, error) {
+	tableName := cliContext.String(OPTION_LOCK_TABLE)
+	if tableName == "" {
+		return nil, nil
+	}
+
+	awsRegion, err := getAwsRegion(cliContext)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	return &distributedLock{
+		AwsClient:     awsClient,
+		AwsRegion:     awsRegion,
+		TableName:     tableName,
+		Name:          name,
+		Owner:         fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		LeaseDuration: cliContext.Duration(OPTION_LOCK_LEASE_DURATION),
+	}, nil
+}
+
+// Make operations that modify the PKI take the distributed PKI lock, if a lock table was configured
+func configurePkiLease(cliContext *cli.Context, awsClient *aws_helpers.AwsClient) error {
+	lock, err := getDistributedLock(cliContext, awsClient, PKI_LOCK_NAME)
+	if err != nil {
+		return err
+	}
+
+	if lock != nil {
+		logging.GetLogger(LOGGER_NAME).Infof("Using DynamoDB table %s to lock the PKI", lock.TableName)
+	}
+
+	pkiLease = lock
+	return nil
+}
+
+// The PKI lock, as held by this process. See lockPki.
+type heldPkiLock struct {
+	unlockLocally func()
+	// nil without a lock table
+	lease        *distributedLock
+	stopRenewing func()
+}
+
+// Take the lock for modifying the PKI: first on this server (see lockPkiLocally), then, if a lock table was
+// configured, the lease in DynamoDB, which is renewed in the background until the lock is released
+func lockPki() (*heldPkiLock, error) {
+	unlockLocally, err := lockPkiLocally()
+	if err != nil {
+		return nil, err
+	}
+
+	if pkiLease == nil {
+		return &heldPkiLock{unlockLocally: unlockLocally}, nil
+	}
+
+	if err := pkiLease.AcquireWithin(pkiLease.LeaseDuration); err != nil {
+		unlockLocally()
+		return nil, err
+	}
+
+	return &heldPkiLock{unlockLocally: unlockLocally, lease: pkiLease, stopRenewing: pkiLease.RenewUntilStopped()}, nil
+}
+
+// Take the PKI lock of this process and then the lock file shared with the other processes on this server, and
+// return a function that releases both
+func lockPkiLocally() (func(), error) {
+	pkiLock.Lock()
+
+	file, err := os.OpenFile(PKI_LOCK_FILE_PATH, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		pkiLock.Unlock()
+		return nil, errors.WithStackTrace(err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		pkiLock.Unlock()
+		return nil, errors.WithStackTrace(err)
+	}
+
+	// Closing the file releases the lock
+	return func() {
+		file.Close()
+		pkiLock.Unlock()
+	}, nil
+}
+
+// Make sure the lock is still held, right before storing a change made under it. This extends the lease by a full
+// lease duration, so it can't expire while the change is being stored. The conditional write of the PKI storage
+// catches anything that slips through, e.g. a server whose clock is off by more than the lease duration.
+func (lock *heldPkiLock) Check() error {
+	if lock.lease == nil {
+		return nil
+	}
+
+	acquired, err := lock.lease.TryAcquire()
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return errors.WithStackTrace(LockLost(lock.lease.Name))
+	}
+	return nil
+}
+
+func (lock *heldPkiLock) Unlock() {
+	if lock.lease != nil {
+		lock.stopRenewing()
+		lock.lease.Release()
+	}
+	lock.unlockLocally()
+}
+
+// Try to take or extend the lease once
+func (lock *distributedLock) TryAcquire() (bool, error) {
+	return lock.AwsClient.AcquireLease(lock.AwsRegion, lock.TableName, lock.Name, lock.Owner, lock.LeaseDuration)
+}
+
+// Keep trying to take the lease until the timeout passes
+func (lock *distributedLock) AcquireWithin(timeout time.Duration) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+	deadline := time.Now().Add(timeout)
+
+	for {
+		acquired, err := lock.TryAcquire()
+		if err != nil {
+			return err
+		}
+		if acquired {
+			logger.Debugf("Acquired lock %s", lock.Name)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.WithStackTrace(LockNotAcquired{Name: lock.Name, Timeout: timeout})
+		}
+
+		logger.Debugf("Lock %s is held by another server. Retrying in %s.", lock.Name, LOCK_RETRY_INTERVAL)
+		time.Sleep(LOCK_RETRY_INTERVAL)
+	}
+}
+
+// Renew the lease every LeaseDuration/3 in the background, the way leaderElection.run does, until the returned function
+// is called. A failed renewal is only logged; heldPkiLock.Check finds out whether the lease was lost.
+func (lock *distributedLock) RenewUntilStopped() func() {
+	logger := logging.GetLogger(LOGGER_NAME)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(lock.LeaseDuration / 3):
+			}
+
+			acquired, err := lock.TryAcquire()
+			if err != nil {
+				logger.Errorf("Unable to renew lease on %s: %s", lock.Name, err.Error())
+			} else if !acquired {
+				logger.Errorf("Lost lease on %s to another server", lock.Name)
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// Release the lease. A failure is only logged, as the lease expires on its own anyway.
+func (lock *distributedLock) Release() {
+	if err := lock.AwsClient.ReleaseLease(lock.AwsRegion, lock.TableName, lock.Name, lock.Owner); err != nil {
+		logging.GetLogger(LOGGER_NAME).Warnf("Unable to release lock %s, it will expire in %s: %s", lock.Name, lock.LeaseDuration, err.Error())
+	}
+}
+
+// Tracks whether this server holds the leader lease. The lease is renewed in the background, so a standby takes over
+// within one lease duration of the leader going away.
+type leaderElection struct {
+	lock     *distributedLock
+	isLeader int32
+}
+
+// Start competing for the leader lease if --leader-only is set. Returns nil otherwise, in which case this server always
+// consumes requests. There is a single lease for both request processing loops, held in the name of the server rather
+// than the process, so that one server both issues and revokes certificates while the others stand by. A standby
+// serves the PKI from where the leader left it, so this requires the PKI to be kept in S3.
+func startLeaderElection(cliContext *cli.Context, awsClient *aws_helpers.AwsClient) (*leaderElection, error) {
+	if !cliContext.Bool(OPTION_LEADER_ONLY) {
+		return nil, nil
+	}
+
+	location := cliContext.String(OPTION_PKI_STORAGE)
+	if location == "" || location == PKI_STORAGE_LOCAL {
+		return nil, errors.WithStackTrace(LeaderOnlyWithLocalPki)
+	}
+
+	lock, err := getDistributedLock(cliContext, awsClient, LEADER_LOCK_NAME)
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		return nil, errors.WithStackTrace(MissingLockTable)
+	}
+
+	lock.Owner, err = os.Hostname()
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	election := &leaderElection{lock: lock}
+	go election.run()
+	return election, nil
+}
+
+func (election *leaderElection) IsLeader() bool {
+	return atomic.LoadInt32(&election.isLeader) == 1
+}
+
+func (election *leaderElection) run() {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	for {
+		acquired, err := election.lock.TryAcquire()
+		if err != nil {
+			logger.Errorf("Unable to renew lease on %s: %s", election.lock.Name, err.Error())
+			acquired = false
+		}
+
+		wasLeader := election.IsLeader()
+		if acquired && !wasLeader {
+			logger.Infof("Became leader (%s). Processing requests.", election.lock.Name)
+			atomic.StoreInt32(&election.isLeader, 1)
+		} else if !acquired && wasLeader {
+			logger.Warnf("Lost leadership (%s). Standing by.", election.lock.Name)
+			atomic.StoreInt32(&election.isLeader, 0)
+		}
+
+		time.Sleep(election.lock.LeaseDuration / 3)
+	}
+}
+
+// Custom errors
+
+type LockNotAcquired struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func (err LockNotAcquired) Error() string {
+	return fmt.Sprintf("Unable to acquire lock %s within %s. Another OpenVPN server is holding it.", err.Name, err.Timeout)
+}
+
+type LockLost string
+
+func (err LockLost) Error() string {
+	return fmt.Sprintf("Lost lock %s to another OpenVPN server before the change could be stored. Retry it.", string(err))
+}
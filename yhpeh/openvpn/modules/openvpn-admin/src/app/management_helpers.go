@@ -0,0 +1,180 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/files"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/urfave/cli"
+)
+
+const MANAGEMENT_TIMEOUT = 10 * time.Second
+
+// The OpenVPN management interface revoked users are disconnected through, if --management-address is set. See
+// configureSessionTermination.
+var managementAddress = ""
+var managementPasswordFile = ""
+
+// Set up disconnecting revoked users from --management-address and --management-password-file
+func configureSessionTermination(cliContext *cli.Context) {
+	managementAddress = cliContext.String(OPTION_MANAGEMENT_ADDRESS)
+	managementPasswordFile = cliContext.String(OPTION_MANAGEMENT_PASSWORD_FILE)
+}
+
+// A connection to the OpenVPN management interface. See https://openvpn.net/community-resources/management-interface/
+type managementClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Connect to the OpenVPN management interface at the given address, which is either host:port or unix:<path> for a
+// unix socket. If passwordFile is not empty, its first line is sent as the management password.
+func dialManagementInterface(address string, passwordFile string) (*managementClient, error) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network = "unix"
+		address = strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+	}
+
+	logger.Debugf("Connecting to OpenVPN management interface at %s (%s)", address, network)
+	conn, err := net.DialTimeout(network, address, MANAGEMENT_TIMEOUT)
+	if err != nil {
+		return nil, errors.WithStackTraceAndPrefix(err, "Unable to connect to the OpenVPN management interface")
+	}
+
+	client := &managementClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	if passwordFile != "" {
+		password, err := files.ReadFileAsString(passwordFile)
+		if err != nil {
+			client.Close()
+			return nil, errors.WithStackTrace(err)
+		}
+
+		if _, err := client.send(strings.SplitN(password, "\n", 2)[0]); err != nil {
+			client.Close()
+			return nil, errors.WithStackTrace(ManagementCommandFailed{Command: "password", Response: errors.Unwrap(err).Error()})
+		}
+	}
+
+	return client, nil
+}
+
+func (client *managementClient) Close() error {
+	return client.conn.Close()
+}
+
+// Send a command and return the lines of its response
+func (client *managementClient) command(command string) ([]string, error) {
+	lines, err := client.send(command)
+	if err != nil {
+		return nil, errors.WithStackTrace(ManagementCommandFailed{Command: strings.Fields(command)[0], Response: errors.Unwrap(err).Error()})
+	}
+	return lines, nil
+}
+
+// Send a line and read the response. Single line responses start with SUCCESS: or ERROR:, while multi-line responses
+// (e.g. status) are terminated by END. Real-time notifications, which start with >, are skipped.
+func (client *managementClient) send(input string) ([]string, error) {
+	client.conn.SetDeadline(time.Now().Add(MANAGEMENT_TIMEOUT))
+
+	if _, err := fmt.Fprintf(client.conn, "%s\n", input); err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	lines := []string{}
+	for {
+		line, err := client.reader.ReadString('\n')
+		if err != nil {
+			return nil, errors.WithStackTrace(err)
+		}
+		// The password prompt is not terminated by a newline, so it ends up in front of the reply to the password
+		line = strings.TrimPrefix(strings.TrimRight(line, "\r\n"), "ENTER PASSWORD:")
+
+		switch {
+		case line == "", strings.HasPrefix(line, ">"):
+			continue
+		case strings.HasPrefix(line, "ERROR:"):
+			return nil, errors.WithStackTrace(fmt.Errorf("%s", line))
+		case strings.HasPrefix(line, "SUCCESS:"):
+			return append(lines, line), nil
+		case line == "END":
+			return lines, nil
+		default:
+			lines = append(lines, line)
+		}
+	}
+}
+
+var killedClientsPattern = regexp.MustCompile(`(\d+) client\(s\) killed`)
+
+// Disconnect the active sessions of the given common names, whose certificates have just been revoked, so they can't
+// keep using their tunnel, and return how many sessions were terminated. This is a no-op if the management interface
+// is not configured. The certificates are already revoked at this point, so failing to disconnect is logged but not
+// treated as an error.
+func disconnectRevokedClients(commonNames ...string) int {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	if managementAddress == "" {
+		return 0
+	}
+
+	totalSessionsTerminated := 0
+	for _, commonName := range commonNames {
+		sessionsTerminated, err := killClientSessions(managementAddress, managementPasswordFile, commonName)
+		if err != nil {
+			logger.Warnf("Revoked certificate for %s but was unable to disconnect their active sessions: %s", commonName, err.Error())
+			continue
+		}
+
+		logger.Infof("Terminated %d active sessions for %s", sessionsTerminated, commonName)
+		totalSessionsTerminated += sessionsTerminated
+	}
+
+	return totalSessionsTerminated
+}
+
+// Disconnect every active session of the given common name and return how many were terminated
+func killClientSessions(address string, passwordFile string, commonName string) (int, error) {
+	client, err := dialManagementInterface(address, passwordFile)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	response, err := client.command(fmt.Sprintf("kill %s", commonName))
+	if err != nil {
+		// The management interface reports an error when the common name has no active sessions
+		if strings.Contains(err.Error(), "not found") {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	matches := killedClientsPattern.FindStringSubmatch(strings.Join(response, "\n"))
+	if matches == nil {
+		return 0, nil
+	}
+
+	return strconv.Atoi(matches[1])
+}
+
+// Custom errors
+
+type ManagementCommandFailed struct {
+	Command  string
+	Response string
+}
+
+func (err ManagementCommandFailed) Error() string {
+	return fmt.Sprintf("OpenVPN management command %s failed: %s", err.Command, err.Response)
+}
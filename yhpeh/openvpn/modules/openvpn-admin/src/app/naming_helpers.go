@@ -0,0 +1,115 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+)
+
+// The upper bound X.509 sets on the length of a common name
+const USERNAME_MAX_LENGTH = 64
+
+// Usernames become the CN of a certificate, the names of files in /etc/openvpn and arguments to the easy-rsa wrapper
+// scripts. Starting with a letter or digit rules out option injection (-foo) and hidden or relative paths (., ..), and
+// the character set rules out path separators, whitespace and shell metacharacters.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]*$`)
+
+// Names that would clash with the server's own certificate and files in /etc/openvpn (e.g. a user called ca would
+// overwrite ca.crt). These are compared case-insensitively.
+var RESERVED_USERNAMES = append([]string{"ca", "ta", "dh", "crl", "index", "serial"}, SERVER_COMMON_NAMES...)
+
+// Check the given username against the naming policy. Usernames are normalized with the username rules (see
+// mapUsername) before they get here, so this only rejects, and never changes, a name. The client checks names before
+// sending a request and the server checks them again before any PKI operation.
+func checkUsername(username string) error {
+	switch {
+	case username == "":
+		return errors.WithStackTrace(MissingUsername)
+	case len(username) > USERNAME_MAX_LENGTH:
+		return errors.WithStackTrace(InvalidUsername{Username: username, Reason: fmt.Sprintf("it is longer than %d characters", USERNAME_MAX_LENGTH)})
+	case !usernamePattern.MatchString(username):
+		return errors.WithStackTrace(InvalidUsername{Username: username, Reason: "it must start with a letter or digit and may only contain letters, digits and . _ @ -"})
+	}
+
+	for _, reserved := range RESERVED_USERNAMES {
+		if strings.EqualFold(username, reserved) {
+			return errors.WithStackTrace(InvalidUsername{Username: username, Reason: "it is reserved for the OpenVPN server"})
+		}
+	}
+
+	return nil
+}
+
+// Check the common name of a certificate, i.e. a username optionally followed by a device (see client.CertificateName),
+// against the naming policy
+func checkCommonName(commonName string) error {
+	username, device := client.SplitCertificateName(commonName)
+
+	if err := checkUsername(username); err != nil {
+		return err
+	}
+	if strings.Contains(commonName, client.DEVICE_SEPARATOR) {
+		if err := checkDevice(device); err != nil {
+			return err
+		}
+	}
+	if len(commonName) > USERNAME_MAX_LENGTH {
+		return errors.WithStackTrace(InvalidUsername{Username: commonName, Reason: fmt.Sprintf("together with the device, it is longer than %d characters", USERNAME_MAX_LENGTH)})
+	}
+
+	return nil
+}
+
+// Make sure no certificate in the index belongs to a username that differs from the one in the given common name only
+// in case, e.g. Jane and jane. Such names would be told apart by OpenVPN but not by the people reading a report or the
+// history, so the first one issued wins.
+func checkUsernameCollision(entries []indexEntry, commonName string) error {
+	username, _ := client.SplitCertificateName(commonName)
+
+	for _, entry := range entries {
+		existing, _ := client.SplitCertificateName(entry.CommonName)
+		if existing != username && strings.EqualFold(existing, username) {
+			return errors.WithStackTrace(UsernameCollision{Username: username, Existing: existing})
+		}
+	}
+	return nil
+}
+
+// Return the path of the file with the given extension (e.g. .crt) of the certificate with the given common name in
+// /etc/openvpn, making sure it can't point anywhere else
+func userPkiPath(commonName string, extension string) (string, error) {
+	if err := checkCommonName(commonName); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(OPENVPN_PATH, commonName+extension)
+	if filepath.Dir(path) != filepath.Clean(OPENVPN_PATH) {
+		return "", errors.WithStackTrace(InvalidUsername{Username: commonName, Reason: "it is not a plain file name"})
+	}
+
+	return path, nil
+}
+
+// Custom errors
+
+type InvalidUsername struct {
+	Username string
+	Reason   string
+}
+
+func (err InvalidUsername) Error() string {
+	return fmt.Sprintf("%q is not a valid username: %s", err.Username, err.Reason)
+}
+
+type UsernameCollision struct {
+	Username string
+	Existing string
+}
+
+func (err UsernameCollision) Error() string {
+	return fmt.Sprintf("%q is too similar to %q, which has been issued a certificate before. Usernames may not differ only in case.", err.Username, err.Existing)
+}
@@ -0,0 +1,242 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/files"
+)
+
+// The header in which an Application Load Balancer with OIDC authentication enabled passes the signed user claims
+const ALB_OIDC_DATA_HEADER = "x-amzn-oidc-data"
+
+// Where the ALB publishes the public keys it signs x-amzn-oidc-data with, by region and key ID
+const ALB_PUBLIC_KEY_URL_FORMAT = "https://public-keys.auth.elb.%s.amazonaws.com/%s"
+
+const ALB_PUBLIC_KEY_FETCH_TIMEOUT = 10 * time.Second
+
+// The ALB's key IDs are UUIDs. Anything else is rejected before it ends up in a URL.
+var albKeyIdPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// The JWT header the ALB adds to x-amzn-oidc-data. See:
+// https://docs.aws.amazon.com/elasticloadbalancing/latest/application/listener-authenticate-users.html#user-claims-encoding
+type albJwtHeader struct {
+	Alg    string `json:"alg"`
+	Kid    string `json:"kid"`
+	Signer string `json:"signer"`
+	Iss    string `json:"iss"`
+	Exp    int64  `json:"exp"`
+}
+
+// The public keys x-amzn-oidc-data tokens are verified with, looked up by the kid in the token's header. The ALB
+// rotates its signing keys, so keys are fetched as tokens signed with them come in, and kept for the lifetime of the
+// process. If Pinned is set, it is the only key accepted, whatever the kid.
+type albPublicKeys struct {
+	Pinned *ecdsa.PublicKey
+	// Download the PEM encoded key with the given ID. Returns UnknownOidcKeyId if there is no such key.
+	Fetch func(kid string) ([]byte, error)
+
+	mutex sync.Mutex
+	keys  map[string]*ecdsa.PublicKey
+}
+
+// The public keys of the ALBs in the given region
+func newAlbPublicKeys(awsRegion string) *albPublicKeys {
+	return &albPublicKeys{Fetch: func(kid string) ([]byte, error) { return fetchAlbPublicKey(awsRegion, kid) }}
+}
+
+// Return the key with the given ID, fetching it on first use
+func (keys *albPublicKeys) Get(kid string) (*ecdsa.PublicKey, error) {
+	if keys.Pinned != nil {
+		return keys.Pinned, nil
+	}
+
+	if !albKeyIdPattern.MatchString(kid) {
+		return nil, errors.WithStackTrace(UnknownOidcKeyId(kid))
+	}
+
+	keys.mutex.Lock()
+	defer keys.mutex.Unlock()
+
+	if key, exists := keys.keys[kid]; exists {
+		return key, nil
+	}
+
+	contents, err := keys.Fetch(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseEcdsaPublicKey(kid, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys.keys == nil {
+		keys.keys = map[string]*ecdsa.PublicKey{}
+	}
+	keys.keys[kid] = key
+	return key, nil
+}
+
+// Download the PEM encoded public key with the given ID from the ALB's public key endpoint for the region
+func fetchAlbPublicKey(awsRegion string, kid string) ([]byte, error) {
+	url := fmt.Sprintf(ALB_PUBLIC_KEY_URL_FORMAT, awsRegion, kid)
+
+	httpClient := http.Client{Timeout: ALB_PUBLIC_KEY_FETCH_TIMEOUT}
+	response, err := httpClient.Get(url)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+	defer response.Body.Close()
+
+	// The endpoint answers 403 or 404 for keys it doesn't have
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusForbidden {
+		return nil, errors.WithStackTrace(UnknownOidcKeyId(kid))
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.WithStackTrace(fmt.Errorf("Unable to fetch %s: %s", url, response.Status))
+	}
+
+	contents, err := ioutil.ReadAll(response.Body)
+	return contents, errors.WithStackTrace(err)
+}
+
+// Read an ECDSA public key from a PEM file, such as one the ALB publishes at ALB_PUBLIC_KEY_URL_FORMAT
+func readEcdsaPublicKey(path string) (*ecdsa.PublicKey, error) {
+	contents, err := files.ReadFileAsString(path)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	return parseEcdsaPublicKey(path, []byte(contents))
+}
+
+// Parse a PEM encoded ECDSA public key. source says where it came from, for errors.
+func parseEcdsaPublicKey(source string, contents []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.WithStackTrace(InvalidOidcPublicKey{Path: source, Reason: "no PEM block found"})
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.WithStackTrace(InvalidOidcPublicKey{Path: source, Reason: err.Error()})
+	}
+
+	ecdsaKey, isEcdsa := key.(*ecdsa.PublicKey)
+	if !isEcdsa {
+		return nil, errors.WithStackTrace(InvalidOidcPublicKey{Path: source, Reason: "not an ECDSA public key"})
+	}
+
+	return ecdsaKey, nil
+}
+
+// Verify the signature and expiration of the JWT in the x-amzn-oidc-data header, with the key given by its kid, and
+// return its claims. If albArn is not empty, the token must also have been signed by that load balancer, and if issuer
+// is not empty, it must have been issued by that identity provider.
+func verifyAlbOidcData(token string, keys *albPublicKeys, albArn string, issuer string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.WithStackTrace(InvalidOidcToken("expected three dot separated segments"))
+	}
+
+	headerBytes, err := decodeJwtSegment(parts[0])
+	if err != nil {
+		return nil, errors.WithStackTrace(InvalidOidcToken("malformed header"))
+	}
+
+	header := albJwtHeader{}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, errors.WithStackTrace(InvalidOidcToken("malformed header"))
+	}
+
+	if header.Alg != "ES256" {
+		return nil, errors.WithStackTrace(InvalidOidcToken(fmt.Sprintf("unsupported algorithm %s", header.Alg)))
+	}
+
+	if albArn != "" && header.Signer != albArn {
+		return nil, errors.WithStackTrace(InvalidOidcToken(fmt.Sprintf("signed by unexpected load balancer %s", header.Signer)))
+	}
+
+	if issuer != "" && header.Iss != issuer {
+		return nil, errors.WithStackTrace(InvalidOidcToken(fmt.Sprintf("issued by unexpected identity provider %s", header.Iss)))
+	}
+
+	publicKey, err := keys.Get(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := decodeJwtSegment(parts[2])
+	if err != nil || len(signature) != 64 {
+		return nil, errors.WithStackTrace(InvalidOidcToken("malformed signature"))
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(publicKey, digest[:], r, s) {
+		return nil, errors.WithStackTrace(InvalidOidcToken("signature verification failed"))
+	}
+
+	if header.Exp == 0 {
+		return nil, errors.WithStackTrace(InvalidOidcToken("token has no expiry"))
+	}
+	if time.Now().After(time.Unix(header.Exp, 0)) {
+		return nil, errors.WithStackTrace(InvalidOidcToken("token has expired"))
+	}
+
+	payloadBytes, err := decodeJwtSegment(parts[1])
+	if err != nil {
+		return nil, errors.WithStackTrace(InvalidOidcToken("malformed payload"))
+	}
+
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+		return nil, errors.WithStackTrace(InvalidOidcToken("malformed payload"))
+	}
+
+	return claims, nil
+}
+
+// The ALB encodes JWT segments as base64url but, unlike most JWT issuers, may include padding
+func decodeJwtSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// Custom errors
+
+type InvalidOidcToken string
+
+func (err InvalidOidcToken) Error() string {
+	return fmt.Sprintf("Invalid %s token: %s", ALB_OIDC_DATA_HEADER, string(err))
+}
+
+type UnknownOidcKeyId string
+
+func (err UnknownOidcKeyId) Error() string {
+	return fmt.Sprintf("Invalid %s token: signed with unknown key %q", ALB_OIDC_DATA_HEADER, string(err))
+}
+
+type InvalidOidcPublicKey struct {
+	Path   string
+	Reason string
+}
+
+func (err InvalidOidcPublicKey) Error() string {
+	return fmt.Sprintf("Unable to load OIDC public key from %s: %s", err.Path, err.Reason)
+}
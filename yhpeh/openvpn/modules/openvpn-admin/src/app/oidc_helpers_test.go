@@ -0,0 +1,231 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+)
+
+const testKid = "a1b2c3d4-0000-1111-2222-333344445555"
+const testAlbArn = "arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/vpn-portal/abc123"
+const testIssuer = "https://idp.example.com"
+
+func generateTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encodeTestPublicKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// Keys that only know testKid, and count how often they were fetched
+func newTestKeys(t *testing.T, key *ecdsa.PrivateKey, fetches *int) *albPublicKeys {
+	return &albPublicKeys{Fetch: func(kid string) ([]byte, error) {
+		*fetches++
+		if kid != testKid {
+			return nil, errors.WithStackTrace(UnknownOidcKeyId(kid))
+		}
+		return encodeTestPublicKey(t, key), nil
+	}}
+}
+
+func testHeader() map[string]interface{} {
+	return map[string]interface{}{
+		"alg":    "ES256",
+		"kid":    testKid,
+		"signer": testAlbArn,
+		"iss":    testIssuer,
+		"exp":    time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+// Sign a token the way the ALB does, with padded base64url segments
+func signTestToken(t *testing.T, key *ecdsa.PrivateKey, header map[string]interface{}, claims map[string]interface{}) string {
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.URLEncoding.EncodeToString(headerJson) + "." + base64.URLEncoding.EncodeToString(claimsJson)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.URLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyAlbOidcDataAcceptsValidToken(t *testing.T) {
+	key := generateTestKey(t)
+	fetches := 0
+	keys := newTestKeys(t, key, &fetches)
+	token := signTestToken(t, key, testHeader(), map[string]interface{}{"email": "alice@corp.com"})
+
+	for i := 0; i < 2; i++ {
+		claims, err := verifyAlbOidcData(token, keys, testAlbArn, testIssuer)
+		if err != nil {
+			t.Fatalf("Expected the token to verify, got %s", err.Error())
+		}
+		if claims["email"] != "alice@corp.com" {
+			t.Fatalf("Expected email claim alice@corp.com, got %v", claims["email"])
+		}
+	}
+
+	if fetches != 1 {
+		t.Fatalf("Expected the key to be fetched once and then cached, got %d fetches", fetches)
+	}
+}
+
+func TestVerifyAlbOidcDataRejectsInvalidTokens(t *testing.T) {
+	key := generateTestKey(t)
+	otherKey := generateTestKey(t)
+	claims := map[string]interface{}{"email": "alice@corp.com"}
+
+	withHeader := func(name string, value interface{}) map[string]interface{} {
+		header := testHeader()
+		if value == nil {
+			delete(header, name)
+		} else {
+			header[name] = value
+		}
+		return header
+	}
+
+	// Swap in the claims of another user, keeping the original signature
+	valid := strings.Split(signTestToken(t, key, testHeader(), claims), ".")
+	forged := strings.Split(signTestToken(t, key, testHeader(), map[string]interface{}{"email": "mallory@corp.com"}), ".")
+	tampered := strings.Join([]string{valid[0], forged[1], valid[2]}, ".")
+
+	testCases := []struct {
+		name  string
+		token string
+	}{
+		{"malformed", "not-a-token"},
+		{"tampered signature", tampered},
+		{"signed with another key", signTestToken(t, otherKey, testHeader(), claims)},
+		{"unsupported algorithm", signTestToken(t, key, withHeader("alg", "HS256"), claims)},
+		{"unknown kid", signTestToken(t, key, withHeader("kid", "ffffffff-0000-1111-2222-333344445555"), claims)},
+		{"kid that is not a key ID", signTestToken(t, key, withHeader("kid", "../../evil"), claims)},
+		{"no expiry", signTestToken(t, key, withHeader("exp", nil), claims)},
+		{"expired", signTestToken(t, key, withHeader("exp", time.Now().Add(-time.Minute).Unix()), claims)},
+		{"other load balancer", signTestToken(t, key, withHeader("signer", "arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/other/def456"), claims)},
+		{"other issuer", signTestToken(t, key, withHeader("iss", "https://evil.example.com"), claims)},
+		{"no issuer", signTestToken(t, key, withHeader("iss", nil), claims)},
+	}
+
+	for _, testCase := range testCases {
+		fetches := 0
+		keys := newTestKeys(t, key, &fetches)
+		if _, err := verifyAlbOidcData(testCase.token, keys, testAlbArn, testIssuer); err == nil {
+			t.Errorf("%s: expected the token to be rejected", testCase.name)
+		}
+	}
+}
+
+func TestVerifyAlbOidcDataWithPinnedKey(t *testing.T) {
+	key := generateTestKey(t)
+	keys := &albPublicKeys{Pinned: &key.PublicKey, Fetch: func(kid string) ([]byte, error) {
+		t.Fatalf("Expected no key to be fetched, but %s was", kid)
+		return nil, nil
+	}}
+
+	token := signTestToken(t, key, testHeader(), map[string]interface{}{"email": "alice@corp.com"})
+	if _, err := verifyAlbOidcData(token, keys, "", ""); err != nil {
+		t.Fatalf("Expected the token to verify, got %s", err.Error())
+	}
+
+	otherToken := signTestToken(t, generateTestKey(t), testHeader(), map[string]interface{}{"email": "alice@corp.com"})
+	if _, err := verifyAlbOidcData(otherToken, keys, "", ""); err == nil {
+		t.Fatal("Expected a token signed with another key to be rejected")
+	}
+}
+
+func TestIsAllowedDomain(t *testing.T) {
+	portal := &webPortal{AllowedDomains: []string{"corp.com", "subsidiary.com"}}
+
+	testCases := []struct {
+		claim   string
+		allowed bool
+	}{
+		{"alice@corp.com", true},
+		{"bob@Subsidiary.COM", true},
+		{"alice@contractor.com", false},
+		{"alice@corp.com.evil.com", false},
+		{"alice@evil.com@corp.co", false},
+		{"alice", false},
+	}
+
+	for _, testCase := range testCases {
+		if allowed := portal.isAllowedDomain(testCase.claim); allowed != testCase.allowed {
+			t.Errorf("isAllowedDomain(%s) = %t, expected %t", testCase.claim, allowed, testCase.allowed)
+		}
+	}
+}
+
+func TestPortalRejectsTokens(t *testing.T) {
+	key := generateTestKey(t)
+	fetches := 0
+	portal := &webPortal{
+		PublicKeys:     newTestKeys(t, key, &fetches),
+		AlbArn:         testAlbArn,
+		Issuer:         testIssuer,
+		UsernameClaim:  "email",
+		AllowedDomains: []string{"corp.com"},
+	}
+
+	handler := portal.authenticated(func(writer http.ResponseWriter, request *http.Request, username string) {
+		t.Fatalf("Expected the request of %s to be rejected", username)
+	})
+
+	testCases := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"expired token", signTestToken(t, key, map[string]interface{}{"alg": "ES256", "kid": testKid, "signer": testAlbArn, "iss": testIssuer, "exp": time.Now().Add(-time.Minute).Unix()}, map[string]interface{}{"email": "alice@corp.com"}), http.StatusUnauthorized},
+		{"no username claim", signTestToken(t, key, testHeader(), map[string]interface{}{"sub": "1234"}), http.StatusUnauthorized},
+		{"other domain", signTestToken(t, key, testHeader(), map[string]interface{}{"email": "alice@contractor.com"}), http.StatusForbidden},
+	}
+
+	for _, testCase := range testCases {
+		request := httptest.NewRequest("GET", "/", nil)
+		if testCase.token != "" {
+			request.Header.Set(ALB_OIDC_DATA_HEADER, testCase.token)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != testCase.status {
+			t.Errorf("%s: expected status %d, got %d", testCase.name, testCase.status, recorder.Code)
+		}
+	}
+}
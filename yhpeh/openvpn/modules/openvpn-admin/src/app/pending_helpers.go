@@ -0,0 +1,432 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/server"
+	"github.com/urfave/cli"
+)
+
+const DEFAULT_PENDING_DIR = "/var/lib/openvpn-admin/pending"
+
+// The file in the pending directory that decisions are serialized with. See pendingStore.lock.
+const PENDING_LOCK_FILE = ".lock"
+
+// How often the process-requests daemon looks for requests that have been approved or denied
+const DECISION_CHECK_INTERVAL = 5 * time.Second
+
+const DECISION_APPROVED = "approved"
+const DECISION_DENIED = "denied"
+
+// A certificate request waiting for an administrator to approve or deny it. Decision is empty until approve or deny
+// records one, after which the process-requests daemon carries it out, stores the result under the request ID and
+// removes the request. Renew is set for renewals through the web portal. IssuedAt is set once the certificate of an
+// approved request has been issued, so that a retry after a failed result write sends that certificate again rather
+// than issuing another one.
+type pendingRequest struct {
+	Request     client.CertificateRequest
+	CommonName  string
+	Renew       bool `json:",omitempty"`
+	SubmittedAt time.Time
+
+	Decision  string     `json:",omitempty"`
+	DecidedBy string     `json:",omitempty"`
+	DecidedAt *time.Time `json:",omitempty"`
+	Reason    string     `json:",omitempty"`
+
+	IssuedAt *time.Time `json:",omitempty"`
+}
+
+// Keeps the requests waiting for approval in a directory on the OpenVPN server, one file per request, so that they
+// survive restarts of the daemon
+type pendingStore struct {
+	Dir string
+}
+
+// The store of requests waiting for approval if --require-approval is set, or nil if certificates are issued right
+// away. See configureApprovals.
+var approvals *pendingStore
+
+// Set up the approval workflow given by --require-approval and --pending-dir. Requests wait in a directory on the
+// server that received them, which a standby taking over wouldn't see, so this can't be combined with --leader-only.
+func configureApprovals(cliContext *cli.Context) error {
+	if !cliContext.Bool(OPTION_REQUIRE_APPROVAL) {
+		approvals = nil
+		return nil
+	}
+
+	if cliContext.Bool(OPTION_LEADER_ONLY) {
+		return errors.WithStackTrace(RequireApprovalWithLeaderOnly)
+	}
+
+	approvals = &pendingStore{Dir: cliContext.String(OPTION_PENDING_DIR)}
+	logging.GetLogger(LOGGER_NAME).Infof("New certificates need approval. Requests wait in %s.", approvals.Dir)
+	return nil
+}
+
+func (store pendingStore) path(requestId string) string {
+	return filepath.Join(store.Dir, requestId+".json")
+}
+
+func (store pendingStore) Save(request pendingRequest) error {
+	if !requestIdPattern.MatchString(request.Request.RequestId) {
+		return errors.WithStackTrace(InvalidRequestId(request.Request.RequestId))
+	}
+
+	contents, err := json.Marshal(request)
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	return replaceFile(store.path(request.Request.RequestId), contents, 0600)
+}
+
+// Return the given request, or nil if it isn't waiting for approval (any more)
+func (store pendingStore) Load(requestId string) (*pendingRequest, error) {
+	if !requestIdPattern.MatchString(requestId) {
+		return nil, errors.WithStackTrace(InvalidRequestId(requestId))
+	}
+
+	contents, err := ioutil.ReadFile(store.path(requestId))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	request := pendingRequest{}
+	if err := json.Unmarshal(contents, &request); err != nil {
+		return nil, errors.WithStackTraceAndPrefix(err, "Unable to parse %s", store.path(requestId))
+	}
+
+	return &request, nil
+}
+
+// Return all requests waiting for approval, oldest first
+func (store pendingStore) List() ([]pendingRequest, error) {
+	files, err := ioutil.ReadDir(store.Dir)
+	if os.IsNotExist(err) {
+		return []pendingRequest{}, nil
+	}
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	requests := []pendingRequest{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		request, err := store.Load(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if request != nil {
+			requests = append(requests, *request)
+		}
+	}
+
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].SubmittedAt.Before(requests[j].SubmittedAt) })
+	return requests, nil
+}
+
+// Return the undecided request for the given common name, or nil if there is none
+func (store pendingStore) FindUndecided(commonName string) (*pendingRequest, error) {
+	requests, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range requests {
+		if requests[i].CommonName == commonName && requests[i].Decision == "" {
+			return &requests[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Take an exclusive lock on the pending directory and return a function that releases it. The lock is shared between
+// the approve and deny commands and the process-requests daemon, and released by the system if its holder dies.
+// Recording a decision and removing a request that has been carried out happen under it, so that two decisions on the
+// same request can't both succeed, and a decision can't bring back a request that has already been carried out.
+func (store pendingStore) lock() (func(), error) {
+	if err := os.MkdirAll(store.Dir, 0770); err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(store.Dir, PENDING_LOCK_FILE), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, errors.WithStackTrace(err)
+	}
+
+	// Closing the file releases the lock
+	return func() { file.Close() }, nil
+}
+
+func (store pendingStore) Delete(requestId string) error {
+	err := os.Remove(store.path(requestId))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStackTrace(err)
+	}
+	return nil
+}
+
+// Park the given request until an administrator approves or denies it, and return the response that tells the
+// requester so. Requests that would be refused anyway (e.g. for an invalid name) are refused right away. Requests made
+// without --no-wait don't carry a request ID, so they get one here, which the requester can fetch the result with.
+func (store pendingStore) Park(request client.CertificateRequest, commonName string) client.CertificateResponse {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	if err := checkCommonName(commonName); err != nil {
+		return client.CertificateResponse{RequestId: request.RequestId, Username: commonName, ErrorMessage: err.Error()}
+	}
+	if _, err := request.Validity(); err != nil {
+		return client.CertificateResponse{RequestId: request.RequestId, Username: commonName, ErrorMessage: err.Error()}
+	}
+
+	if request.RequestId == "" {
+		requestId, err := client.NewRequestId()
+		if err != nil {
+			return client.CertificateResponse{Username: commonName, ErrorMessage: err.Error()}
+		}
+		request.RequestId = requestId
+	}
+
+	// SQS may deliver a request more than once
+	existing, err := store.Load(request.RequestId)
+	if err != nil {
+		return client.CertificateResponse{RequestId: request.RequestId, Username: commonName, ErrorMessage: err.Error()}
+	}
+
+	if existing == nil {
+		err := store.Save(pendingRequest{Request: request, CommonName: commonName, SubmittedAt: time.Now()})
+		if err != nil {
+			return client.CertificateResponse{RequestId: request.RequestId, Username: commonName, ErrorMessage: err.Error()}
+		}
+		logger.Infof("Request %s for %s is waiting for approval. Run 'openvpn-admin approve %s' or 'openvpn-admin deny %s --%s <reason>'.", request.RequestId, commonName, request.RequestId, request.RequestId, OPTION_REASON)
+	}
+
+	return client.CertificateResponse{RequestId: request.RequestId, Username: commonName, Pending: true, AwaitingApproval: true}
+}
+
+// Whether the given request is waiting for approval, for answering fetch
+func (store pendingStore) IsAwaitingApproval(requestId string) bool {
+	request, err := store.Load(requestId)
+	return err == nil && request != nil
+}
+
+// Carry out the decisions on pending requests every DECISION_CHECK_INTERVAL, in the background, for the lifetime of
+// the process-requests daemon. This is a no-op if --require-approval is not set. If leader is not nil, standbys skip
+// the decisions.
+func startDecisionProcessing(awsClient *aws_helpers.AwsClient, awsRegion string, results resultStore, leader *leaderElection) {
+	if approvals == nil {
+		return
+	}
+
+	go func() {
+		for {
+			if leader == nil || leader.IsLeader() {
+				carryOutDecisions(awsClient, awsRegion, results)
+			}
+			time.Sleep(DECISION_CHECK_INTERVAL)
+		}
+	}()
+}
+
+// Issue the certificates of approved requests and refuse denied ones. The result is stored under the request ID, for
+// fetch, and sent to the requester's response queue in case they are still waiting.
+func carryOutDecisions(awsClient *aws_helpers.AwsClient, awsRegion string, results resultStore) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	requests, err := approvals.List()
+	if err != nil {
+		logger.Errorf("Unable to read the requests waiting for approval: %s", err.Error())
+		return
+	}
+
+	for _, request := range requests {
+		if request.Decision == "" {
+			continue
+		}
+
+		// The result was stored on an earlier pass, which then failed to remove the request
+		existing, err := results.Load(request.Request.RequestId)
+		if err != nil {
+			logger.Errorf("Unable to read the result of request %s for %s: %s", request.Request.RequestId, request.CommonName, err.Error())
+			continue
+		}
+		if existing != nil {
+			if err := approvals.deleteDecided(request.Request.RequestId); err != nil {
+				logger.Errorf("Unable to remove request %s from the requests waiting for approval: %s", request.Request.RequestId, err.Error())
+			}
+			continue
+		}
+
+		response := carryOutDecision(request)
+		if !response.Success && request.Decision == DECISION_APPROVED {
+			logger.Errorf("Request %s failed: %s", response.RequestId, response.ErrorMessage)
+		}
+
+		// Record the issuance before anything else can fail, so a retry doesn't issue a second certificate
+		if response.Success && request.Decision == DECISION_APPROVED && request.IssuedAt == nil {
+			now := time.Now()
+			request.IssuedAt = &now
+			if err := approvals.Save(request); err != nil {
+				logger.Errorf("Unable to record that the certificate of request %s for %s was issued: %s", response.RequestId, response.Username, err.Error())
+			}
+		}
+
+		err = results.Save(server.Result{
+			RequestId:    response.RequestId,
+			Username:     response.Username,
+			Success:      response.Success,
+			Body:         response.Body,
+			ErrorMessage: response.ErrorMessage,
+			CompletedAt:  time.Now(),
+		})
+		if err != nil {
+			// Keep the request, so the decision is carried out again rather than lost
+			logger.Errorf("Unable to store the result of request %s for %s: %s", response.RequestId, response.Username, err.Error())
+			continue
+		}
+
+		if err := sendCertificateReply(awsClient, awsRegion, request.Request.ResponseQueue, response); err != nil {
+			logger.Warnf("Unable to notify the requester of request %s, who may have stopped waiting. They can still fetch the result. %s", response.RequestId, err.Error())
+		}
+
+		if err := approvals.deleteDecided(response.RequestId); err != nil {
+			logger.Errorf("Unable to remove request %s from the requests waiting for approval: %s", response.RequestId, err.Error())
+		}
+	}
+}
+
+func carryOutDecision(request pendingRequest) client.CertificateResponse {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	response := client.CertificateResponse{RequestId: request.Request.RequestId, Username: request.CommonName}
+
+	var err error
+	if request.Decision == DECISION_APPROVED && request.IssuedAt != nil {
+		logger.Infof("Sending the certificate for %s issued at %s again (request %s)", request.CommonName, request.IssuedAt.Format(time.RFC3339), response.RequestId)
+		response.Body, err = generateCertificateTemplate(request.CommonName)
+	} else if request.Decision == DECISION_APPROVED {
+		logger.Infof("Issuing certificate for %s, approved by %s (request %s)", request.CommonName, request.DecidedBy, response.RequestId)
+		if request.Renew {
+			response.Body, err = renewCertificate(request.CommonName)
+		} else {
+			var validFor time.Duration
+			validFor, err = request.Request.Validity()
+			if err == nil {
+				response.Body, err = issueCertificate(request.CommonName, validFor)
+			}
+		}
+	} else {
+		logger.Infof("Refusing certificate for %s, denied by %s (request %s)", request.CommonName, request.DecidedBy, response.RequestId)
+		err = errors.WithStackTrace(RequestDenied{RequestId: response.RequestId, DecidedBy: request.DecidedBy, Reason: request.Reason})
+		notifyCertificateEvent(EVENT_REQUEST_DENIED, request.CommonName, response.RequestId, fmt.Sprintf("denied by %s: %s", request.DecidedBy, request.Reason))
+	}
+
+	if err != nil {
+		response.ErrorMessage = err.Error()
+	} else {
+		response.Success = true
+	}
+	return response
+}
+
+// Remove a request whose decision has been carried out, under the lock, so a decision made at the same time either
+// lands before (and is refused as the request was already decided) or finds the request gone
+func (store pendingStore) deleteDecided(requestId string) error {
+	unlock, err := store.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return store.Delete(requestId)
+}
+
+// Record a decision on the given request, for the process-requests daemon to carry out
+func decideOnRequest(store pendingStore, requestId string, decision string, reason string) (*pendingRequest, error) {
+	unlock, err := store.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	request, err := store.Load(requestId)
+	if err != nil {
+		return nil, err
+	}
+	if request == nil {
+		return nil, errors.WithStackTrace(UnknownPendingRequest(requestId))
+	}
+	if request.Decision != "" {
+		return nil, errors.WithStackTrace(AlreadyDecided{RequestId: requestId, Decision: request.Decision, DecidedBy: request.DecidedBy})
+	}
+
+	now := time.Now()
+	request.Decision = decision
+	request.DecidedBy = currentOperator()
+	request.DecidedAt = &now
+	request.Reason = reason
+
+	return request, store.Save(*request)
+}
+
+// The name of the person running the command, for the record. Under sudo, that is the user who ran sudo.
+func currentOperator() string {
+	for _, variable := range []string{"SUDO_USER", "USER"} {
+		if name := os.Getenv(variable); name != "" {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Custom errors
+
+type RequestDenied struct {
+	RequestId string
+	DecidedBy string
+	Reason    string
+}
+
+func (err RequestDenied) Error() string {
+	return fmt.Sprintf("Request %s was denied by %s: %s", err.RequestId, err.DecidedBy, err.Reason)
+}
+
+type UnknownPendingRequest string
+
+func (err UnknownPendingRequest) Error() string {
+	return fmt.Sprintf("Request %s is not waiting for approval. Run 'openvpn-admin pending' to see the requests that are.", string(err))
+}
+
+type AlreadyDecided struct {
+	RequestId string
+	Decision  string
+	DecidedBy string
+}
+
+func (err AlreadyDecided) Error() string {
+	return fmt.Sprintf("Request %s has already been %s by %s", err.RequestId, err.Decision, err.DecidedBy)
+}
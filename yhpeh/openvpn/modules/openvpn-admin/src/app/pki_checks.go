@@ -0,0 +1,276 @@
+package app
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const CLIENT_TEMPLATE_PATH = "/etc/openvpn/openvpn-client.ovpn"
+
+// The placeholders generateCertificateTemplate replaces in openvpn-client.ovpn
+var CLIENT_TEMPLATE_PLACEHOLDERS = []string{"__SERVER_ADDRESS__", "__CA_CERTIFICATE__", "__CLIENT_CERTIFICATE__", "__CLIENT_KEY__"}
+
+// A problem found in the PKI, along with what to do about it
+type pkiFinding struct {
+	Problem string
+	Fix     string
+}
+
+// Check that the given PKI files, keyed by absolute path, are consistent: the CA certificate matches the CA key, every
+// certificate was signed by the CA, matches its index.txt entry and its key, serials are unique, serial is ahead of
+// index.txt, and the CRL was signed by the CA and contains every revoked certificate.
+func checkPkiConsistency(files map[string][]byte) []pkiFinding {
+	findings := []pkiFinding{}
+
+	caCert, err := parseCertificate(files[CA_CERT_PATH])
+	if err != nil {
+		return append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s: %s", CA_CERT_PATH, err.Error()),
+			Fix:     "Restore the CA from a backup with openvpn-admin restore",
+		})
+	}
+
+	if time.Now().After(caCert.NotAfter) {
+		findings = append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s expired at %s", CA_CERT_PATH, caCert.NotAfter.Format(time.RFC3339)),
+			Fix:     "Create a new PKI with init-openvpn and issue new certificates to all users",
+		})
+	}
+
+	caKey, err := parsePrivateKey(files[CA_KEY_PATH])
+	if err != nil {
+		findings = append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s: %s", CA_KEY_PATH, err.Error()),
+			Fix:     "Restore the CA key from a backup with openvpn-admin restore",
+		})
+	} else if !publicKeysEqual(caCert.PublicKey, caKey.Public()) {
+		findings = append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s does not match the public key in %s", CA_KEY_PATH, CA_CERT_PATH),
+			Fix:     "Restore ca.crt and ca.key from the same backup with openvpn-admin restore",
+		})
+	}
+
+	entries, err := parseIndex(string(files[INDEX_FILE_PATH]))
+	if err != nil {
+		return append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s: %s", INDEX_FILE_PATH, err.Error()),
+			Fix:     "Fix or remove the offending line, or restore index.txt from a backup",
+		})
+	}
+
+	indexedSerials := map[string]indexEntry{}
+	maxSerial := big.NewInt(0)
+	for _, entry := range entries {
+		if _, duplicate := indexedSerials[entry.Serial]; duplicate {
+			findings = append(findings, pkiFinding{
+				Problem: fmt.Sprintf("%s lists serial %s more than once", INDEX_FILE_PATH, entry.Serial),
+				Fix:     "Remove the duplicate line, keeping the one that matches the certificate on disk",
+			})
+		}
+		indexedSerials[entry.Serial] = entry
+
+		if serial, isHex := new(big.Int).SetString(entry.Serial, 16); isHex && serial.Cmp(maxSerial) > 0 {
+			maxSerial = serial
+		}
+	}
+
+	nextSerial, isHex := new(big.Int).SetString(strings.TrimSpace(string(files[SERIAL_FILE_PATH])), 16)
+	if !isHex {
+		findings = append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s is missing or is not a hex serial number", SERIAL_FILE_PATH),
+			Fix:     fmt.Sprintf("Write the serial after the highest one in %s to %s", INDEX_FILE_PATH, SERIAL_FILE_PATH),
+		})
+	} else if nextSerial.Cmp(maxSerial) <= 0 {
+		next := new(big.Int).Add(maxSerial, big.NewInt(1))
+		findings = append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s (%s) is not greater than the highest serial in %s (%s), so new certificates would reuse serials", SERIAL_FILE_PATH, formatSerial(nextSerial), INDEX_FILE_PATH, formatSerial(maxSerial)),
+			Fix:     fmt.Sprintf("echo %s > %s", formatSerial(next), SERIAL_FILE_PATH),
+		})
+	}
+
+	for path, contents := range files {
+		if path == CA_CERT_PATH || filepath.Ext(path) != ".crt" {
+			continue
+		}
+		findings = append(findings, checkCertificateFile(path, contents, files, caCert, indexedSerials)...)
+	}
+
+	crl, err := x509.ParseCRL(files[CRL_FILE_PATH])
+	if err != nil {
+		return append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s: %s", CRL_FILE_PATH, err.Error()),
+			Fix:     "Run openvpn-admin crl regenerate",
+		})
+	}
+	if err := caCert.CheckCRLSignature(crl); err != nil {
+		findings = append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s was not signed by the CA: %s", CRL_FILE_PATH, err.Error()),
+			Fix:     "Run openvpn-admin crl regenerate",
+		})
+	}
+
+	revokedSerials := map[string]bool{}
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		revokedSerials[formatSerial(revoked.SerialNumber)] = true
+	}
+	for _, entry := range entries {
+		if entry.IsRevoked() && !revokedSerials[entry.Serial] {
+			findings = append(findings, pkiFinding{
+				Problem: fmt.Sprintf("the certificate of %s (serial %s) is revoked in %s but not in %s", entry.CommonName, entry.Serial, INDEX_FILE_PATH, CRL_FILE_PATH),
+				Fix:     "Run openvpn-admin crl regenerate",
+			})
+		}
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+// Check that a certificate was signed by the CA, is listed in index.txt under its common name, and matches its key
+func checkCertificateFile(path string, contents []byte, files map[string][]byte, caCert *x509.Certificate, indexedSerials map[string]indexEntry) []pkiFinding {
+	findings := []pkiFinding{}
+	reissue := fmt.Sprintf("Revoke and reissue the certificate, or remove %s if it is stale", path)
+
+	cert, err := parseCertificate(contents)
+	if err != nil {
+		return append(findings, pkiFinding{Problem: fmt.Sprintf("%s: %s", path, err.Error()), Fix: reissue})
+	}
+
+	if err := cert.CheckSignatureFrom(caCert); err != nil {
+		findings = append(findings, pkiFinding{Problem: fmt.Sprintf("%s was not signed by the CA: %s", path, err.Error()), Fix: reissue})
+	}
+
+	serial := formatSerial(cert.SerialNumber)
+	entry, indexed := indexedSerials[serial]
+	if !indexed {
+		findings = append(findings, pkiFinding{Problem: fmt.Sprintf("%s has serial %s, which is not in %s", path, serial, INDEX_FILE_PATH), Fix: reissue})
+	} else if entry.CommonName != cert.Subject.CommonName {
+		findings = append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s is issued to %s, but %s lists serial %s as %s", path, cert.Subject.CommonName, INDEX_FILE_PATH, serial, entry.CommonName),
+			Fix:     reissue,
+		})
+	}
+
+	keyPath := strings.TrimSuffix(path, ".crt") + ".key"
+	if keyContents, hasKey := files[keyPath]; hasKey {
+		key, err := parsePrivateKey(keyContents)
+		if err != nil {
+			findings = append(findings, pkiFinding{Problem: fmt.Sprintf("%s: %s", keyPath, err.Error()), Fix: reissue})
+		} else if !publicKeysEqual(cert.PublicKey, key.Public()) {
+			findings = append(findings, pkiFinding{Problem: fmt.Sprintf("%s does not match the public key in %s", keyPath, path), Fix: reissue})
+		}
+	}
+
+	return findings
+}
+
+// Check that the CRL has not passed its next update. OpenVPN rejects every client once it has.
+func checkCrlNotExpired(files map[string][]byte) []pkiFinding {
+	crl, err := x509.ParseCRL(files[CRL_FILE_PATH])
+	if err != nil {
+		// Reported by checkPkiConsistency
+		return []pkiFinding{}
+	}
+
+	if crl.HasExpired(time.Now()) {
+		return []pkiFinding{{
+			Problem: fmt.Sprintf("%s expired at %s, so OpenVPN rejects every client", CRL_FILE_PATH, crl.TBSCertList.NextUpdate.Format(time.RFC3339)),
+			Fix:     "Run openvpn-admin crl regenerate",
+		}}
+	}
+
+	return []pkiFinding{}
+}
+
+// Check that the client profile template contains every placeholder, so that generated profiles are complete
+func checkClientTemplate(template string) []pkiFinding {
+	findings := []pkiFinding{}
+	for _, placeholder := range CLIENT_TEMPLATE_PLACEHOLDERS {
+		if !strings.Contains(template, placeholder) {
+			findings = append(findings, pkiFinding{
+				Problem: fmt.Sprintf("%s does not contain %s, so generated profiles will be incomplete", CLIENT_TEMPLATE_PATH, placeholder),
+				Fix:     fmt.Sprintf("Copy the template from the install-openvpn module back to %s", CLIENT_TEMPLATE_PATH),
+			})
+		}
+	}
+	return findings
+}
+
+// Check that private keys are not readable by anyone but their owner
+func checkPrivateKeyPermissions(modes map[string]os.FileMode) []pkiFinding {
+	findings := []pkiFinding{}
+	for path, mode := range modes {
+		if filepath.Ext(path) != ".key" || mode.Perm()&0077 == 0 {
+			continue
+		}
+		findings = append(findings, pkiFinding{
+			Problem: fmt.Sprintf("%s has mode %s, so users other than its owner can read it", path, mode.Perm()),
+			Fix:     fmt.Sprintf("chmod 600 %s", path),
+		})
+	}
+	sortFindings(findings)
+	return findings
+}
+
+func sortFindings(findings []pkiFinding) {
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Problem < findings[j].Problem })
+}
+
+func parseCertificate(contents []byte) (*x509.Certificate, error) {
+	// easy-rsa writes the human readable form of the certificate before the PEM block, which pem.Decode skips over
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKey(contents []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+func publicKeysEqual(first crypto.PublicKey, second crypto.PublicKey) bool {
+	firstDer, err := x509.MarshalPKIXPublicKey(first)
+	if err != nil {
+		return false
+	}
+	secondDer, err := x509.MarshalPKIXPublicKey(second)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(firstDer, secondDer)
+}
@@ -0,0 +1,458 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/urfave/cli"
+)
+
+const PKI_STORAGE_LOCAL = "local"
+
+// The name of the archive that holds the PKI in a remote PKI storage, under its prefix
+const PKI_STORAGE_ARCHIVE_NAME = "pki.tar.gz"
+
+// How often the request processing daemons refresh the working copy from a remote PKI storage, so that e.g. a CRL
+// regenerated by another server reaches this server's OpenVPN
+const PKI_SYNC_INTERVAL = time.Minute
+
+// Where the PKI state (certificates, keys, index.txt, serial, crl.pem) is kept. easy-rsa and OpenVPN only work with
+// the files in /etc/openvpn, so every implementation keeps a working copy there.
+type pkiStorage interface {
+	// Read the stored contents of a PKI file, given by its path in /etc/openvpn. This never returns the changes of a
+	// change that is still in progress.
+	ReadFile(path string) ([]byte, error)
+
+	// Read a PKI file from the working copy. Changes use this to see their own modifications (e.g. the certificate
+	// easy-rsa just signed).
+	ReadWorkingFile(path string) ([]byte, error)
+
+	// Bring the working copy in /etc/openvpn up to date
+	Sync() error
+
+	// Bring the working copy up to date, run change to modify it (usually through easy-rsa) and persist the result.
+	// checkLock is called right before the result is persisted, and fails if the PKI lock was lost in the meantime.
+	// Callers must hold the PKI lock (see changePki).
+	Change(change func() error, checkLock func() error) error
+}
+
+// The storage used by all PKI reads and changes. See configurePkiStorage.
+var pkiStore pkiStorage = localPkiStorage{}
+
+// Set up the PKI storage given by --pki-storage: either local (the default) or an S3 URI such as s3://bucket/pki
+func configurePkiStorage(cliContext *cli.Context, awsClient *aws_helpers.AwsClient) error {
+	// openvpn-admin dev keeps its throwaway PKI for as long as it runs
+	if _, isDev := pkiStore.(devPkiStorage); isDev {
+		return nil
+	}
+
+	location := cliContext.String(OPTION_PKI_STORAGE)
+	if location == "" || location == PKI_STORAGE_LOCAL {
+		pkiStore = localPkiStorage{}
+		return nil
+	}
+
+	awsRegion, err := getAwsRegion(cliContext)
+	if err != nil {
+		return err
+	}
+
+	bucket, prefix, err := aws_helpers.ParseS3Uri(location)
+	if err != nil {
+		return err
+	}
+
+	logging.GetLogger(LOGGER_NAME).Infof("Using %s as the PKI storage", location)
+	pkiStore = &s3PkiStorage{
+		AwsClient: awsClient,
+		AwsRegion: awsRegion,
+		Bucket:    bucket,
+		Prefix:    strings.TrimSuffix(prefix, "/"),
+		KmsKeyId:  cliContext.String(OPTION_KMS_KEY_ID),
+	}
+	return nil
+}
+
+// Set up the PKI storage, sync the working copy once and then keep syncing it every PKI_SYNC_INTERVAL, in the
+// background, for the lifetime of the request processing daemons. Only the first sync is a no-op for local storage.
+func startPeriodicPkiSync(cliContext *cli.Context, awsClient *aws_helpers.AwsClient) error {
+	if err := configurePkiStorage(cliContext, awsClient); err != nil {
+		return err
+	}
+
+	if err := syncPki(); err != nil {
+		return err
+	}
+
+	if _, isLocal := pkiStore.(localPkiStorage); isLocal {
+		return nil
+	}
+
+	go func() {
+		for {
+			time.Sleep(PKI_SYNC_INTERVAL)
+			if err := syncPki(); err != nil {
+				logging.GetLogger(LOGGER_NAME).Errorf("Unable to sync the PKI: %s", err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Bring the working copy up to date. This only takes the PKI lock on this server, as it doesn't modify the PKI storage.
+func syncPki() error {
+	unlock, err := lockPkiLocally()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return pkiStore.Sync()
+}
+
+// Modify the PKI while holding the PKI lock
+func changePki(change func() error) error {
+	lock, err := lockPki()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	return pkiStore.Change(change, lock.Check)
+}
+
+func readPkiFileAsString(path string) (string, error) {
+	contents, err := pkiStore.ReadFile(path)
+	return string(contents), err
+}
+
+// Like readPkiFileAsString, but reads the working copy. Only use this during a change (see changePki).
+func readWorkingPkiFileAsString(path string) (string, error) {
+	contents, err := pkiStore.ReadWorkingFile(path)
+	return string(contents), err
+}
+
+// Keeps the PKI on local disk only. It survives the server only through backups.
+type localPkiStorage struct{}
+
+func (storage localPkiStorage) ReadFile(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	return contents, errors.WithStackTrace(err)
+}
+
+func (storage localPkiStorage) ReadWorkingFile(path string) ([]byte, error) {
+	return storage.ReadFile(path)
+}
+
+func (storage localPkiStorage) Sync() error {
+	return nil
+}
+
+func (storage localPkiStorage) Change(change func() error, checkLock func() error) error {
+	return change()
+}
+
+// Keeps the PKI in S3, so a replacement server picks up the exact current state. The whole PKI is stored as a single
+// archive (in the backup format, see createBackupArchive), so that every change is committed by a single conditional
+// write: either all of its files are stored or none of them are. Every change first downloads the current state, and
+// then uploads the new archive only if nobody else stored one in the meantime. If someone did, the change fails with
+// PkiStateConflict and the next change starts over from the state in S3.
+type s3PkiStorage struct {
+	AwsClient *aws_helpers.AwsClient
+	AwsRegion string
+	Bucket    string
+	Prefix    string
+	KmsKeyId  string
+
+	mutex sync.Mutex
+	// The PKI files as of the last sync or change, keyed by path in /etc/openvpn. This is what ReadFile returns, so
+	// that readers never see a change that is still in progress in the working copy. nil until the first sync.
+	files map[string][]byte
+	// The ETag of the archive files came from, or "" if there is no archive in S3 yet
+	etag string
+	// Whether the working copy matches files, i.e. no change has modified it without storing the result
+	clean bool
+}
+
+func (storage *s3PkiStorage) key(name string) string {
+	return storage.keyPrefix() + name
+}
+
+func (storage *s3PkiStorage) keyPrefix() string {
+	if storage.Prefix == "" {
+		return ""
+	}
+	return storage.Prefix + "/"
+}
+
+// Files are read from the state as of the last sync or change, which is downloaded on first use
+func (storage *s3PkiStorage) ReadFile(path string) ([]byte, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.files == nil {
+		files, etag, err := storage.download()
+		if err != nil {
+			return nil, err
+		}
+		storage.files = files
+		storage.etag = etag
+	}
+
+	contents, exists := storage.files[path]
+	if !exists {
+		return nil, errors.WithStackTrace(&os.PathError{Op: "read", Path: path, Err: os.ErrNotExist})
+	}
+	return contents, nil
+}
+
+func (storage *s3PkiStorage) ReadWorkingFile(path string) ([]byte, error) {
+	return localPkiStorage{}.ReadFile(path)
+}
+
+// Bring the working copy in /etc/openvpn in line with the PKI in S3. This is skipped if neither changed since the
+// last sync.
+func (storage *s3PkiStorage) Sync() error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	files, etag, err := storage.download()
+	if err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	upToDate := storage.clean && storage.files != nil && storage.etag == etag
+	storage.mutex.Unlock()
+
+	if upToDate {
+		return nil
+	}
+
+	if err := writeWorkingCopy(files); err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	storage.files = files
+	storage.etag = etag
+	storage.clean = true
+	storage.mutex.Unlock()
+
+	logger.Debugf("Synced %d PKI files from s3://%s/%s", len(files), storage.Bucket, storage.Prefix)
+	return nil
+}
+
+func (storage *s3PkiStorage) Change(change func() error, checkLock func() error) error {
+	if err := storage.Sync(); err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	storage.clean = false
+	storage.mutex.Unlock()
+
+	if err := change(); err != nil {
+		return err
+	}
+
+	return storage.commit(checkLock)
+}
+
+// Download the PKI from S3 along with the ETag of its archive. PKIs stored by older versions of openvpn-admin, with an
+// object per file, are read as well; the next change then stores them as an archive. If there is no PKI in S3 at all,
+// this returns the working copy, which the next change uploads. This is how an existing server moves its PKI to S3.
+func (storage *s3PkiStorage) download() (map[string][]byte, string, error) {
+	archive, etag, err := storage.AwsClient.GetS3ObjectWithEtag(storage.AwsRegion, storage.Bucket, storage.key(PKI_STORAGE_ARCHIVE_NAME))
+	if aws_helpers.IsS3ObjectMissing(err) {
+		files, err := storage.downloadFilePerObject()
+		if err != nil || len(files) > 0 {
+			return files, "", err
+		}
+		return readWorkingCopy()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	backup, err := readBackupArchive(archive)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for path := range backup.Files {
+		if !isPkiStatePath(path) {
+			return nil, "", errors.WithStackTrace(InvalidBackup(fmt.Sprintf("unexpected file %s", path)))
+		}
+	}
+
+	return backup.Files, etag, nil
+}
+
+// Download a PKI stored by an older version of openvpn-admin, with an object per file
+func (storage *s3PkiStorage) downloadFilePerObject() (map[string][]byte, error) {
+	etagsByKey, err := storage.AwsClient.ListS3ObjectEtags(storage.AwsRegion, storage.Bucket, storage.keyPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	for key := range etagsByKey {
+		// Skip anything in "subdirectories", e.g. backups uploaded to the same bucket
+		name := strings.TrimPrefix(key, storage.keyPrefix())
+		if strings.Contains(name, "/") {
+			continue
+		}
+
+		path := filepath.Join(OPENVPN_PATH, name)
+		if !isPkiStatePath(path) {
+			continue
+		}
+
+		contents, err := storage.AwsClient.GetS3Object(storage.AwsRegion, storage.Bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		files[path] = contents
+	}
+
+	return files, nil
+}
+
+// Store the working copy in S3, unless it didn't change. The conditional write on the archive is the commit point.
+func (storage *s3PkiStorage) commit(checkLock func() error) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	paths, err := collectPkiStateFiles()
+	if err != nil {
+		return err
+	}
+
+	backup, err := readBackupFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	unchanged := storage.etag != "" && sameFiles(storage.files, backup.Files)
+	previousEtag := storage.etag
+	storage.mutex.Unlock()
+
+	if !unchanged {
+		archive, err := createBackupArchive(backup)
+		if err != nil {
+			return err
+		}
+
+		if err := checkLock(); err != nil {
+			return err
+		}
+
+		key := storage.key(PKI_STORAGE_ARCHIVE_NAME)
+		etag, err := storage.AwsClient.PutS3ObjectIfMatch(storage.AwsRegion, storage.Bucket, key, archive, storage.KmsKeyId, previousEtag)
+		if _, isConflict := errors.Unwrap(err).(aws_helpers.S3ObjectChanged); isConflict {
+			return errors.WithStackTrace(PkiStateConflict(fmt.Sprintf("s3://%s/%s", storage.Bucket, key)))
+		}
+		if err != nil {
+			return err
+		}
+
+		logger.Debugf("Stored %d PKI files in s3://%s/%s", len(backup.Files), storage.Bucket, key)
+		previousEtag = etag
+	}
+
+	storage.mutex.Lock()
+	storage.files = backup.Files
+	storage.etag = previousEtag
+	storage.clean = true
+	storage.mutex.Unlock()
+
+	return nil
+}
+
+// Read every PKI file in the working copy, keyed by path
+func readWorkingCopy() (map[string][]byte, string, error) {
+	paths, err := collectPkiStateFiles()
+	if err != nil {
+		return nil, "", err
+	}
+
+	backup, err := readBackupFiles(paths)
+	return backup.Files, "", err
+}
+
+// Replace the working copy with the given files. PKI files that aren't among them, e.g. the certificate of a change
+// that could not be stored, are removed.
+func writeWorkingCopy(files map[string][]byte) error {
+	paths, err := collectPkiStateFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if _, keep := files[path]; !keep {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return errors.WithStackTrace(err)
+			}
+		}
+	}
+
+	for path, contents := range files {
+		if err := replaceFile(path, contents, pkiFileMode(path)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Whether the given path is one of the PKI files in /etc/openvpn (see PKI_STATE_FILE_PATTERNS)
+func isPkiStatePath(path string) bool {
+	if filepath.Clean(path) != path || filepath.Dir(path) != OPENVPN_PATH {
+		return false
+	}
+	for _, pattern := range PKI_STATE_FILE_PATTERNS {
+		if matches, _ := filepath.Match(pattern, filepath.Base(path)); matches {
+			return true
+		}
+	}
+	return false
+}
+
+func sameFiles(files map[string][]byte, otherFiles map[string][]byte) bool {
+	if len(files) != len(otherFiles) {
+		return false
+	}
+	for path, contents := range files {
+		otherContents, exists := otherFiles[path]
+		if !exists || !bytes.Equal(contents, otherContents) {
+			return false
+		}
+	}
+	return true
+}
+
+// Private keys are only readable by their owner. See init-openvpn.
+func pkiFileMode(path string) os.FileMode {
+	if filepath.Ext(path) == ".key" {
+		return 0600
+	}
+	return 0660
+}
+
+// Custom errors
+
+type PkiStateConflict string
+
+func (err PkiStateConflict) Error() string {
+	return fmt.Sprintf("%s was changed in the PKI storage by another server during this operation, so the operation was not stored. Retry it.", string(err))
+}
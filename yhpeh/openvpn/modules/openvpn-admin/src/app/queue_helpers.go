@@ -0,0 +1,182 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/urfave/cli"
+)
+
+// The tags the openvpn-server module puts on its queues. The role tells request and revocation queues apart, and the
+// server tag tells the queues of different OpenVPN servers in the same account apart.
+const QUEUE_TAG_ROLE = "openvpn-admin:role"
+const QUEUE_TAG_SERVER = "openvpn-admin:server"
+
+const QUEUE_ROLE_REQUESTS = "requests"
+const QUEUE_ROLE_REVOCATIONS = "revocations"
+
+// How many queues discoverQueues reads the tags of at once. Tags can only be read one queue at a time, which is slow in
+// accounts with many queues.
+const MAX_CONCURRENT_TAG_LOOKUPS = 10
+
+// A queue found by discoverQueues
+type discoveredQueue struct {
+	Url string
+	// The openvpn-admin:server tag of the queue, if any
+	Server string
+}
+
+func (queue discoveredQueue) String() string {
+	if queue.Server == "" {
+		return queue.Url
+	}
+	return fmt.Sprintf("%s (%s)", queue.Server, queue.Url)
+}
+
+// Find the queues with the given role, i.e. those tagged openvpn-admin:role=<role>, plus untagged queues whose name
+// starts with legacyPrefix, as created by older versions of the openvpn-server module. Only queues that also carry all
+// of the given tags are returned. Queues whose tags we aren't allowed to read, e.g. because the user's policy predates
+// the tags and only grants sqs:ListQueues, are matched by the legacy prefix alone, unless tags are wanted.
+//
+// Tags can only be read one queue at a time, so rather than reading the tags of every queue in the region, this first
+// looks at the queues named with the legacy prefix, which the openvpn-server module still uses for tagged queues, and
+// only looks further if there are none.
+func discoverQueues(awsClient *aws_helpers.AwsClient, awsRegion string, role string, legacyPrefix string, wantedTags map[string]string) ([]discoveredQueue, error) {
+	queues, err := findQueuesWithRole(awsClient, awsRegion, role, legacyPrefix, legacyPrefix, wantedTags)
+	if err != nil || len(queues) > 0 {
+		return queues, err
+	}
+
+	return findQueuesWithRole(awsClient, awsRegion, role, "", legacyPrefix, wantedTags)
+}
+
+// Find the queues with the given role (see discoverQueues) among those whose name starts with namePrefix
+func findQueuesWithRole(awsClient *aws_helpers.AwsClient, awsRegion string, role string, namePrefix string, legacyPrefix string, wantedTags map[string]string) ([]discoveredQueue, error) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	queueUrls, err := awsClient.FindQueuesWithNamePrefix(awsRegion, namePrefix)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("Looking for %s queues among %d queues named %s* in %s", role, len(queueUrls), namePrefix, awsRegion)
+
+	allTags, err := getAllQueueTags(awsClient, awsRegion, queueUrls)
+	if err != nil {
+		return nil, err
+	}
+
+	queues := []discoveredQueue{}
+	for i, queueUrl := range queueUrls {
+		tags := allTags[i]
+		if tags == nil {
+			if len(wantedTags) == 0 && strings.HasPrefix(queueName(queueUrl), legacyPrefix) {
+				logger.Debugf("Using %s by its name, as we may not read its tags", queueUrl)
+				queues = append(queues, discoveredQueue{Url: queueUrl})
+			} else {
+				logger.Debugf("Skipping %s, as we may not read its tags", queueUrl)
+			}
+			continue
+		}
+
+		queueRole, tagged := tags[QUEUE_TAG_ROLE]
+		if tagged && queueRole != role {
+			continue
+		}
+		if !tagged && !strings.HasPrefix(queueName(queueUrl), legacyPrefix) {
+			continue
+		}
+		if !hasAllTags(tags, wantedTags) {
+			continue
+		}
+
+		queues = append(queues, discoveredQueue{Url: queueUrl, Server: tags[QUEUE_TAG_SERVER]})
+	}
+
+	return queues, nil
+}
+
+// Read the tags of the given queues, in the same order. The tags of queues we may not read the tags of are nil.
+func getAllQueueTags(awsClient *aws_helpers.AwsClient, awsRegion string, queueUrls []string) ([]map[string]string, error) {
+	allTags := make([]map[string]string, len(queueUrls))
+	errs := make([]error, len(queueUrls))
+	slots := make(chan bool, MAX_CONCURRENT_TAG_LOOKUPS)
+
+	var waitGroup sync.WaitGroup
+	for i, queueUrl := range queueUrls {
+		waitGroup.Add(1)
+		go func(i int, queueUrl string) {
+			defer waitGroup.Done()
+			slots <- true
+			defer func() { <-slots }()
+
+			tags, err := awsClient.GetQueueTags(awsRegion, queueUrl)
+			if aws_helpers.IsAccessDenied(err) {
+				return
+			}
+			if tags == nil {
+				tags = map[string]string{}
+			}
+			allTags[i], errs[i] = tags, err
+		}(i, queueUrl)
+	}
+	waitGroup.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return allTags, nil
+}
+
+// The name of a queue is the last part of its URL
+func queueName(queueUrl string) string {
+	return queueUrl[strings.LastIndex(queueUrl, "/")+1:]
+}
+
+// Ask on the terminal which of the given queues to use
+func chooseQueue(cliContext *cli.Context, role string, queues []discoveredQueue) (string, error) {
+	writer := cliContext.App.ErrWriter
+	if writer == nil {
+		writer = cli.ErrWriter
+	}
+
+	fmt.Fprintf(writer, "Found %d %s queues:\n", len(queues), role)
+	for i, queue := range queues {
+		fmt.Fprintf(writer, "  %d) %s\n", i+1, queue.String())
+	}
+	fmt.Fprintf(writer, "Which one should be used? [1-%d] ", len(queues))
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+
+	choice, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || choice < 1 || choice > len(queues) {
+		return "", errors.WithStackTrace(InvalidQueueChoice(strings.TrimSpace(answer)))
+	}
+
+	return queues[choice-1].Url, nil
+}
+
+// Whether the given file is a terminal rather than e.g. a pipe or /dev/null
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Custom errors
+
+type InvalidQueueChoice string
+
+func (err InvalidQueueChoice) Error() string {
+	return fmt.Sprintf("%q is not one of the queues listed", string(err))
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/server"
+)
+
+const DEFAULT_RESULTS_DIR = "/var/lib/openvpn-admin/results"
+const DEFAULT_RESULT_RETENTION = 24 * time.Hour
+
+// Request IDs end up in file names, so only allow what uuid generates
+var requestIdPattern = regexp.MustCompile(`^[a-zA-Z0-9-]{1,64}$`)
+
+// Keeps the results of --no-wait requests in a directory on the OpenVPN server, one file per request, for the given
+// retention. The files hold private keys, so only root may read them. This is the server.ResultStore of the
+// process-requests daemon.
+type resultStore struct {
+	Dir       string
+	Retention time.Duration
+}
+
+func (store resultStore) path(requestId string) string {
+	return filepath.Join(store.Dir, requestId+".json")
+}
+
+// Store the result of a request, and remove results that are past the retention while at it
+func (store resultStore) Save(result server.Result) error {
+	if !requestIdPattern.MatchString(result.RequestId) {
+		return errors.WithStackTrace(InvalidRequestId(result.RequestId))
+	}
+
+	contents, err := json.Marshal(result)
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	if err := replaceFile(store.path(result.RequestId), contents, 0600); err != nil {
+		return err
+	}
+
+	return store.Prune()
+}
+
+// Return the stored result of the given request, or nil if there is none (yet), or it is past the retention
+func (store resultStore) Load(requestId string) (*server.Result, error) {
+	if !requestIdPattern.MatchString(requestId) {
+		return nil, errors.WithStackTrace(InvalidRequestId(requestId))
+	}
+
+	contents, err := ioutil.ReadFile(store.path(requestId))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	result := server.Result{}
+	if err := json.Unmarshal(contents, &result); err != nil {
+		return nil, errors.WithStackTraceAndPrefix(err, "Unable to parse %s", store.path(requestId))
+	}
+
+	if time.Since(result.CompletedAt) > store.Retention {
+		return nil, nil
+	}
+
+	return &result, nil
+}
+
+// Delete the results that are past the retention
+func (store resultStore) Prune() error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	entries, err := ioutil.ReadDir(store.Dir)
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") || time.Since(entry.ModTime()) <= store.Retention {
+			continue
+		}
+
+		logger.Debugf("Removing expired result %s", entry.Name())
+		if err := os.Remove(filepath.Join(store.Dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return errors.WithStackTrace(err)
+		}
+	}
+
+	return nil
+}
+
+// Custom errors
+
+type InvalidRequestId string
+
+func (err InvalidRequestId) Error() string {
+	return fmt.Sprintf("%s is not a valid request ID", string(err))
+}
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/files"
+)
+
+// A client currently connected to the OpenVPN server, as reported by the management interface or the status file
+type connectedClient struct {
+	CommonName        string
+	RealAddress       string
+	VirtualAddress    string
+	BytesReceived     int64
+	BytesSent         int64
+	ConnectedSince    time.Time
+	CertificateStatus string
+}
+
+// Read the connected clients from the OpenVPN management interface
+func readConnectedClientsFromManagement(address string, passwordFile string) ([]connectedClient, error) {
+	client, err := dialManagementInterface(address, passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	lines, err := client.command("status 3")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseOpenVpnStatus(lines)
+}
+
+// Read the connected clients from a status file written by OpenVPN's status directive
+func readConnectedClientsFromStatusFile(path string) ([]connectedClient, error) {
+	contents, err := files.ReadFileAsString(path)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	return parseOpenVpnStatus(strings.Split(contents, "\n"))
+}
+
+// Parse the CLIENT_LIST rows of OpenVPN status output. Status version 2 separates fields with commas and version 3 with
+// tabs. The columns differ between OpenVPN releases, so they are looked up by name in the HEADER row.
+func parseOpenVpnStatus(lines []string) ([]connectedClient, error) {
+	clients := []connectedClient{}
+	columns := map[string]int{}
+
+	for _, line := range lines {
+		separator := ","
+		if strings.Contains(line, "\t") {
+			separator = "\t"
+		}
+		fields := strings.Split(strings.TrimRight(line, "\r"), separator)
+
+		if len(fields) > 2 && fields[0] == "HEADER" && fields[1] == "CLIENT_LIST" {
+			for i, name := range fields[1:] {
+				columns[name] = i
+			}
+			continue
+		}
+
+		if fields[0] != "CLIENT_LIST" {
+			continue
+		}
+
+		if len(columns) == 0 {
+			return nil, errors.WithStackTrace(UnsupportedStatusFormat("CLIENT_LIST row found before its HEADER"))
+		}
+
+		field := func(name string) string {
+			index, exists := columns[name]
+			if !exists || index >= len(fields) {
+				return ""
+			}
+			return fields[index]
+		}
+
+		client := connectedClient{
+			CommonName:     field("Common Name"),
+			RealAddress:    field("Real Address"),
+			VirtualAddress: field("Virtual Address"),
+		}
+		client.BytesReceived, _ = strconv.ParseInt(field("Bytes Received"), 10, 64)
+		client.BytesSent, _ = strconv.ParseInt(field("Bytes Sent"), 10, 64)
+		if connectedSince, err := strconv.ParseInt(field("Connected Since (time_t)"), 10, 64); err == nil {
+			client.ConnectedSince = time.Unix(connectedSince, 0)
+		}
+
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// Set the certificate status of each client from index.txt, so that clients connected with a certificate that has been
+// revoked or has expired since they connected stand out
+func annotateCertificateStatus(clients []connectedClient, entries []indexEntry) {
+	for i := range clients {
+		entry := latestIndexEntryFor(entries, clients[i].CommonName)
+		if entry == nil {
+			clients[i].CertificateStatus = "unknown"
+		} else {
+			clients[i].CertificateStatus = certificateStatus(*entry)
+		}
+	}
+}
+
+// Custom errors
+
+type UnsupportedStatusFormat string
+
+func (err UnsupportedStatusFormat) Error() string {
+	return fmt.Sprintf("Unable to parse OpenVPN status output (only status-version 2 and 3 are supported): %s", string(err))
+}
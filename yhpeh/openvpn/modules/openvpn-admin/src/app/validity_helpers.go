@@ -0,0 +1,369 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/urfave/cli"
+)
+
+// easy-rsa issues certificates for a whole number of days, so validities are rounded up to the next day and maximums
+// must be whole days
+const DAY = 24 * time.Hour
+
+const DEFAULT_EXPIRED_CLEANUP_INTERVAL = time.Hour
+
+// How much later than requested a certificate may expire before it is taken as a sign that generate-wrapper.sh ignored
+// the requested validity
+const VALIDITY_TOLERANCE = time.Hour
+
+// How long the members of the groups in --group-max-valid-for are kept before they are looked up in IAM again, so that
+// a burst of requests doesn't list every group for every certificate
+const GROUP_MEMBERS_CACHE_DURATION = time.Minute
+
+var keyExpirePattern = regexp.MustCompile(`(?m)^export KEY_EXPIRE=(\d+)\s*$`)
+
+// The longest validity users may request, as given by --max-valid-for and --group-max-valid-for. A maximum of 0 means
+// only KEY_EXPIRE applies. See configureValidityLimits.
+type validityLimits struct {
+	AwsClient *aws_helpers.AwsClient
+	AwsRegion string
+	Max       time.Duration
+	GroupMax  map[string]time.Duration
+
+	members *groupMembersCache
+}
+
+// The members of IAM groups, by group, as last looked up
+type groupMembersCache struct {
+	mutex   sync.Mutex
+	members map[string]cachedGroupMembers
+}
+
+type cachedGroupMembers struct {
+	Names     []string
+	FetchedAt time.Time
+}
+
+var certificateValidityLimits = validityLimits{}
+
+// Set up the validity limits given by --max-valid-for and --group-max-valid-for
+func configureValidityLimits(cliContext *cli.Context, awsClient *aws_helpers.AwsClient) error {
+	limits := validityLimits{Max: cliContext.Duration(OPTION_MAX_VALID_FOR), GroupMax: map[string]time.Duration{}}
+	if err := checkMaxValidity(OPTION_MAX_VALID_FOR, limits.Max); err != nil {
+		return err
+	}
+
+	for _, groupMax := range cliContext.StringSlice(OPTION_GROUP_MAX_VALID_FOR) {
+		groupAndMax := strings.SplitN(groupMax, "=", 2)
+		if len(groupAndMax) != 2 || groupAndMax[0] == "" {
+			return errors.WithStackTrace(InvalidGroupMaxValidity(groupMax))
+		}
+
+		max, err := time.ParseDuration(groupAndMax[1])
+		if err != nil || max == 0 {
+			return errors.WithStackTrace(InvalidGroupMaxValidity(groupMax))
+		}
+		if err := checkMaxValidity(OPTION_GROUP_MAX_VALID_FOR, max); err != nil {
+			return err
+		}
+
+		limits.GroupMax[groupAndMax[0]] = max
+	}
+
+	// Group membership is looked up in IAM
+	if len(limits.GroupMax) > 0 {
+		awsRegion, err := getAwsRegion(cliContext)
+		if err != nil {
+			return err
+		}
+		limits.AwsClient = awsClient
+		limits.AwsRegion = awsRegion
+		limits.members = &groupMembersCache{members: map[string]cachedGroupMembers{}}
+	}
+
+	certificateValidityLimits = limits
+	return nil
+}
+
+func checkMaxValidity(option string, max time.Duration) error {
+	if max < 0 || max%DAY != 0 {
+		return errors.WithStackTrace(InvalidMaxValidity{Option: option, Max: max})
+	}
+	return nil
+}
+
+// The longest validity the given user may request, or 0 if only KEY_EXPIRE applies. Members of one or more of the
+// groups in --group-max-valid-for get the largest maximum of those groups, and everyone else gets --max-valid-for.
+func (limits validityLimits) maxValidityFor(username string) (time.Duration, error) {
+	// Without group limits, there is nothing to look up in IAM
+	if len(limits.GroupMax) == 0 {
+		return limits.Max, nil
+	}
+
+	groups := []string{}
+	for group := range limits.GroupMax {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	var groupMax time.Duration
+	for _, group := range groups {
+		members, err := limits.groupMembers(group)
+		if err != nil {
+			return 0, err
+		}
+		for _, member := range members {
+			if mapUsername(member) == username && limits.GroupMax[group] > groupMax {
+				groupMax = limits.GroupMax[group]
+			}
+		}
+	}
+
+	if groupMax > 0 {
+		return groupMax, nil
+	}
+	return limits.Max, nil
+}
+
+// The IAM users in the given group, looked up at most every GROUP_MEMBERS_CACHE_DURATION
+func (limits validityLimits) groupMembers(group string) ([]string, error) {
+	limits.members.mutex.Lock()
+	defer limits.members.mutex.Unlock()
+
+	if cached, exists := limits.members.members[group]; exists && time.Since(cached.FetchedAt) < GROUP_MEMBERS_CACHE_DURATION {
+		return cached.Names, nil
+	}
+
+	names, err := limits.AwsClient.ListIamGroupMemberNames(limits.AwsRegion, group)
+	if err != nil {
+		return nil, err
+	}
+
+	limits.members.members[group] = cachedGroupMembers{Names: names, FetchedAt: time.Now()}
+	return names, nil
+}
+
+// Work out for how many days the certificate with the given common name should be valid, given the validity its
+// request asked for, or 0 if it didn't ask for one. Returns 0 for the default, KEY_EXPIRE. Requests for more than the
+// user's maximum are refused, and requests that don't ask get the maximum if it is shorter than the default.
+func certificateValidityDays(commonName string, requested time.Duration) (int, error) {
+	if requested < 0 {
+		return 0, errors.WithStackTrace(InvalidValidity(requested))
+	}
+
+	username, _ := client.SplitCertificateName(commonName)
+	max, err := certificateValidityLimits.maxValidityFor(username)
+	if err != nil {
+		return 0, err
+	}
+	if requested == 0 && max == 0 {
+		return 0, nil
+	}
+
+	defaultDays, err := readKeyExpireDays()
+	if err != nil {
+		return 0, err
+	}
+
+	limit := time.Duration(defaultDays) * DAY
+	if max > 0 && max < limit {
+		limit = max
+	}
+
+	if requested == 0 {
+		if limit < time.Duration(defaultDays)*DAY {
+			return int(limit / DAY), nil
+		}
+		return 0, nil
+	}
+
+	days := int((requested + DAY - 1) / DAY)
+	if time.Duration(days)*DAY > limit {
+		return 0, errors.WithStackTrace(ValidityTooLong{CommonName: commonName, Requested: requested, Max: limit})
+	}
+	return days, nil
+}
+
+// Read the default validity of certificates, in days, from vars.local
+func readKeyExpireDays() (int, error) {
+	contents, err := ioutil.ReadFile(VARS_LOCAL_PATH)
+	if err != nil {
+		return 0, errors.WithStackTrace(err)
+	}
+
+	match := keyExpirePattern.FindStringSubmatch(string(contents))
+	if match == nil {
+		return 0, errors.WithStackTrace(MissingKeyExpire(VARS_LOCAL_PATH))
+	}
+
+	days, err := strconv.Atoi(match[1])
+	return days, errors.WithStackTrace(err)
+}
+
+// Make sure the certificate just issued with the given common name doesn't outlive the validity it was issued for.
+// Servers installed before --valid-for existed have a generate-wrapper.sh that ignores it, so rather than hand out a
+// certificate that is valid for years instead of days, revoke it again.
+func checkIssuedValidity(commonName string, days int) error {
+	entries, err := readWorkingIndex()
+	if err != nil {
+		return err
+	}
+
+	entry := latestIndexEntryFor(entries, commonName)
+	if entry == nil {
+		return errors.WithStackTrace(fmt.Errorf("the certificate for %s is missing from %s", commonName, INDEX_FILE_PATH))
+	}
+
+	if entry.ExpirationDate.After(time.Now().Add(time.Duration(days)*DAY + VALIDITY_TOLERANCE)) {
+		if err := revokeCertificate(commonName); err != nil {
+			return err
+		}
+		return errors.WithStackTrace(ValidityIgnored{CommonName: commonName, Days: days, Expires: entry.ExpirationDate})
+	}
+
+	return nil
+}
+
+// Mark the certificates in index.txt that have passed their expiration date as expired, the way openssl ca -updatedb
+// does, and return the updated entries along with the common names of the certificates that expired. Until then, the
+// CA database still counts them as valid, which would stop their owners from getting a new certificate. Callers must
+// hold the PKI lock (see changePki).
+func markExpiredCertificates() ([]indexEntry, []string, error) {
+	contents, err := readWorkingPkiFileAsString(INDEX_FILE_PATH)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	expired := []string{}
+	lines := strings.Split(contents, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		entry, err := parseIndexLine(line)
+		if err != nil {
+			return nil, nil, errors.WithStackTrace(InvalidIndexLine{LineNumber: i + 1, Line: line, Err: err})
+		}
+
+		if entry.Status == INDEX_STATUS_VALID && !now.Before(entry.ExpirationDate) {
+			lines[i] = INDEX_STATUS_EXPIRED + strings.TrimPrefix(line, INDEX_STATUS_VALID)
+			expired = append(expired, entry.CommonName)
+		}
+	}
+
+	if len(expired) > 0 {
+		contents = strings.Join(lines, "\n")
+		if err := replaceFile(INDEX_FILE_PATH, []byte(contents), pkiFileMode(INDEX_FILE_PATH)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	entries, err := parseIndex(contents)
+	return entries, expired, err
+}
+
+// Mark expired certificates as such every --expired-cleanup-interval, in the background, for the lifetime of the
+// process-requests daemon. If leader is not nil, standbys skip the cleanup.
+func startExpiredCertificateCleanup(cliContext *cli.Context, leader *leaderElection) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	interval := cliContext.Duration(OPTION_EXPIRED_CLEANUP_INTERVAL)
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			if leader == nil || leader.IsLeader() {
+				err := changePki(func() error {
+					_, expired, err := markExpiredCertificates()
+					for _, commonName := range expired {
+						logger.Infof("Marked the certificate for %s as expired", commonName)
+					}
+					return err
+				})
+				if err != nil {
+					logger.Errorf("Unable to clean up expired certificates: %s", err.Error())
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// A short description of the time left until the given expiration date, e.g. 3d 4h
+func describeTimeLeft(expires time.Time) string {
+	remaining := time.Until(expires)
+	switch {
+	case remaining <= 0:
+		return "0m"
+	case remaining >= DAY:
+		return fmt.Sprintf("%dd %dh", int(remaining/DAY), int(remaining%DAY/time.Hour))
+	case remaining >= time.Hour:
+		return fmt.Sprintf("%dh %dm", int(remaining/time.Hour), int(remaining%time.Hour/time.Minute))
+	default:
+		return fmt.Sprintf("%dm", int(remaining/time.Minute))
+	}
+}
+
+// Custom errors
+
+type InvalidValidity time.Duration
+
+func (err InvalidValidity) Error() string {
+	return fmt.Sprintf("--%s must be positive, but was %s", OPTION_VALID_FOR, time.Duration(err))
+}
+
+type InvalidMaxValidity struct {
+	Option string
+	Max    time.Duration
+}
+
+func (err InvalidMaxValidity) Error() string {
+	return fmt.Sprintf("--%s must be a whole number of days (e.g. 72h), but was %s", err.Option, err.Max)
+}
+
+type InvalidGroupMaxValidity string
+
+func (err InvalidGroupMaxValidity) Error() string {
+	return fmt.Sprintf("Invalid --%s %q. Expected <group>=<duration>, e.g. contractors=72h.", OPTION_GROUP_MAX_VALID_FOR, string(err))
+}
+
+type ValidityTooLong struct {
+	CommonName string
+	Requested  time.Duration
+	Max        time.Duration
+}
+
+func (err ValidityTooLong) Error() string {
+	return fmt.Sprintf("A certificate for %s may be valid for at most %d days, but %s was requested (rounded up to %d days)", err.CommonName, int(err.Max/DAY), err.Requested, int((err.Requested+DAY-1)/DAY))
+}
+
+type MissingKeyExpire string
+
+func (err MissingKeyExpire) Error() string {
+	return fmt.Sprintf("Unable to find the default certificate validity (export KEY_EXPIRE=<days>) in %s", string(err))
+}
+
+type ValidityIgnored struct {
+	CommonName string
+	Days       int
+	Expires    time.Time
+}
+
+func (err ValidityIgnored) Error() string {
+	return fmt.Sprintf("The certificate for %s was to be valid for %d days, but expires on %s, so it was revoked again. Update /etc/openvpn-ca/generate-wrapper.sh from the install-openvpn module, which ignores the validity in older versions.", err.CommonName, err.Days, err.Expires.Format(time.RFC3339))
+}
@@ -0,0 +1,319 @@
+package app
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/urfave/cli"
+)
+
+// A self-service web UI, served by the process-requests daemon behind an ALB with OIDC authentication, that lets users
+// who don't have AWS credentials download, renew and revoke their own OpenVPN profile.
+type webPortal struct {
+	PublicKeys    *albPublicKeys
+	AlbArn        string
+	Issuer        string
+	UsernameClaim string
+	// If set, only claims that are addresses in one of these domains are accepted
+	AllowedDomains []string
+}
+
+type webPortalStatus struct {
+	Username string
+	Entry    *indexEntry
+	Message  string
+	Error    string
+}
+
+// Start the web portal in the background if --portal-listen-address is set. Otherwise, this is a no-op.
+func startWebPortal(cliContext *cli.Context) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	listenAddress := cliContext.String(OPTION_PORTAL_LISTEN_ADDRESS)
+	if listenAddress == "" {
+		return nil
+	}
+
+	awsRegion, err := getAwsRegion(cliContext)
+	if err != nil {
+		return err
+	}
+
+	// The keys are looked up by the kid of each token, unless one is pinned
+	publicKeys := newAlbPublicKeys(awsRegion)
+	if publicKeyPath := cliContext.String(OPTION_PORTAL_OIDC_PUBLIC_KEY); publicKeyPath != "" {
+		publicKeys.Pinned, err = readEcdsaPublicKey(publicKeyPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	portal := &webPortal{
+		PublicKeys:     publicKeys,
+		AlbArn:         cliContext.String(OPTION_PORTAL_ALB_ARN),
+		Issuer:         cliContext.String(OPTION_PORTAL_OIDC_ISSUER),
+		UsernameClaim:  cliContext.String(OPTION_PORTAL_USERNAME_CLAIM),
+		AllowedDomains: cliContext.StringSlice(OPTION_PORTAL_ALLOWED_DOMAIN),
+	}
+
+	// If the username rules drop the domain (e.g. strip-domain), alice@contractor.com would get the certificate of
+	// alice@corp.com, unless we know which domains to accept
+	if len(portal.AllowedDomains) == 0 && !strings.Contains(mapUsername("user@example.com"), "@") {
+		return errors.WithStackTrace(MissingPortalAllowedDomain)
+	}
+
+	server := &http.Server{Addr: listenAddress, Handler: portal.handler()}
+
+	go func() {
+		logger.Infof("Serving web portal on %s", listenAddress)
+		if err := server.ListenAndServe(); err != nil {
+			logger.Errorf("Web portal stopped: %s", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+func (portal *webPortal) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", portal.authenticated(portal.showStatus))
+	mux.HandleFunc("/download", portal.authenticated(portal.postOnly(portal.downloadProfile)))
+	mux.HandleFunc("/renew", portal.authenticated(portal.postOnly(portal.renewProfile)))
+	mux.HandleFunc("/revoke", portal.authenticated(portal.postOnly(portal.revokeProfile)))
+	return mux
+}
+
+// Wrap the given handler so it only runs for requests that carry a valid ALB OIDC token, passing it the username
+// derived from that token
+func (portal *webPortal) authenticated(handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		logger := logging.GetLogger(LOGGER_NAME)
+
+		claims, err := verifyAlbOidcData(request.Header.Get(ALB_OIDC_DATA_HEADER), portal.PublicKeys, portal.AlbArn, portal.Issuer)
+		if err != nil {
+			logger.Warnf("Rejecting web portal request from %s: %s", request.RemoteAddr, err.Error())
+			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		claim, isString := claims[portal.UsernameClaim].(string)
+		if !isString || claim == "" {
+			logger.Warnf("Rejecting web portal request from %s: token has no %s claim", request.RemoteAddr, portal.UsernameClaim)
+			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !portal.isAllowedDomain(claim) {
+			logger.Warnf("Rejecting web portal request from %s: %s is not in any of the domains in --%s", request.RemoteAddr, claim, OPTION_PORTAL_ALLOWED_DOMAIN)
+			http.Error(writer, "Your account can't be used for a certificate. Ask an administrator for help.", http.StatusForbidden)
+			return
+		}
+
+		// Use the username rules, so that the username matches the one used by the request command
+		username := mapUsername(claim)
+
+		if err := checkUsername(username); err != nil {
+			logger.Warnf("Rejecting web portal request from %s: %s", request.RemoteAddr, errors.Unwrap(err).Error())
+			http.Error(writer, "Your username can't be used for a certificate. Ask an administrator for help.", http.StatusForbidden)
+			return
+		}
+
+		handler(writer, request, username)
+	}
+}
+
+// Only allow same-origin POST requests through to the given handler. The ALB authenticates users with a session
+// cookie, so without the origin check another site could submit these forms on a user's behalf.
+func (portal *webPortal) postOnly(handler func(http.ResponseWriter, *http.Request, string)) func(http.ResponseWriter, *http.Request, string) {
+	return func(writer http.ResponseWriter, request *http.Request, username string) {
+		if request.Method != http.MethodPost {
+			http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if origin := request.Header.Get("Origin"); origin != "" {
+			originUrl, err := url.Parse(origin)
+			if err != nil || originUrl.Host != request.Host {
+				http.Error(writer, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		handler(writer, request, username)
+	}
+}
+
+func (portal *webPortal) showStatus(writer http.ResponseWriter, request *http.Request, username string) {
+	if request.URL.Path != "/" {
+		http.NotFound(writer, request)
+		return
+	}
+	portal.renderStatus(writer, username, "", nil)
+}
+
+// Send the user their current profile, issuing a new certificate first if they don't have a valid one
+func (portal *webPortal) downloadProfile(writer http.ResponseWriter, request *http.Request, username string) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	certificateExists, err := indexContainsValidCertificate(username)
+	if err != nil {
+		portal.renderStatus(writer, username, "", err)
+		return
+	}
+
+	var profile string
+	if certificateExists {
+		profile, err = generateCertificateTemplate(username)
+	} else if approvals != nil {
+		portal.requestApproval(writer, username, false)
+		return
+	} else {
+		logger.Infof("Issuing certificate for %s via web portal", username)
+		profile, err = issueCertificate(username, 0)
+	}
+
+	if err != nil {
+		portal.renderStatus(writer, username, "", err)
+		return
+	}
+
+	sendProfile(writer, username, profile)
+}
+
+func (portal *webPortal) renewProfile(writer http.ResponseWriter, request *http.Request, username string) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	if approvals != nil {
+		portal.requestApproval(writer, username, true)
+		return
+	}
+	logger.Infof("Renewing certificate for %s via web portal", username)
+
+	profile, err := renewCertificate(username)
+	if err != nil {
+		portal.renderStatus(writer, username, "", err)
+		return
+	}
+
+	sendProfile(writer, username, profile)
+}
+
+// With --require-approval, park a request for the user's certificate until an administrator approves it, unless one is
+// already waiting. Once it is approved, downloading the profile gets the new certificate.
+func (portal *webPortal) requestApproval(writer http.ResponseWriter, username string, renew bool) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	pending, err := approvals.FindUndecided(username)
+	if err == nil && pending == nil {
+		pending = &pendingRequest{Request: client.CertificateRequest{Username: username}, CommonName: username, Renew: renew, SubmittedAt: time.Now()}
+		pending.Request.RequestId, err = client.NewRequestId()
+		if err == nil {
+			err = approvals.Save(*pending)
+		}
+		if err == nil {
+			logger.Infof("Request %s for %s via web portal is waiting for approval", pending.Request.RequestId, username)
+		}
+	}
+
+	if err != nil {
+		portal.renderStatus(writer, username, "", err)
+		return
+	}
+
+	portal.renderStatus(writer, username, fmt.Sprintf("Your request %s is waiting for approval by an administrator. Come back to download your profile once it has been approved.", pending.Request.RequestId), nil)
+}
+
+func (portal *webPortal) revokeProfile(writer http.ResponseWriter, request *http.Request, username string) {
+	logger := logging.GetLogger(LOGGER_NAME)
+	logger.Infof("Revoking certificate for %s via web portal", username)
+
+	_, err := revokeUserCertificate(username)
+	portal.renderStatus(writer, username, fmt.Sprintf("The certificate for %s has been revoked.", username), err)
+}
+
+func (portal *webPortal) renderStatus(writer http.ResponseWriter, username string, message string, actionErr error) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	status := webPortalStatus{Username: username}
+	if actionErr != nil {
+		logger.Errorf("Web portal action for %s failed: %s", username, actionErr.Error())
+		status.Error = errors.Unwrap(actionErr).Error()
+	} else {
+		status.Message = message
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		logger.Errorf("Unable to read certificate index: %s", err.Error())
+		http.Error(writer, "Unable to read certificate status", http.StatusInternalServerError)
+		return
+	}
+	status.Entry = latestIndexEntryFor(entries, username)
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := webPortalTemplate.Execute(writer, status); err != nil {
+		logger.Errorf("Unable to render web portal: %s", err.Error())
+	}
+}
+
+func sendProfile(writer http.ResponseWriter, username string, profile string) {
+	writer.Header().Set("Content-Type", "application/x-openvpn-profile")
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+".ovpn"))
+	writer.Write([]byte(profile))
+}
+
+// Whether the given claim is an address in one of the allowed domains, or any claim at all if there are none
+func (portal *webPortal) isAllowedDomain(claim string) bool {
+	if len(portal.AllowedDomains) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(claim, "@")
+	if at < 0 {
+		return false
+	}
+
+	for _, domain := range portal.AllowedDomains {
+		if strings.EqualFold(claim[at+1:], domain) {
+			return true
+		}
+	}
+	return false
+}
+
+var webPortalTemplate = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html>
+<head><title>OpenVPN profile for {{.Username}}</title></head>
+<body>
+<h1>OpenVPN profile for {{.Username}}</h1>
+{{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{with .Entry}}
+<table>
+<tr><th align="left">Serial</th><td>{{.Serial}}</td></tr>
+<tr><th align="left">Status</th><td>{{if .IsValid}}Valid{{else if .IsRevoked}}Revoked{{else}}Expired{{end}}</td></tr>
+<tr><th align="left">Expires</th><td>{{.ExpirationDate.Format "2006-01-02 15:04 MST"}}</td></tr>
+{{if .IsRevoked}}<tr><th align="left">Revoked</th><td>{{.RevocationDate.Format "2006-01-02 15:04 MST"}}</td></tr>{{end}}
+</table>
+{{else}}
+<p>You do not have a certificate yet.</p>
+{{end}}
+<form method="post" action="/download"><button type="submit">Download profile</button></form>
+{{with .Entry}}{{if .IsValid}}
+<form method="post" action="/renew"><button type="submit">Renew certificate</button></form>
+<form method="post" action="/revoke" onsubmit="return confirm('Revoke your certificate?')"><button type="submit">Revoke certificate</button></form>
+{{end}}{{end}}
+</body>
+</html>
+`))
+
+// Custom errors
+
+var MissingPortalAllowedDomain = fmt.Errorf("--%s is required when the --%s rules remove the domain from usernames, so that users of other domains can't get the certificates of users with the same name", OPTION_PORTAL_ALLOWED_DOMAIN, OPTION_USERNAME_RULE)
@@ -0,0 +1,437 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+	"github.com/urfave/cli"
+)
+
+const DEFAULT_WEBHOOK_SPOOL_DIR = "/var/lib/openvpn-admin/webhooks"
+const DEFAULT_EXPIRY_WARNING_DAYS = 7
+
+const EVENT_CERTIFICATE_ISSUED = "certificate.issued"
+const EVENT_CERTIFICATE_RENEWED = "certificate.renewed"
+const EVENT_CERTIFICATE_REVOKED = "certificate.revoked"
+const EVENT_CERTIFICATE_EXPIRING = "certificate.expiring"
+const EVENT_REQUEST_DENIED = "request.denied"
+
+const WEBHOOK_FORMAT_JSON = "json"
+const WEBHOOK_FORMAT_SLACK = "slack"
+
+const WEBHOOK_TIMEOUT = 10 * time.Second
+
+// Failed deliveries are retried with exponential backoff between these bounds, until the event is older than
+// WEBHOOK_SPOOL_RETENTION, at which point it is dropped
+const WEBHOOK_MIN_BACKOFF = 10 * time.Second
+const WEBHOOK_MAX_BACKOFF = time.Hour
+const WEBHOOK_SPOOL_RETENTION = 7 * 24 * time.Hour
+
+// How often the spool is checked for deliveries that are due, when nothing new was spooled in the meantime
+const WEBHOOK_DELIVERY_INTERVAL = 10 * time.Second
+
+// A delivery claimed by a process that died before finishing it is taken over after this long
+const WEBHOOK_CLAIM_TIMEOUT = 5 * time.Minute
+
+const EXPIRY_CHECK_INTERVAL = time.Hour
+
+// Which certificates were reported as expiring, by serial, so each is only reported once. Kept in the spool directory.
+const EXPIRY_NOTIFICATIONS_FILE = "expiry-notifications.state"
+
+// Something that happened to a certificate, as sent to the webhooks. ID is unique to the event, so that receivers can
+// drop the duplicates retries may cause.
+type certificateEvent struct {
+	Id         string     `json:"id"`
+	Event      string     `json:"event"`
+	Time       time.Time  `json:"time"`
+	Host       string     `json:"host"`
+	CommonName string     `json:"common_name"`
+	Username   string     `json:"username"`
+	Device     string     `json:"device,omitempty"`
+	Serial     string     `json:"serial,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RequestId  string     `json:"request_id,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+}
+
+// A delivery of an event to one webhook, kept in the spool until it succeeds
+type spooledWebhook struct {
+	Url         string
+	Format      string
+	Event       certificateEvent
+	Attempts    int
+	NextAttempt time.Time
+}
+
+type webhookNotifier struct {
+	Urls      []string
+	SlackUrls []string
+	SpoolDir  string
+	Host      string
+
+	client *http.Client
+	wake   chan struct{}
+	// Only one delivery pass at a time within this process. Other processes sharing the spool are kept out by claims.
+	delivering sync.Mutex
+}
+
+// The webhooks to notify of certificate events, or nil if none are configured. See configureWebhooks.
+var webhooks *webhookNotifier
+
+// Set up the webhooks given by --webhook-url and --slack-webhook-url
+func configureWebhooks(cliContext *cli.Context) error {
+	urls := cliContext.StringSlice(OPTION_WEBHOOK_URL)
+	slackUrls := cliContext.StringSlice(OPTION_SLACK_WEBHOOK_URL)
+	if len(urls) == 0 && len(slackUrls) == 0 {
+		webhooks = nil
+		return nil
+	}
+
+	for _, url := range append(append([]string{}, urls...), slackUrls...) {
+		if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+			return errors.WithStackTrace(InvalidWebhookUrl(url))
+		}
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	webhooks = &webhookNotifier{
+		Urls:      urls,
+		SlackUrls: slackUrls,
+		SpoolDir:  cliContext.String(OPTION_WEBHOOK_SPOOL_DIR),
+		Host:      host,
+		client:    &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		wake:      make(chan struct{}, 1),
+	}
+	return nil
+}
+
+// Deliver spooled events in the background for the lifetime of a daemon. This is a no-op if no webhooks are
+// configured.
+func startWebhookDelivery() {
+	if webhooks == nil {
+		return
+	}
+
+	go func() {
+		for {
+			webhooks.deliver()
+			select {
+			case <-webhooks.wake:
+			case <-time.After(WEBHOOK_DELIVERY_INTERVAL):
+			}
+		}
+	}()
+}
+
+// Try to deliver spooled events once, e.g. before a command that doesn't run a daemon exits. Whatever can't be
+// delivered stays in the spool for the daemons on this server to retry.
+func flushWebhooks() {
+	if webhooks != nil {
+		webhooks.deliver()
+	}
+}
+
+// Notify the webhooks of an event concerning the certificate with the given common name. Unless a request was denied,
+// the serial and expiration date are filled in from the latest certificate with that name in the index. Failures are
+// logged rather than returned, as the change to the certificate has already been made.
+func notifyCertificateEvent(eventType string, commonName string, requestId string, reason string) {
+	if webhooks == nil {
+		return
+	}
+
+	event := certificateEvent{Event: eventType, CommonName: commonName, RequestId: requestId, Reason: reason}
+	if entries, err := readIndex(); err == nil && eventType != EVENT_REQUEST_DENIED {
+		if entry := latestIndexEntryFor(entries, commonName); entry != nil {
+			event.Serial = entry.Serial
+			event.ExpiresAt = &entry.ExpirationDate
+		}
+	}
+
+	webhooks.notify(event)
+}
+
+// Spool a delivery of the event to each webhook and wake up the delivery
+func (notifier *webhookNotifier) notify(event certificateEvent) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	id, err := client.NewRequestId()
+	if err != nil {
+		logger.Errorf("Unable to notify webhooks of %s for %s: %s", event.Event, event.CommonName, err.Error())
+		return
+	}
+	event.Id = id
+	event.Time = time.Now().UTC()
+	event.Host = notifier.Host
+	event.Username, event.Device = client.SplitCertificateName(event.CommonName)
+
+	deliveries := []spooledWebhook{}
+	for _, url := range notifier.Urls {
+		deliveries = append(deliveries, spooledWebhook{Url: url, Format: WEBHOOK_FORMAT_JSON, Event: event, NextAttempt: event.Time})
+	}
+	for _, url := range notifier.SlackUrls {
+		deliveries = append(deliveries, spooledWebhook{Url: url, Format: WEBHOOK_FORMAT_SLACK, Event: event, NextAttempt: event.Time})
+	}
+
+	for i, delivery := range deliveries {
+		path := filepath.Join(notifier.SpoolDir, fmt.Sprintf("%d-%s-%d.json", event.Time.UnixNano(), event.Id, i))
+		if err := notifier.save(path, delivery); err != nil {
+			logger.Errorf("Unable to spool %s for %s to %s: %s", event.Event, event.CommonName, delivery.Url, err.Error())
+		}
+	}
+
+	select {
+	case notifier.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Attempt every spooled delivery that is due, oldest first
+func (notifier *webhookNotifier) deliver() {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	notifier.delivering.Lock()
+	defer notifier.delivering.Unlock()
+
+	files, err := ioutil.ReadDir(notifier.SpoolDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logger.Errorf("Unable to read the webhook spool %s: %s", notifier.SpoolDir, err.Error())
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	for _, file := range files {
+		path := filepath.Join(notifier.SpoolDir, strings.TrimSuffix(file.Name(), ".sending"))
+		switch {
+		case file.IsDir():
+			continue
+		case strings.HasSuffix(file.Name(), ".json"):
+		case strings.HasSuffix(file.Name(), ".json.sending") && time.Since(file.ModTime()) > WEBHOOK_CLAIM_TIMEOUT:
+			logger.Warnf("Taking over the delivery of %s, which was abandoned", path)
+		default:
+			continue
+		}
+
+		if err := notifier.attempt(path, filepath.Join(notifier.SpoolDir, file.Name())); err != nil {
+			logger.Errorf("Unable to process spooled webhook %s: %s", path, err.Error())
+		}
+	}
+}
+
+// Claim the delivery in the given spool file, attempt it if it is due, and then remove it or put it back for a retry
+func (notifier *webhookNotifier) attempt(path string, currentPath string) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	// Another process may be delivering from the same spool, so claim the delivery by renaming it first
+	claimedPath := path + ".sending"
+	if err := os.Rename(currentPath, claimedPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStackTrace(err)
+	}
+	now := time.Now()
+	if err := os.Chtimes(claimedPath, now, now); err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	contents, err := ioutil.ReadFile(claimedPath)
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+	delivery := spooledWebhook{}
+	if err := json.Unmarshal(contents, &delivery); err != nil {
+		logger.Errorf("Dropping unreadable spooled webhook %s: %s", path, err.Error())
+		return errors.WithStackTrace(os.Remove(claimedPath))
+	}
+
+	if now.Before(delivery.NextAttempt) {
+		return errors.WithStackTrace(os.Rename(claimedPath, path))
+	}
+
+	err = notifier.post(delivery)
+	if err == nil {
+		logger.Debugf("Delivered %s for %s to %s", delivery.Event.Event, delivery.Event.CommonName, delivery.Url)
+		return errors.WithStackTrace(os.Remove(claimedPath))
+	}
+
+	delivery.Attempts++
+	if now.Sub(delivery.Event.Time) > WEBHOOK_SPOOL_RETENTION {
+		logger.Errorf("Giving up on delivering %s for %s to %s after %d attempts: %s", delivery.Event.Event, delivery.Event.CommonName, delivery.Url, delivery.Attempts, err.Error())
+		return errors.WithStackTrace(os.Remove(claimedPath))
+	}
+
+	delivery.NextAttempt = now.Add(webhookBackoff(delivery.Attempts))
+	logger.Warnf("Unable to deliver %s for %s to %s (attempt %d), retrying at %s: %s", delivery.Event.Event, delivery.Event.CommonName, delivery.Url, delivery.Attempts, delivery.NextAttempt.Format(time.RFC3339), err.Error())
+	if err := notifier.save(path, delivery); err != nil {
+		return err
+	}
+	return errors.WithStackTrace(os.Remove(claimedPath))
+}
+
+func (notifier *webhookNotifier) save(path string, delivery spooledWebhook) error {
+	contents, err := json.Marshal(delivery)
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+	return replaceFile(path, contents, 0600)
+}
+
+func (notifier *webhookNotifier) post(delivery spooledWebhook) error {
+	var payload interface{} = delivery.Event
+	if delivery.Format == WEBHOOK_FORMAT_SLACK {
+		payload = map[string]string{"text": slackMessage(delivery.Event)}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+
+	response, err := notifier.client.Post(delivery.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.WithStackTrace(fmt.Errorf("%s answered %s", delivery.Url, response.Status))
+	}
+	return nil
+}
+
+// Double the backoff with each attempt, from WEBHOOK_MIN_BACKOFF up to WEBHOOK_MAX_BACKOFF
+func webhookBackoff(attempts int) time.Duration {
+	backoff := WEBHOOK_MIN_BACKOFF
+	for i := 1; i < attempts && backoff < WEBHOOK_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > WEBHOOK_MAX_BACKOFF {
+		return WEBHOOK_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// A human readable description of the event for Slack, using its mrkdwn formatting
+func slackMessage(event certificateEvent) string {
+	var message string
+	switch event.Event {
+	case EVENT_CERTIFICATE_ISSUED:
+		message = fmt.Sprintf(":white_check_mark: Issued a certificate for *%s*", event.CommonName)
+	case EVENT_CERTIFICATE_RENEWED:
+		message = fmt.Sprintf(":arrows_counterclockwise: Renewed the certificate for *%s*", event.CommonName)
+	case EVENT_CERTIFICATE_REVOKED:
+		message = fmt.Sprintf(":no_entry: Revoked the certificate for *%s*", event.CommonName)
+	case EVENT_CERTIFICATE_EXPIRING:
+		message = fmt.Sprintf(":hourglass_flowing_sand: The certificate for *%s* expires soon", event.CommonName)
+	case EVENT_REQUEST_DENIED:
+		message = fmt.Sprintf(":x: Denied request %s for *%s*", event.RequestId, event.CommonName)
+	default:
+		message = fmt.Sprintf("%s for *%s*", event.Event, event.CommonName)
+	}
+
+	details := []string{}
+	if event.Serial != "" {
+		details = append(details, "serial "+event.Serial)
+	}
+	if event.ExpiresAt != nil && event.Event != EVENT_CERTIFICATE_REVOKED {
+		details = append(details, "expires "+event.ExpiresAt.Format("2006-01-02 15:04 MST"))
+	}
+	details = append(details, "on "+event.Host)
+	message = fmt.Sprintf("%s (%s)", message, strings.Join(details, ", "))
+
+	if event.Reason != "" {
+		message += ": " + event.Reason
+	}
+	return message
+}
+
+// Report the valid certificates that expire within --expiry-warning-days to the webhooks, every EXPIRY_CHECK_INTERVAL,
+// in the background, for the lifetime of the process-requests daemon. This is a no-op if no webhooks are configured or
+// the warning is disabled. If leader is not nil, standbys skip the check.
+func startExpiryNotifications(cliContext *cli.Context, leader *leaderElection) {
+	warningDays := cliContext.Int(OPTION_EXPIRY_WARNING_DAYS)
+	if webhooks == nil || warningDays <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			if leader == nil || leader.IsLeader() {
+				if err := notifyExpiringCertificates(time.Duration(warningDays) * DAY); err != nil {
+					logging.GetLogger(LOGGER_NAME).Errorf("Unable to check for expiring certificates: %s", err.Error())
+				}
+			}
+			time.Sleep(EXPIRY_CHECK_INTERVAL)
+		}
+	}()
+}
+
+// Notify the webhooks of each valid certificate that expires within the given warning period, once per certificate
+func notifyExpiringCertificates(warning time.Duration) error {
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(webhooks.SpoolDir, EXPIRY_NOTIFICATIONS_FILE)
+	notified := map[string]time.Time{}
+	contents, err := ioutil.ReadFile(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStackTrace(err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(contents, &notified); err != nil {
+			return errors.WithStackTraceAndPrefix(err, "Unable to parse %s", statePath)
+		}
+	}
+
+	current := map[string]time.Time{}
+	for _, entry := range entries {
+		if !entry.IsValid() || !entry.IsUserCertificate() || time.Until(entry.ExpirationDate) > warning {
+			continue
+		}
+
+		if notifiedAt, wasNotified := notified[entry.Serial]; wasNotified {
+			current[entry.Serial] = notifiedAt
+			continue
+		}
+
+		expiresAt := entry.ExpirationDate
+		webhooks.notify(certificateEvent{Event: EVENT_CERTIFICATE_EXPIRING, CommonName: entry.CommonName, Serial: entry.Serial, ExpiresAt: &expiresAt})
+		current[entry.Serial] = time.Now()
+	}
+
+	// Certificates that are no longer valid are dropped from the state
+	contents, err = json.Marshal(current)
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+	return replaceFile(statePath, contents, 0600)
+}
+
+// Custom errors
+
+type InvalidWebhookUrl string
+
+func (err InvalidWebhookUrl) Error() string {
+	return fmt.Sprintf("%s is not a valid webhook URL. It must start with https:// or http://.", string(err))
+}
@@ -0,0 +1,213 @@
+package aws_helpers
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+)
+
+const DEFAULT_MAX_RETRIES = 5
+const DEFAULT_MIN_RETRY_DELAY = 100 * time.Millisecond
+const DEFAULT_MAX_RETRY_DELAY = 20 * time.Second
+
+// SQS long polls take up to 20 seconds, so the request timeout must be well above that
+const DEFAULT_REQUEST_TIMEOUT = time.Minute
+
+// How the AWS API is called
+type ClientOptions struct {
+	// How often a throttled, failed (5xx) or timed out request is retried
+	MaxRetries int
+
+	// The delay before the first retry is about MinRetryDelay and doubles with every retry, up to MaxRetryDelay
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+
+	// How long a single HTTP request may take. 0 means no limit.
+	RequestTimeout time.Duration
+
+	// If set, send all requests to this URL instead of the AWS endpoints, e.g. http://localhost:4566 for LocalStack or
+	// http://localhost:9324 for ElasticMQ
+	EndpointUrl string
+
+	// The named profile in ~/.aws/config and ~/.aws/credentials to use. Profiles may assume roles themselves (role_arn
+	// and source_profile), including with MFA (mfa_serial).
+	Profile string
+
+	// If set, assume this IAM role on top of the credentials found, e.g. to use queues in another account
+	RoleArn    string
+	ExternalId string
+
+	// If set, the serial number or ARN of the MFA device required to assume RoleArn. The token is prompted for on the
+	// terminal.
+	MfaSerial string
+}
+
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		MaxRetries:     DEFAULT_MAX_RETRIES,
+		MinRetryDelay:  DEFAULT_MIN_RETRY_DELAY,
+		MaxRetryDelay:  DEFAULT_MAX_RETRY_DELAY,
+		RequestTimeout: DEFAULT_REQUEST_TIMEOUT,
+	}
+}
+
+// A long-lived client for the AWS API, which all functions in this package are methods of. It creates one session per
+// region and reuses it, and with it the credentials, for every call, rather than looking up credentials on each call.
+// Create one with NewAwsClient and share it; clients with different options can be used side by side.
+type AwsClient struct {
+	Options ClientOptions
+
+	mutex    sync.Mutex
+	sessions map[string]*session.Session
+	// Shared by the sessions of all regions, so that e.g. an MFA token is only asked for once
+	credentials *credentials.Credentials
+}
+
+func NewAwsClient(options ClientOptions) *AwsClient {
+	return &AwsClient{
+		Options:  options,
+		sessions: map[string]*session.Session{},
+	}
+}
+
+// Return the session for the given region, creating it on first use
+func (awsClient *AwsClient) Session(awsRegion string) (*session.Session, error) {
+	awsClient.mutex.Lock()
+	defer awsClient.mutex.Unlock()
+
+	if sess, exists := awsClient.sessions[awsRegion]; exists {
+		return sess, nil
+	}
+
+	sess, err := awsClient.newSession(awsRegion, NO_IAM_ROLE, awsClient.credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	awsClient.sessions[awsRegion] = sess
+	awsClient.credentials = sess.Config.Credentials
+	return sess, nil
+}
+
+// Create a new session in the given region with the settings of this client and check that credentials are present.
+// If roleArn is not empty, assume the specified IAM role instead of the one in the client options.
+func (awsClient *AwsClient) NewSession(awsRegion string, roleArn string) (*session.Session, error) {
+	return awsClient.newSession(awsRegion, roleArn, nil)
+}
+
+// Create a new session, using the given credentials if not nil
+func (awsClient *AwsClient) newSession(awsRegion string, roleArn string, creds *credentials.Credentials) (*session.Session, error) {
+	options := awsClient.Options
+
+	sessionOptions := session.Options{
+		Config:  *awsClient.config(awsRegion),
+		Profile: options.Profile,
+		// Prompts for the MFA token of profiles that assume a role with mfa_serial
+		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
+	}
+	if options.Profile != "" {
+		// Roles and MFA devices of profiles are configured in ~/.aws/config, which the SDK only reads when told to
+		sessionOptions.SharedConfigState = session.SharedConfigEnable
+	}
+
+	sess, err := session.NewSessionWithOptions(sessionOptions)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	if roleArn == "" {
+		roleArn = options.RoleArn
+	}
+
+	if creds != nil {
+		sess.Config.Credentials = creds
+	} else if roleArn != "" {
+		logging.GetLogger(LOGGER_NAME).Debugf("Assuming IAM role %s", roleArn)
+		sess.Config.Credentials = stscreds.NewCredentials(sess, roleArn, func(provider *stscreds.AssumeRoleProvider) {
+			if options.ExternalId != "" {
+				provider.ExternalID = aws.String(options.ExternalId)
+			}
+			if options.MfaSerial != "" {
+				provider.SerialNumber = aws.String(options.MfaSerial)
+				provider.TokenProvider = stscreds.StdinTokenProvider
+			}
+		})
+	}
+
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		return nil, errors.WithStackTraceAndPrefix(err, "Error finding AWS credentials (did you set the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables, or --profile?)")
+	}
+
+	return sess, nil
+}
+
+func (awsClient *AwsClient) config(awsRegion string) *aws.Config {
+	options := awsClient.Options
+
+	config := aws.NewConfig().
+		WithRegion(awsRegion).
+		WithHTTPClient(&http.Client{Timeout: options.RequestTimeout})
+
+	if options.EndpointUrl != "" {
+		logging.GetLogger(LOGGER_NAME).Debugf("Sending AWS requests to %s", options.EndpointUrl)
+		// Local stand-ins serve every bucket from the same host, so bucket names must go in the path
+		config = config.WithEndpoint(options.EndpointUrl).WithS3ForcePathStyle(true)
+	}
+
+	return request.WithRetryer(config, backoffRetryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: options.MaxRetries},
+		minDelay:       options.MinRetryDelay,
+		maxDelay:       options.MaxRetryDelay,
+	})
+}
+
+// Retries the same requests as the SDK's default retryer, but with our own exponential backoff bounds. Each delay is
+// picked at random from the upper half of the current backoff window, so that servers retrying at the same time (e.g.
+// after SQS throttled all of them) spread out.
+type backoffRetryer struct {
+	client.DefaultRetryer
+	minDelay time.Duration
+	maxDelay time.Duration
+}
+
+func (retryer backoffRetryer) RetryRules(req *request.Request) time.Duration {
+	return BackoffDelay(retryer.minDelay, retryer.maxDelay, req.RetryCount)
+}
+
+// Return how long to wait before the given (zero based) retry: minDelay doubled for every earlier retry, capped at
+// maxDelay, and picked at random from the upper half of that window
+func BackoffDelay(minDelay time.Duration, maxDelay time.Duration, retry int) time.Duration {
+	delay := maxDelay
+	if retry < 32 {
+		if backoff := minDelay << uint(retry); backoff > 0 && backoff < delay {
+			delay = backoff
+		}
+	}
+
+	if delay <= 1 {
+		return delay
+	}
+
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Drop the cached session of the given region and the shared credentials, so that the next call creates a new session
+// and looks up credentials again, e.g. after the credentials expired
+func (awsClient *AwsClient) RefreshCredentials(awsRegion string) {
+	awsClient.mutex.Lock()
+	defer awsClient.mutex.Unlock()
+
+	delete(awsClient.sessions, awsRegion)
+	awsClient.credentials = nil
+}
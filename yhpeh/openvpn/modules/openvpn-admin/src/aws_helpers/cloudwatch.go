@@ -0,0 +1,47 @@
+package aws_helpers
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+)
+
+// Publish a single data point for a custom CloudWatch metric. The dimensions map dimension names to values.
+func (awsClient *AwsClient) PutMetric(awsRegion string, namespace string, metricName string, value float64, unit string, dimensions map[string]string) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+	logger.Debugf("Publishing metric %s/%s = %f", namespace, metricName, value)
+
+	cloudwatchClient, err := awsClient.CreateCloudWatchClient(awsRegion)
+	if err != nil {
+		return err
+	}
+
+	datum := &cloudwatch.MetricDatum{
+		MetricName: aws.String(metricName),
+		Value:      aws.Float64(value),
+		Unit:       aws.String(unit),
+	}
+
+	for name, dimensionValue := range dimensions {
+		datum.Dimensions = append(datum.Dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(dimensionValue),
+		})
+	}
+
+	_, err = cloudwatchClient.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(namespace),
+		MetricData: []*cloudwatch.MetricDatum{datum},
+	})
+	return errors.WithStackTrace(err)
+}
+
+func (awsClient *AwsClient) CreateCloudWatchClient(awsRegion string) (*cloudwatch.CloudWatch, error) {
+	sess, err := awsClient.Session(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	return cloudwatch.New(sess), nil
+}
@@ -0,0 +1,89 @@
+package aws_helpers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+)
+
+// Take or extend a lease on the named lock. The table must have a string partition key called LockName. Returns false
+// if another owner holds a lease that has not expired yet. Leases expire based on the local clock of each owner, so
+// the lease duration should be much longer than the expected clock skew between servers.
+func (awsClient *AwsClient) AcquireLease(awsRegion string, tableName string, lockName string, owner string, duration time.Duration) (bool, error) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	dynamoDbClient, err := awsClient.CreateDynamoDbClient(awsRegion)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+
+	_, err = dynamoDbClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockName":  {S: aws.String(lockName)},
+			"Owner":     {S: aws.String(owner)},
+			"ExpiresAt": {N: aws.String(strconv.FormatInt(now.Add(duration).UnixNano()/int64(time.Millisecond), 10))},
+		},
+		// Owner is a reserved word in DynamoDB expressions
+		ConditionExpression:      aws.String("attribute_not_exists(LockName) OR ExpiresAt < :now OR #owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{"#owner": aws.String("Owner")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":   {N: aws.String(strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10))},
+			":owner": {S: aws.String(owner)},
+		},
+	})
+
+	if isConditionalCheckFailed(err) {
+		logger.Debugf("Lock %s is held by another owner", lockName)
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.WithStackTrace(err)
+	}
+
+	return true, nil
+}
+
+// Give up a lease on the named lock, if it is still held by the given owner
+func (awsClient *AwsClient) ReleaseLease(awsRegion string, tableName string, lockName string, owner string) error {
+	dynamoDbClient, err := awsClient.CreateDynamoDbClient(awsRegion)
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamoDbClient.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:                 aws.String(tableName),
+		Key:                       map[string]*dynamodb.AttributeValue{"LockName": {S: aws.String(lockName)}},
+		ConditionExpression:       aws.String("#owner = :owner"),
+		ExpressionAttributeNames:  map[string]*string{"#owner": aws.String("Owner")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":owner": {S: aws.String(owner)}},
+	})
+
+	// The lease already expired and was taken over by someone else, so there is nothing to release
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+
+	return errors.WithStackTrace(err)
+}
+
+func isConditionalCheckFailed(err error) bool {
+	awsErr, isAwsErr := err.(awserr.Error)
+	return isAwsErr && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func (awsClient *AwsClient) CreateDynamoDbClient(awsRegion string) (*dynamodb.DynamoDB, error) {
+	sess, err := awsClient.Session(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamodb.New(sess), nil
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/gruntwork-io/gruntwork-cli/errors"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 )
 
 type PolicyDocument struct {
@@ -23,46 +22,58 @@ type StatementEntry struct {
 const NO_IAM_ROLE = ""
 
 // Create an AWS Session object in the given region and check that credentials are present. If roleArn is not empty,
-// assume the specified IAM role.
-func CreateAwsSession(awsRegion string, roleArn string) (*session.Session, error) {
-	sess, err := session.NewSession()
-	if err != nil {
-		return nil, errors.WithStackTrace(err)
-	}
-
-	sess.Config.Region = aws.String(awsRegion)
+// assume the specified IAM role. The session uses the settings of this client.
+func (awsClient *AwsClient) CreateAwsSession(awsRegion string, roleArn string) (*session.Session, error) {
+	return awsClient.NewSession(awsRegion, roleArn)
+}
 
-	if roleArn != "" {
-		sess.Config.Credentials = stscreds.NewCredentials(sess, roleArn)
+// Return the names of all IAM users in the account
+func (awsClient *AwsClient) ListIamUserNames(awsRegion string) ([]string, error) {
+	iamClient, err := awsClient.createIamClient(awsRegion)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := sess.Config.Credentials.Get(); err != nil {
-		return nil, errors.WithStackTraceAndPrefix(err, "Error finding AWS credentials (did you set the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables?)")
+	userNames := []string{}
+	err = iamClient.ListUsersPages(&iam.ListUsersInput{}, func(page *iam.ListUsersOutput, lastPage bool) bool {
+		for _, user := range page.Users {
+			userNames = append(userNames, aws.StringValue(user.UserName))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
 	}
 
-	return sess, nil
+	return userNames, nil
 }
 
-func GetIamUserName(awsRegion string) (string, error) {
-
-	iamClient, err := createIamClient(awsRegion)
+// Return the names of all IAM users that are members of the given IAM group
+func (awsClient *AwsClient) ListIamGroupMemberNames(awsRegion string, groupName string) ([]string, error) {
+	iamClient, err := awsClient.createIamClient(awsRegion)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	resp, err := iamClient.GetUser(&iam.GetUserInput{})
+	userNames := []string{}
+	err = iamClient.GetGroupPages(&iam.GetGroupInput{GroupName: aws.String(groupName)}, func(page *iam.GetGroupOutput, lastPage bool) bool {
+		for _, user := range page.Users {
+			userNames = append(userNames, aws.StringValue(user.UserName))
+		}
+		return true
+	})
 	if err != nil {
-		return "", err
+		return nil, errors.WithStackTrace(err)
 	}
 
-	return *resp.User.UserName, nil
+	return userNames, nil
 }
 
-func createIamClient(awsRegion string) (*iam.IAM, error) {
-	sess, err := CreateAwsSession(awsRegion, NO_IAM_ROLE)
+func (awsClient *AwsClient) createIamClient(awsRegion string) (*iam.IAM, error) {
+	sess, err := awsClient.Session(awsRegion)
 	if err != nil {
 		return nil, err
 	}
 
 	return iam.New(sess), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,246 @@
+package aws_helpers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+)
+
+// Split an S3 URI of the form s3://bucket/path/to/key into its bucket and key
+func ParseS3Uri(uri string) (string, string, error) {
+	if !strings.HasPrefix(uri, "s3://") {
+		return "", "", errors.WithStackTrace(InvalidS3Uri(uri))
+	}
+
+	bucketAndKey := strings.SplitN(strings.TrimPrefix(uri, "s3://"), "/", 2)
+	if len(bucketAndKey) != 2 || bucketAndKey[0] == "" || bucketAndKey[1] == "" {
+		return "", "", errors.WithStackTrace(InvalidS3Uri(uri))
+	}
+
+	return bucketAndKey[0], bucketAndKey[1], nil
+}
+
+// Upload the given contents to S3. If kmsKeyId is not empty, the object is encrypted with that KMS key.
+func (awsClient *AwsClient) PutS3Object(awsRegion string, bucket string, key string, contents []byte, contentType string, kmsKeyId string) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+	logger.Debugf("Uploading %d bytes to s3://%s/%s", len(contents), bucket, key)
+
+	s3Client, err := awsClient.CreateS3Client(awsRegion)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(contents),
+		ContentType: aws.String(contentType),
+	}
+
+	if kmsKeyId != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(kmsKeyId)
+	}
+
+	_, err = s3Client.PutObject(input)
+	return errors.WithStackTrace(err)
+}
+
+// Download the contents of an S3 object
+func (awsClient *AwsClient) GetS3Object(awsRegion string, bucket string, key string) ([]byte, error) {
+	logger := logging.GetLogger(LOGGER_NAME)
+	logger.Debugf("Downloading s3://%s/%s", bucket, key)
+
+	s3Client, err := awsClient.CreateS3Client(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+	defer output.Body.Close()
+
+	contents, err := ioutil.ReadAll(output.Body)
+	return contents, errors.WithStackTrace(err)
+}
+
+// Return the key of the most recently modified object under the given prefix whose key ends with suffix
+func (awsClient *AwsClient) FindLatestS3Object(awsRegion string, bucket string, prefix string, suffix string) (string, error) {
+	s3Client, err := awsClient.CreateS3Client(awsRegion)
+	if err != nil {
+		return "", err
+	}
+
+	var latest *s3.Object
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	err = s3Client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if !strings.HasSuffix(aws.StringValue(object.Key), suffix) {
+				continue
+			}
+			if latest == nil || aws.TimeValue(object.LastModified).After(aws.TimeValue(latest.LastModified)) {
+				latest = object
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+
+	if latest == nil {
+		return "", errors.WithStackTrace(NoS3ObjectsFound{Bucket: bucket, Prefix: prefix, Suffix: suffix})
+	}
+
+	return aws.StringValue(latest.Key), nil
+}
+
+// Download the contents of an S3 object along with its ETag
+func (awsClient *AwsClient) GetS3ObjectWithEtag(awsRegion string, bucket string, key string) ([]byte, string, error) {
+	s3Client, err := awsClient.CreateS3Client(awsRegion)
+	if err != nil {
+		return nil, "", err
+	}
+
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, "", errors.WithStackTrace(err)
+	}
+	defer output.Body.Close()
+
+	contents, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", errors.WithStackTrace(err)
+	}
+
+	return contents, aws.StringValue(output.ETag), nil
+}
+
+// Return the ETag of every object under the given prefix, keyed by object key
+func (awsClient *AwsClient) ListS3ObjectEtags(awsRegion string, bucket string, prefix string) (map[string]string, error) {
+	s3Client, err := awsClient.CreateS3Client(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	etags := map[string]string{}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	err = s3Client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			etags[aws.StringValue(object.Key)] = aws.StringValue(object.ETag)
+		}
+		return true
+	})
+
+	return etags, errors.WithStackTrace(err)
+}
+
+// Upload an object only if it has not changed since it was read, i.e. its ETag still matches the given one. If etag is
+// empty, the object is only uploaded if it does not exist yet. Returns the ETag of the new object, or S3ObjectChanged
+// if someone else wrote the object in the meantime.
+func (awsClient *AwsClient) PutS3ObjectIfMatch(awsRegion string, bucket string, key string, contents []byte, kmsKeyId string, etag string) (string, error) {
+	logger := logging.GetLogger(LOGGER_NAME)
+	logger.Debugf("Uploading %d bytes to s3://%s/%s (if-match %s)", len(contents), bucket, key, etag)
+
+	s3Client, err := awsClient.CreateS3Client(awsRegion)
+	if err != nil {
+		return "", err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(contents),
+	}
+
+	if kmsKeyId != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(kmsKeyId)
+	}
+
+	// The conditional write headers are not modelled by this version of the SDK, so they are set on the request directly
+	request, output := s3Client.PutObjectRequest(input)
+	if etag == "" {
+		request.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		request.HTTPRequest.Header.Set("If-Match", etag)
+	}
+
+	err = request.Send()
+	if requestFailure, isRequestFailure := err.(awserr.RequestFailure); isRequestFailure {
+		// 412 means the precondition failed, 409 that a concurrent conditional write won
+		if requestFailure.StatusCode() == 412 || requestFailure.StatusCode() == 409 {
+			return "", errors.WithStackTrace(S3ObjectChanged{Bucket: bucket, Key: key})
+		}
+	}
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+
+	return aws.StringValue(output.ETag), nil
+}
+
+// Whether the given error means the S3 object does not exist
+func IsS3ObjectMissing(err error) bool {
+	awsErr, isAwsErr := errors.Unwrap(err).(awserr.Error)
+	return isAwsErr && awsErr.Code() == s3.ErrCodeNoSuchKey
+}
+
+func (awsClient *AwsClient) CreateS3Client(awsRegion string) (*s3.S3, error) {
+	sess, err := awsClient.Session(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.New(sess), nil
+}
+
+// Custom errors
+
+type InvalidS3Uri string
+
+func (err InvalidS3Uri) Error() string {
+	return fmt.Sprintf("Expected an S3 URI of the form s3://bucket/key but got '%s'", string(err))
+}
+
+type NoS3ObjectsFound struct {
+	Bucket string
+	Prefix string
+	Suffix string
+}
+
+func (err NoS3ObjectsFound) Error() string {
+	return fmt.Sprintf("No objects ending in %s found in s3://%s/%s", err.Suffix, err.Bucket, err.Prefix)
+}
+
+type S3ObjectChanged struct {
+	Bucket string
+	Key    string
+}
+
+func (err S3ObjectChanged) Error() string {
+	return fmt.Sprintf("s3://%s/%s was changed by someone else since it was read", err.Bucket, err.Key)
+}
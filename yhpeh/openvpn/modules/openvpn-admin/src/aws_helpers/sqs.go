@@ -1,6 +1,7 @@
 package aws_helpers
 
 import (
+	"context"
 	"github.com/gruntwork-io/gruntwork-cli/logging"
 	"github.com/google/uuid"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -9,15 +10,16 @@ import (
 	"strconv"
 	"strings"
 	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 )
 
 const LOGGER_NAME = "aws_helper"
 
-func CreateRandomQueue(awsRegion string, prefix string) (string, error) {
+func (awsClient *AwsClient) CreateRandomQueue(awsRegion string, prefix string) (string, error) {
 	logger := logging.GetLogger(LOGGER_NAME)
 	logger.Debugf("Creating randomly named SQS queue with prefix %s", prefix)
 
-	sqsClient, err := CreateSqsClient(awsRegion)
+	sqsClient, err := awsClient.CreateSqsClient(awsRegion)
 	if err != nil {
 		return "", err
 	}
@@ -40,11 +42,11 @@ func CreateRandomQueue(awsRegion string, prefix string) (string, error) {
 	return *queue.QueueUrl, nil;
 }
 
-func DeleteQueue(awsRegion string, queueUrl string) (error) {
+func (awsClient *AwsClient) DeleteQueue(awsRegion string, queueUrl string) (error) {
 	logger := logging.GetLogger(LOGGER_NAME)
 	logger.Debugf("Deleting SQS Queue %s", queueUrl)
 
-	sqsClient, err := CreateSqsClient(awsRegion)
+	sqsClient, err := awsClient.CreateSqsClient(awsRegion)
 	if err != nil {
 		return err
 	}
@@ -59,11 +61,11 @@ func DeleteQueue(awsRegion string, queueUrl string) (error) {
 	return nil
 }
 
-func DeleteMessageFromQueue(awsRegion string, queueUrl string, receipt string) (error) {
+func (awsClient *AwsClient) DeleteMessageFromQueue(awsRegion string, queueUrl string, receipt string) (error) {
 	logger := logging.GetLogger(LOGGER_NAME)
 	logger.Debugf("Deleting message from queue %s (%s)", queueUrl, receipt)
 
-	sqsClient, err := CreateSqsClient(awsRegion)
+	sqsClient, err := awsClient.CreateSqsClient(awsRegion)
 	if err != nil {
 		return err
 	}
@@ -79,10 +81,10 @@ func DeleteMessageFromQueue(awsRegion string, queueUrl string, receipt string) (
 	return nil
 }
 
-func SendMessageToQueue(awsRegion string, queueUrl string, message string) (error) {
+func (awsClient *AwsClient) SendMessageToQueue(awsRegion string, queueUrl string, message string) (error) {
 	logger := logging.GetLogger(LOGGER_NAME)
 
-	sqsClient, err := CreateSqsClient(awsRegion)
+	sqsClient, err := awsClient.CreateSqsClient(awsRegion)
 	if err != nil {
 		return err
 	}
@@ -105,8 +107,8 @@ func SendMessageToQueue(awsRegion string, queueUrl string, message string) (erro
 	return nil
 }
 
-func CreateSqsClient(awsRegion string) (*sqs.SQS, error) {
-	sess, err := CreateAwsSession(awsRegion, NO_IAM_ROLE)
+func (awsClient *AwsClient) CreateSqsClient(awsRegion string) (*sqs.SQS, error) {
+	sess, err := awsClient.Session(awsRegion)
 	if err != nil {
 		return nil, err
 	}
@@ -116,12 +118,18 @@ func CreateSqsClient(awsRegion string) (*sqs.SQS, error) {
 
 // Waits to receive a message from on the queueUrl. Since the API only allows us to wait a max 20 seconds for a new
 // message to arrive, we must loop TIMEOUT/20 number of times to be able to wait for a total of TIMEOUT seconds
-func WaitForQueueMessage(awsRegion string, queueUrl string, timeout int) (string, string, error) {
+func (awsClient *AwsClient) WaitForQueueMessage(awsRegion string, queueUrl string, timeout int) (string, string, error) {
+	return awsClient.WaitForQueueMessageWithContext(context.Background(), awsRegion, queueUrl, timeout)
+}
+
+// Like WaitForQueueMessage, but stops waiting as soon as ctx is cancelled or its deadline passes, and returns ctx.Err()
+func (awsClient *AwsClient) WaitForQueueMessageWithContext(ctx context.Context, awsRegion string, queueUrl string, timeout int) (string, string, error) {
 	logger := logging.GetLogger(LOGGER_NAME)
 
-	sqsClient, err := CreateSqsClient(awsRegion)
+	sqsClient, err := awsClient.CreateSqsClient(awsRegion)
 	if err != nil {
-		return "", "", err
+		// Creating the client only fails if there are no (valid) credentials
+		return "", "", errors.WithStackTrace(QueueAuthFailed{QueueUrl: queueUrl, Err: err})
 	}
 
 	cycles := timeout;
@@ -134,7 +142,8 @@ func WaitForQueueMessage(awsRegion string, queueUrl string, timeout int) (string
 
 	for i := 0; i < cycles; i++ {
 		logger.Debugf("Waiting for message on %s (%ss)", queueUrl, strconv.Itoa(i * cycleLength))
-		result, err := sqsClient.ReceiveMessage(&sqs.ReceiveMessageInput{
+		// Cancelling ctx aborts the long poll itself, so SQS can't hand us a message that nobody will read
+		result, err := sqsClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
 			QueueUrl: aws.String(queueUrl),
 			AttributeNames: aws.StringSlice([]string{
 				"SentTimestamp",
@@ -146,8 +155,11 @@ func WaitForQueueMessage(awsRegion string, queueUrl string, timeout int) (string
 			WaitTimeSeconds: aws.Int64(int64(cycleLength)),
 		})
 
+		if ctx.Err() != nil {
+			return "", "", errors.WithStackTrace(ctx.Err())
+		}
 		if err != nil {
-			return "", "", err
+			return "", "", errors.WithStackTrace(classifyQueueError(queueUrl, err))
 		}
 
 		if len(result.Messages) > 0 {
@@ -156,19 +168,139 @@ func WaitForQueueMessage(awsRegion string, queueUrl string, timeout int) (string
 		}
 	}
 
-	return "", "", fmt.Errorf("Failed to receive messages on %s within %s seconds", queueUrl, strconv.Itoa(timeout))
+	return "", "", errors.WithStackTrace(QueueReceiveTimeout{QueueUrl: queueUrl, Timeout: timeout})
+}
+
+// SQS error codes that mean the caller is sending requests too fast
+var sqsThrottlingErrorCodes = []string{"Throttling", "ThrottlingException", "RequestThrottled", "OverLimit"}
+
+// SQS error codes that mean the credentials are missing, expired or not allowed to use the queue
+var sqsAuthErrorCodes = []string{"ExpiredToken", "ExpiredTokenException", "InvalidClientTokenId", "UnrecognizedClientException", "SignatureDoesNotMatch", "AccessDenied", "AccessDeniedException", "NoCredentialProviders"}
+
+// SQS error codes that mean the queue does not exist (any more)
+var sqsQueueMissingErrorCodes = []string{"AWS.SimpleQueueService.NonExistentQueue", "QueueDoesNotExist"}
+
+// Turn an error from the SQS API into one of QueueThrottled, QueueAuthFailed, QueueMissing or QueueUnavailable
+func classifyQueueError(queueUrl string, err error) error {
+	awsErr, isAwsErr := err.(awserr.Error)
+	if !isAwsErr {
+		return QueueUnavailable{QueueUrl: queueUrl, Err: err}
+	}
+
+	switch {
+	case containsString(sqsThrottlingErrorCodes, awsErr.Code()):
+		return QueueThrottled{QueueUrl: queueUrl, Err: err}
+	case containsString(sqsAuthErrorCodes, awsErr.Code()):
+		return QueueAuthFailed{QueueUrl: queueUrl, Err: err}
+	case containsString(sqsQueueMissingErrorCodes, awsErr.Code()):
+		return QueueMissing{QueueUrl: queueUrl}
+	default:
+		return QueueUnavailable{QueueUrl: queueUrl, Err: err}
+	}
 }
 
-func FindQueuesWithNamePrefix(awsRegion string, namePrefix string) ([]string, error) {
-	sqsClient, err := CreateSqsClient(awsRegion)
+// Whether the given error means the credentials are not allowed to make the call
+func IsAccessDenied(err error) bool {
+	awsErr, isAwsErr := errors.Unwrap(err).(awserr.Error)
+	return isAwsErr && (awsErr.Code() == "AccessDenied" || awsErr.Code() == "AccessDeniedException")
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// The most queues ListQueues returns per page
+const LIST_QUEUES_PAGE_SIZE = 1000
+
+// Return the URLs of all queues whose name starts with the given prefix, which may be empty to list every queue.
+// Without a page size, ListQueues silently stops at 1000 queues, so this asks for pages and follows them to the end.
+func (awsClient *AwsClient) FindQueuesWithNamePrefix(awsRegion string, namePrefix string) ([]string, error) {
+	sqsClient, err := awsClient.CreateSqsClient(awsRegion)
 	if err != nil {
 		return nil, err
 	}
 
-	output, err := sqsClient.ListQueues(&sqs.ListQueuesInput{QueueNamePrefix: aws.String(namePrefix)})
+	input := &sqs.ListQueuesInput{MaxResults: aws.Int64(LIST_QUEUES_PAGE_SIZE)}
+	if namePrefix != "" {
+		input.QueueNamePrefix = aws.String(namePrefix)
+	}
+
+	queueUrls := []string{}
+	err = sqsClient.ListQueuesPages(input, func(output *sqs.ListQueuesOutput, lastPage bool) bool {
+		queueUrls = append(queueUrls, aws.StringValueSlice(output.QueueUrls)...)
+		return true
+	})
 	if err != nil {
 		return nil, errors.WithStackTrace(err)
 	}
 
-	return aws.StringValueSlice(output.QueueUrls), nil
-}
\ No newline at end of file
+	return queueUrls, nil
+}
+
+// Return the tags of the given queue
+func (awsClient *AwsClient) GetQueueTags(awsRegion string, queueUrl string) (map[string]string, error) {
+	sqsClient, err := awsClient.CreateSqsClient(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := sqsClient.ListQueueTags(&sqs.ListQueueTagsInput{QueueUrl: aws.String(queueUrl)})
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+
+	return aws.StringValueMap(output.Tags), nil
+}
+
+// Custom errors
+
+// No message arrived within the timeout. This is not a failure: the queue is simply idle.
+type QueueReceiveTimeout struct {
+	QueueUrl string
+	Timeout  int
+}
+
+func (err QueueReceiveTimeout) Error() string {
+	return fmt.Sprintf("Failed to receive messages on %s within %d seconds", err.QueueUrl, err.Timeout)
+}
+
+type QueueThrottled struct {
+	QueueUrl string
+	Err      error
+}
+
+func (err QueueThrottled) Error() string {
+	return fmt.Sprintf("Requests to %s are being throttled: %s", err.QueueUrl, err.Err.Error())
+}
+
+type QueueAuthFailed struct {
+	QueueUrl string
+	Err      error
+}
+
+func (err QueueAuthFailed) Error() string {
+	return fmt.Sprintf("Not allowed to receive messages from %s. Check the credentials and IAM permissions: %s", err.QueueUrl, err.Err.Error())
+}
+
+type QueueMissing struct {
+	QueueUrl string
+}
+
+func (err QueueMissing) Error() string {
+	return fmt.Sprintf("Queue %s does not exist", err.QueueUrl)
+}
+
+// Any other failure, e.g. a network error or SQS returning 5xx errors after all retries
+type QueueUnavailable struct {
+	QueueUrl string
+	Err      error
+}
+
+func (err QueueUnavailable) Error() string {
+	return fmt.Sprintf("Unable to receive messages from %s: %s", err.QueueUrl, err.Err.Error())
+}
@@ -0,0 +1,32 @@
+package aws_helpers
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+)
+
+// Return the ARN of the identity whose credentials are in use: an IAM user, an assumed role session (which includes
+// SSO users) or a federated user. Unlike iam:GetUser, this works for every kind of credentials and needs no permissions.
+func (awsClient *AwsClient) GetCallerIdentityArn(awsRegion string) (string, error) {
+	stsClient, err := awsClient.CreateStsClient(awsRegion)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := stsClient.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+
+	return aws.StringValue(output.Arn), nil
+}
+
+func (awsClient *AwsClient) CreateStsClient(awsRegion string) (*sts.STS, error) {
+	sess, err := awsClient.Session(awsRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	return sts.New(sess), nil
+}
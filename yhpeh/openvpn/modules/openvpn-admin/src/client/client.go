@@ -0,0 +1,217 @@
+// Package client requests and revokes certificates from an OpenVPN server installed with the package-openvpn modules.
+// It talks to the openvpn-admin process-requests and process-revokes daemons on the server over their SQS queues, the
+// same way the openvpn-admin request, fetch and revoke commands do.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+)
+
+const LOGGER_NAME = "openvpn-admin-client"
+
+// How many seconds to wait for a response from the OpenVPN server if the options don't say
+const DEFAULT_TIMEOUT = 300
+
+// A user may hold a certificate for each of their devices. The common name of a device's certificate is the username
+// and the device joined by this separator, e.g. alice+laptop, while the certificate without a device is just alice.
+// The naming policy doesn't allow the separator in usernames, so the two can always be told apart.
+const DEVICE_SEPARATOR = "+"
+
+// The action of a CertificateRequest that asks for the stored result of an earlier request instead of a new certificate
+const REQUEST_ACTION_FETCH = "fetch"
+
+const RESPONSE_QUEUE_PREFIX = "openvpn-response"
+
+// The message a client puts on the request queue
+type CertificateRequest struct {
+	Username      string
+	ResponseQueue string
+
+	// The device the certificate is for, if any. See CertificateName.
+	Device string `json:",omitempty"`
+
+	// How long the certificate should be valid for, as a duration such as 72h. See Validity.
+	ValidFor string `json:",omitempty"`
+
+	// Set for requests whose result the server should keep for a later fetch, and for fetching it
+	RequestId string `json:",omitempty"`
+	Action    string `json:",omitempty"`
+}
+
+// The message the server puts on the response queue of a CertificateRequest
+type CertificateResponse struct {
+	Success      bool
+	Body         string
+	ErrorMessage string
+
+	// Set in responses to fetch. Username is the common name of the certificate, so it includes the device, if any.
+	// Pending means there is no result for the request (yet).
+	RequestId string `json:",omitempty"`
+	Username  string `json:",omitempty"`
+	Pending   bool   `json:",omitempty"`
+
+	// Set along with Pending when the request waits for an administrator to approve it
+	AwaitingApproval bool `json:",omitempty"`
+}
+
+// The message a client puts on the revoke queue
+type CertificateRevokeRequest struct {
+	Username      string
+	ResponseQueue string
+
+	// The device whose certificate to revoke, or all of the user's certificates. See CertificateName.
+	Device     string `json:",omitempty"`
+	AllDevices bool   `json:",omitempty"`
+}
+
+// The message the server puts on the response queue of a CertificateRevokeRequest
+type CertificateRevokeResponse struct {
+	Success            bool
+	ErrorMessage       string
+	SessionsTerminated int
+}
+
+// The validity the request asks for, or 0 if it doesn't ask for one
+func (request CertificateRequest) Validity() (time.Duration, error) {
+	if request.ValidFor == "" {
+		return 0, nil
+	}
+	validFor, err := time.ParseDuration(request.ValidFor)
+	return validFor, errors.WithStackTrace(err)
+}
+
+// The validity to put in a request, which is left out if the server's default should apply
+func FormatValidFor(validFor time.Duration) string {
+	if validFor == 0 {
+		return ""
+	}
+	return validFor.String()
+}
+
+// The common name of the certificate for the given user and device, which may be empty
+func CertificateName(username string, device string) string {
+	if device == "" {
+		return username
+	}
+	return username + DEVICE_SEPARATOR + device
+}
+
+// Split a common name into the username and the device, which is empty for a certificate without a device
+func SplitCertificateName(commonName string) (string, string) {
+	parts := strings.SplitN(commonName, DEVICE_SEPARATOR, 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// A temporary queue the server sends its response to, which only lives as long as the request
+type responseQueue struct {
+	Transport Transport
+	Url       string
+}
+
+func createResponseQueue(transport Transport) (*responseQueue, error) {
+	logging.GetLogger(LOGGER_NAME).Debugf("Creating temporary response queue")
+
+	queueUrl, err := transport.CreateQueue(RESPONSE_QUEUE_PREFIX)
+	if err != nil {
+		return nil, errors.WithStackTrace(err)
+	}
+	return &responseQueue{Transport: transport, Url: queueUrl}, nil
+}
+
+func (queue responseQueue) Delete() {
+	if err := queue.Transport.DeleteQueue(queue.Url); err != nil {
+		logging.GetLogger(LOGGER_NAME).Warnf("Unable to delete temporary queue %s: %s", queue.Url, err.Error())
+	}
+}
+
+// Wait up to timeout seconds for the server's response and parse it into response
+func (queue responseQueue) Receive(ctx context.Context, timeout int, response interface{}) error {
+	message, err := queue.Transport.Receive(ctx, queue.Url, timeout)
+	if err != nil {
+		return err
+	}
+	return errors.WithStackTrace(json.Unmarshal([]byte(message), response))
+}
+
+func sendMessage(transport Transport, queueUrl string, message interface{}) error {
+	messageJson, err := json.Marshal(message)
+	if err != nil {
+		return errors.WithStackTrace(err)
+	}
+	return transport.Send(queueUrl, string(messageJson))
+}
+
+// The given transport, or SQS in the given region if it is nil. SQS is called through the given AWS client, or, if
+// that is nil too, a new one with the default options.
+func transportOrSqs(transport Transport, awsClient *aws_helpers.AwsClient, awsRegion string) Transport {
+	if transport != nil {
+		return transport
+	}
+	if awsClient == nil {
+		awsClient = aws_helpers.NewAwsClient(aws_helpers.DefaultClientOptions())
+	}
+	return SqsTransport{AwsRegion: awsRegion, AwsClient: awsClient}
+}
+
+// Check the AWS region, which is only needed when the requests go over SQS
+func checkAwsRegion(transport Transport, awsRegion string) error {
+	if transport != nil {
+		return nil
+	}
+	return checkRequired("AwsRegion", awsRegion)
+}
+
+func timeoutOrDefault(timeout int) int {
+	if timeout <= 0 {
+		return DEFAULT_TIMEOUT
+	}
+	return timeout
+}
+
+// Generate the ID of a request whose result the server should keep for a later fetch
+func NewRequestId() (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+	return id.String(), nil
+}
+
+// Check that the given options, passed as pairs of name and value, are set
+func checkRequired(namesAndValues ...string) error {
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		if namesAndValues[i+1] == "" {
+			return errors.WithStackTrace(MissingOption(namesAndValues[i]))
+		}
+	}
+	return nil
+}
+
+// Custom errors
+
+var DeviceAndAllDevices = fmt.Errorf("Only one of Device and AllDevices may be set")
+
+type MissingOption string
+
+func (err MissingOption) Error() string {
+	return fmt.Sprintf("%s is required", string(err))
+}
+
+// The error message of a server that was unable to carry out the request
+type ServerError string
+
+func (err ServerError) Error() string {
+	return string(err)
+}
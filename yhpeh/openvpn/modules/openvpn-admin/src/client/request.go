@@ -0,0 +1,215 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+)
+
+type RequestOptions struct {
+	AwsRegion  string
+	RequestUrl string
+	Username   string
+
+	// Optional. Defaults to SQS in AwsRegion, which isn't needed otherwise.
+	Transport Transport
+
+	// The AWS client SQS is called through. Optional. Defaults to a new client with aws_helpers.DefaultClientOptions.
+	AwsClient *aws_helpers.AwsClient
+
+	// Optional. See CertificateName.
+	Device string
+
+	// How long the certificate should be valid for, rounded up to whole days by the server. 0 means the server's
+	// default.
+	ValidFor time.Duration
+
+	// How many seconds to wait for the server. 0 means DEFAULT_TIMEOUT.
+	Timeout int
+
+	// Called when the server says the request is waiting for approval by an administrator, before waiting on for the
+	// certificate
+	OnAwaitingApproval func(requestId string)
+}
+
+type FetchOptions struct {
+	AwsRegion  string
+	RequestUrl string
+	RequestId  string
+
+	// Optional. Defaults to SQS in AwsRegion, which isn't needed otherwise.
+	Transport Transport
+
+	// The AWS client SQS is called through. Optional. Defaults to a new client with aws_helpers.DefaultClientOptions.
+	AwsClient *aws_helpers.AwsClient
+
+	// How many seconds to wait for the server. 0 means DEFAULT_TIMEOUT.
+	Timeout int
+}
+
+// A certificate issued by the OpenVPN server. Profile is the contents of the OpenVPN profile (.ovpn file), which
+// includes the private key.
+type Certificate struct {
+	CommonName string
+	RequestId  string
+	Profile    string
+}
+
+// Request a new certificate from the OpenVPN server and wait for it. If the server requires approval, this waits on
+// until an administrator approved the request, or returns AwaitingApproval once the timeout is up, in which case the
+// certificate can be fetched with FetchCertificate later.
+func RequestCertificate(ctx context.Context, opts RequestOptions) (*Certificate, error) {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	timeout := timeoutOrDefault(opts.Timeout)
+	commonName := CertificateName(opts.Username, opts.Device)
+	transport := transportOrSqs(opts.Transport, opts.AwsClient, opts.AwsRegion)
+
+	queue, err := createResponseQueue(transport)
+	if err != nil {
+		return nil, err
+	}
+	defer queue.Delete()
+
+	logger.Debugf("Requesting a certificate for %s on %s", commonName, opts.RequestUrl)
+	request := CertificateRequest{
+		Username:      opts.Username,
+		Device:        opts.Device,
+		ValidFor:      FormatValidFor(opts.ValidFor),
+		ResponseQueue: queue.Url,
+	}
+	if err := sendMessage(transport, opts.RequestUrl, request); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	response := CertificateResponse{}
+	if err := queue.Receive(ctx, timeout, &response); err != nil {
+		return nil, err
+	}
+
+	// If the server requires approval, it first says so, and sends the certificate once an administrator approved it
+	if response.AwaitingApproval {
+		requestId := response.RequestId
+		if opts.OnAwaitingApproval != nil {
+			opts.OnAwaitingApproval(requestId)
+		}
+
+		remaining := timeout - int(time.Since(start).Seconds())
+		if remaining <= 0 {
+			return nil, errors.WithStackTrace(AwaitingApproval(requestId))
+		}
+
+		response = CertificateResponse{}
+		err := queue.Receive(ctx, remaining, &response)
+		if _, isTimeout := errors.Unwrap(err).(aws_helpers.QueueReceiveTimeout); isTimeout {
+			return nil, errors.WithStackTrace(AwaitingApproval(requestId))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !response.Success {
+		return nil, errors.WithStackTrace(ServerError(response.ErrorMessage))
+	}
+
+	return &Certificate{CommonName: commonName, RequestId: response.RequestId, Profile: response.Body}, nil
+}
+
+// Submit a request for a new certificate without waiting for the response. The server keeps the result under the
+// returned request ID, for FetchCertificate.
+func SubmitCertificateRequest(ctx context.Context, opts RequestOptions) (string, error) {
+	if err := opts.check(); err != nil {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+
+	requestId, err := NewRequestId()
+	if err != nil {
+		return "", err
+	}
+
+	request := CertificateRequest{
+		Username:  opts.Username,
+		Device:    opts.Device,
+		ValidFor:  FormatValidFor(opts.ValidFor),
+		RequestId: requestId,
+	}
+	if err := sendMessage(transportOrSqs(opts.Transport, opts.AwsClient, opts.AwsRegion), opts.RequestUrl, request); err != nil {
+		return "", err
+	}
+
+	return requestId, nil
+}
+
+// Get the certificate of a request made with SubmitCertificateRequest, or of one that had to wait for approval.
+// Returns RequestNotReady or AwaitingApproval if the server has no result for it yet.
+func FetchCertificate(ctx context.Context, opts FetchOptions) (*Certificate, error) {
+	if err := checkAwsRegion(opts.Transport, opts.AwsRegion); err != nil {
+		return nil, err
+	}
+	if err := checkRequired("RequestUrl", opts.RequestUrl, "RequestId", opts.RequestId); err != nil {
+		return nil, err
+	}
+	transport := transportOrSqs(opts.Transport, opts.AwsClient, opts.AwsRegion)
+
+	queue, err := createResponseQueue(transport)
+	if err != nil {
+		return nil, err
+	}
+	defer queue.Delete()
+
+	logging.GetLogger(LOGGER_NAME).Debugf("Fetching the result of request %s", opts.RequestId)
+	request := CertificateRequest{RequestId: opts.RequestId, Action: REQUEST_ACTION_FETCH, ResponseQueue: queue.Url}
+	if err := sendMessage(transport, opts.RequestUrl, request); err != nil {
+		return nil, err
+	}
+
+	response := CertificateResponse{}
+	if err := queue.Receive(ctx, timeoutOrDefault(opts.Timeout), &response); err != nil {
+		return nil, err
+	}
+
+	if response.AwaitingApproval {
+		return nil, errors.WithStackTrace(AwaitingApproval(opts.RequestId))
+	}
+	if response.Pending {
+		return nil, errors.WithStackTrace(RequestNotReady(opts.RequestId))
+	}
+	if !response.Success {
+		return nil, errors.WithStackTrace(ServerError(response.ErrorMessage))
+	}
+
+	return &Certificate{CommonName: response.Username, RequestId: opts.RequestId, Profile: response.Body}, nil
+}
+
+func (opts RequestOptions) check() error {
+	if err := checkAwsRegion(opts.Transport, opts.AwsRegion); err != nil {
+		return err
+	}
+	return checkRequired("RequestUrl", opts.RequestUrl, "Username", opts.Username)
+}
+
+// Custom errors
+
+type AwaitingApproval string
+
+func (err AwaitingApproval) Error() string {
+	return fmt.Sprintf("Request %s is waiting for approval by an administrator. Run 'openvpn-admin fetch %s' to get the profile once it has been approved.", string(err), string(err))
+}
+
+type RequestNotReady string
+
+func (err RequestNotReady) Error() string {
+	return fmt.Sprintf("There is no result for request %s yet. The OpenVPN server may still be working through its queue, so try again later. Results are only kept for a limited time, so if the request was made long ago, make a new one.", string(err))
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+)
+
+type RevokeOptions struct {
+	AwsRegion string
+	RevokeUrl string
+	Username  string
+
+	// Optional. Defaults to SQS in AwsRegion, which isn't needed otherwise.
+	Transport Transport
+
+	// The AWS client SQS is called through. Optional. Defaults to a new client with aws_helpers.DefaultClientOptions.
+	AwsClient *aws_helpers.AwsClient
+
+	// Revoke the certificate of the given device (see CertificateName), or all of the user's certificates. By default,
+	// only the certificate without a device is revoked.
+	Device     string
+	AllDevices bool
+
+	// How many seconds to wait for the server. 0 means DEFAULT_TIMEOUT.
+	Timeout int
+}
+
+// The outcome of a revocation. If the server's OpenVPN management interface is configured, the server disconnects the
+// active sessions of the revoked certificates.
+type Revocation struct {
+	SessionsTerminated int
+}
+
+// Revoke a certificate on the OpenVPN server and wait for the server to confirm it
+func RevokeCertificate(ctx context.Context, opts RevokeOptions) (*Revocation, error) {
+	if err := checkAwsRegion(opts.Transport, opts.AwsRegion); err != nil {
+		return nil, err
+	}
+	if err := checkRequired("RevokeUrl", opts.RevokeUrl, "Username", opts.Username); err != nil {
+		return nil, err
+	}
+	if opts.AllDevices && opts.Device != "" {
+		return nil, errors.WithStackTrace(DeviceAndAllDevices)
+	}
+
+	transport := transportOrSqs(opts.Transport, opts.AwsClient, opts.AwsRegion)
+
+	queue, err := createResponseQueue(transport)
+	if err != nil {
+		return nil, err
+	}
+	defer queue.Delete()
+
+	logging.GetLogger(LOGGER_NAME).Debugf("Requesting certificate revocation for %s on %s", CertificateName(opts.Username, opts.Device), opts.RevokeUrl)
+	request := CertificateRevokeRequest{
+		Username:      opts.Username,
+		Device:        opts.Device,
+		AllDevices:    opts.AllDevices,
+		ResponseQueue: queue.Url,
+	}
+	if err := sendMessage(transport, opts.RevokeUrl, request); err != nil {
+		return nil, err
+	}
+
+	response := CertificateRevokeResponse{}
+	if err := queue.Receive(ctx, timeoutOrDefault(opts.Timeout), &response); err != nil {
+		return nil, err
+	}
+
+	if !response.Success {
+		return nil, errors.WithStackTrace(ServerError(response.ErrorMessage))
+	}
+
+	return &Revocation{SessionsTerminated: response.SessionsTerminated}, nil
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+)
+
+// Memory queues hold this many messages before Send fails
+const MEMORY_QUEUE_CAPACITY = 100
+
+// Memory queue URLs look like real ones, so they pass the same validation, but use the reserved .invalid domain, which
+// never resolves
+const MEMORY_QUEUE_URL_PREFIX = "https://queues.memory.invalid/"
+
+// How clients and servers exchange messages: over SQS (see SqsTransport) or, for tests and openvpn-admin dev, in
+// memory (see MemoryTransport)
+type Transport interface {
+	// Create a queue named prefix followed by a random suffix and return its URL
+	CreateQueue(prefix string) (string, error)
+
+	DeleteQueue(queueUrl string) error
+
+	// Send a message. Messages for queues that don't exist (any more) are dropped, as nobody is waiting for them.
+	Send(queueUrl string, message string) error
+
+	// Wait up to timeout seconds for a message and remove it from the queue. Returns aws_helpers.QueueReceiveTimeout if
+	// none arrives in time.
+	Receive(ctx context.Context, queueUrl string, timeout int) (string, error)
+}
+
+// Exchanges messages over SQS queues in the given region, using the given AWS client
+type SqsTransport struct {
+	AwsRegion string
+	AwsClient *aws_helpers.AwsClient
+}
+
+func (transport SqsTransport) CreateQueue(prefix string) (string, error) {
+	return transport.AwsClient.CreateRandomQueue(transport.AwsRegion, prefix)
+}
+
+func (transport SqsTransport) DeleteQueue(queueUrl string) error {
+	return transport.AwsClient.DeleteQueue(transport.AwsRegion, queueUrl)
+}
+
+func (transport SqsTransport) Send(queueUrl string, message string) error {
+	return transport.AwsClient.SendMessageToQueue(transport.AwsRegion, queueUrl, message)
+}
+
+func (transport SqsTransport) Receive(ctx context.Context, queueUrl string, timeout int) (string, error) {
+	receipt, message, err := transport.AwsClient.WaitForQueueMessageWithContext(ctx, transport.AwsRegion, queueUrl, timeout)
+	if err != nil {
+		return "", err
+	}
+	return message, transport.AwsClient.DeleteMessageFromQueue(transport.AwsRegion, queueUrl, receipt)
+}
+
+// Exchanges messages over queues that only exist in this process. Create one with NewMemoryTransport.
+type MemoryTransport struct {
+	mutex  sync.Mutex
+	queues map[string]chan string
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{queues: map[string]chan string{}}
+}
+
+func (transport *MemoryTransport) CreateQueue(prefix string) (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", errors.WithStackTrace(err)
+	}
+	queueUrl := fmt.Sprintf("%s%s-%s", MEMORY_QUEUE_URL_PREFIX, prefix, id.String())
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	transport.queues[queueUrl] = make(chan string, MEMORY_QUEUE_CAPACITY)
+	return queueUrl, nil
+}
+
+func (transport *MemoryTransport) DeleteQueue(queueUrl string) error {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	delete(transport.queues, queueUrl)
+	return nil
+}
+
+func (transport *MemoryTransport) Send(queueUrl string, message string) error {
+	queue, exists := transport.queue(queueUrl)
+	if !exists {
+		return nil
+	}
+
+	select {
+	case queue <- message:
+		return nil
+	default:
+		return errors.WithStackTrace(MemoryQueueFull(queueUrl))
+	}
+}
+
+func (transport *MemoryTransport) Receive(ctx context.Context, queueUrl string, timeout int) (string, error) {
+	queue, exists := transport.queue(queueUrl)
+	if !exists {
+		return "", errors.WithStackTrace(aws_helpers.QueueMissing{QueueUrl: queueUrl})
+	}
+
+	select {
+	case message := <-queue:
+		return message, nil
+	case <-ctx.Done():
+		return "", errors.WithStackTrace(ctx.Err())
+	case <-time.After(time.Duration(timeout) * time.Second):
+		return "", errors.WithStackTrace(aws_helpers.QueueReceiveTimeout{QueueUrl: queueUrl, Timeout: timeout})
+	}
+}
+
+func (transport *MemoryTransport) queue(queueUrl string) (chan string, bool) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	queue, exists := transport.queues[queueUrl]
+	return queue, exists
+}
+
+// Custom errors
+
+type MemoryQueueFull string
+
+func (err MemoryQueueFull) Error() string {
+	return fmt.Sprintf("Queue %s is full", string(err))
+}
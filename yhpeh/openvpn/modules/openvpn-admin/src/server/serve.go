@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/gruntwork-io/gruntwork-cli/errors"
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/aws_helpers"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+)
+
+// How many seconds Serve waits for a message before it checks whether to stop
+const SERVE_RECEIVE_TIMEOUT = 20
+
+// Handle the certificate requests on requestQueue and the revocation requests on revokeQueue of the given transport,
+// one at a time, until ctx is done or receiving fails. Returns nil once ctx is done. This is all openvpn-admin dev
+// runs; the process-requests and process-revokes daemons add retries, leader election, health checks and disconnecting
+// revoked users on top.
+func (handler Handler) Serve(ctx context.Context, transport client.Transport, requestQueue string, revokeQueue string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failures := make(chan error, 2)
+	go func() {
+		failures <- serveQueue(ctx, transport, requestQueue, func(message string) (string, interface{}) {
+			request := client.CertificateRequest{}
+			json.Unmarshal([]byte(message), &request)
+			return request.ResponseQueue, handler.HandleCertificateRequest(ctx, request)
+		})
+	}()
+	go func() {
+		failures <- serveQueue(ctx, transport, revokeQueue, func(message string) (string, interface{}) {
+			request := client.CertificateRevokeRequest{}
+			json.Unmarshal([]byte(message), &request)
+
+			response := client.CertificateRevokeResponse{Success: true}
+			if _, err := handler.HandleRevokeRequest(ctx, request); err != nil {
+				response = client.CertificateRevokeResponse{ErrorMessage: err.Error()}
+			}
+			return request.ResponseQueue, response
+		})
+	}()
+
+	// Stop the other queue as soon as one of them fails
+	err := <-failures
+	cancel()
+	if otherErr := <-failures; err == nil {
+		err = otherErr
+	}
+	return err
+}
+
+// Handle the messages on the given queue until ctx is done, sending each response to the response queue handle returns
+func serveQueue(ctx context.Context, transport client.Transport, queueUrl string, handle func(message string) (string, interface{})) error {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	for {
+		message, err := transport.Receive(ctx, queueUrl, SERVE_RECEIVE_TIMEOUT)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if _, isTimeout := errors.Unwrap(err).(aws_helpers.QueueReceiveTimeout); isTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		responseQueue, response := handle(message)
+		if responseQueue == "" {
+			continue
+		}
+
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			return errors.WithStackTrace(err)
+		}
+		if err := transport.Send(responseQueue, string(responseJson)); err != nil {
+			logger.Warnf("Unable to send the response to %s: %s", responseQueue, err.Error())
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Package server handles the certificate and revocation requests that clients (see package client) put on the queues of
+// an OpenVPN server. The certificates themselves are left to a CertificateAuthority, which for the openvpn-admin daemons
+// is the easy-rsa PKI installed by the install-openvpn module.
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/gruntwork-io/gruntwork-cli/logging"
+	"github.com/gruntwork-io/package-openvpn/modules/openvpn-admin/src/client"
+)
+
+const LOGGER_NAME = "openvpn-admin-server"
+
+// Issues and revokes the certificates with the given common names (see client.CertificateName)
+type CertificateAuthority interface {
+	// Issue a certificate valid for validFor, or the default validity if that is 0, and return the OpenVPN profile
+	IssueCertificate(commonName string, validFor time.Duration) (string, error)
+
+	RevokeCertificate(commonName string) error
+
+	// Revoke all valid certificates of the given user, across all of their devices, and return their common names
+	RevokeAllCertificates(username string) ([]string, error)
+}
+
+// The result of a request that carries a request ID, kept until the requester fetches it
+type Result struct {
+	RequestId    string
+	Username     string
+	Success      bool
+	Body         string
+	ErrorMessage string
+	CompletedAt  time.Time
+}
+
+// Keeps the results of requests that carry a request ID. Load returns nil if there is no result (any more).
+type ResultStore interface {
+	Load(requestId string) (*Result, error)
+	Save(result Result) error
+}
+
+// Holds certificate requests until an administrator approves or denies them
+type Approvals interface {
+	// Hold the given request and return the response that tells the requester so
+	Park(request client.CertificateRequest, commonName string) client.CertificateResponse
+
+	IsAwaitingApproval(requestId string) bool
+}
+
+// Handles requests with the given CertificateAuthority. Results and Approvals are optional: without Results, requests
+// are not kept for a later fetch, and without Approvals, certificates are issued right away. MapUsername, if set, is
+// applied to the usernames in requests, in case a client sent a name it didn't map (e.g. an older client).
+type Handler struct {
+	Authority   CertificateAuthority
+	Results     ResultStore
+	Approvals   Approvals
+	MapUsername func(username string) string
+}
+
+// Issue a certificate for the given request, or look up the result of an earlier request when asked to fetch one.
+// Requests that carry a request ID get their result stored for a later fetch, and a duplicate of such a request gets the
+// stored result rather than a second certificate. Errors are returned in the response, for the requester.
+func (handler Handler) HandleCertificateRequest(ctx context.Context, request client.CertificateRequest) client.CertificateResponse {
+	logger := logging.GetLogger(LOGGER_NAME)
+
+	if err := ctx.Err(); err != nil {
+		return client.CertificateResponse{RequestId: request.RequestId, ErrorMessage: err.Error()}
+	}
+
+	if request.RequestId != "" && handler.Results != nil {
+		stored, err := handler.Results.Load(request.RequestId)
+		if err != nil {
+			return client.CertificateResponse{RequestId: request.RequestId, ErrorMessage: err.Error()}
+		}
+		if stored != nil {
+			logger.Infof("Returning stored result of request %s for %s", stored.RequestId, stored.Username)
+			return client.CertificateResponse{RequestId: stored.RequestId, Username: stored.Username, Success: stored.Success, Body: stored.Body, ErrorMessage: stored.ErrorMessage}
+		}
+	}
+	if request.Action == client.REQUEST_ACTION_FETCH {
+		return client.CertificateResponse{RequestId: request.RequestId, Pending: true, AwaitingApproval: handler.Approvals != nil && handler.Approvals.IsAwaitingApproval(request.RequestId)}
+	}
+
+	commonName := client.CertificateName(handler.mapUsername(request.Username), request.Device)
+	if handler.Approvals != nil {
+		return handler.Approvals.Park(request, commonName)
+	}
+
+	response := client.CertificateResponse{RequestId: request.RequestId, Username: commonName}
+
+	validFor, err := request.Validity()
+	if err == nil {
+		response.Body, err = handler.Authority.IssueCertificate(commonName, validFor)
+	}
+	if err != nil {
+		response.ErrorMessage = err.Error()
+	} else {
+		response.Success = true
+	}
+
+	if request.RequestId != "" && handler.Results != nil {
+		err := handler.Results.Save(Result{
+			RequestId:    request.RequestId,
+			Username:     commonName,
+			Success:      response.Success,
+			Body:         response.Body,
+			ErrorMessage: response.ErrorMessage,
+			CompletedAt:  time.Now(),
+		})
+		if err != nil {
+			logger.Errorf("Unable to store the result of request %s for %s: %s", request.RequestId, commonName, err.Error())
+		}
+	}
+
+	return response
+}
+
+// Revoke the certificate in the given request, or all of the user's certificates if it asks for all devices, and return
+// the common names of the revoked certificates
+func (handler Handler) HandleRevokeRequest(ctx context.Context, request client.CertificateRevokeRequest) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	username := handler.mapUsername(request.Username)
+	if request.AllDevices {
+		return handler.Authority.RevokeAllCertificates(username)
+	}
+
+	commonName := client.CertificateName(username, request.Device)
+	if err := handler.Authority.RevokeCertificate(commonName); err != nil {
+		return nil, err
+	}
+	return []string{commonName}, nil
+}
+
+func (handler Handler) mapUsername(username string) string {
+	if handler.MapUsername == nil {
+		return username
+	}
+	return handler.MapUsername(username)
+}
@@ -208,6 +208,31 @@ data "aws_iam_policy_document" "openvpn" {
 
     resources = ["*"]
   }
+
+  # Allows openvpn-admin process-revokes to publish how many days are left until the CRL must be regenerated
+  statement {
+    sid    = "PublishCrlMetrics"
+    effect = "Allow"
+
+    actions = [
+      "cloudwatch:PutMetricData",
+    ]
+
+    resources = ["*"]
+  }
+
+  # Allows openvpn-admin sync-iam to revoke the certificates of users that have left or lost access
+  statement {
+    sid    = "ReconcileIamUsers"
+    effect = "Allow"
+
+    actions = [
+      "iam:ListUsers",
+      "iam:GetGroup",
+    ]
+
+    resources = ["*"]
+  }
 }
 
 # ---------------------------------------------------------------------------------------------------------------------
@@ -311,12 +336,23 @@ resource "aws_iam_role_policy" "backup" {
 # CREATE THE SQS QUEUES
 # This queue is used to receive requests for new certificates
 # ---------------------------------------------------------------------------------------------------------------------
+# openvpn-admin finds the queues by these tags, so that several OpenVPN servers can share an account
 resource "aws_sqs_queue" "client-request-queue" {
   name = "openvpn-requests-${var.request_queue_name}"
+
+  tags = {
+    "openvpn-admin:role"   = "requests"
+    "openvpn-admin:server" = "${var.name}"
+  }
 }
 
 resource "aws_sqs_queue" "client-revocation-queue" {
   name = "openvpn-revocations-${var.revocation_queue_name}"
+
+  tags = {
+    "openvpn-admin:role"   = "revocations"
+    "openvpn-admin:server" = "${var.name}"
+  }
 }
 
 # ----------------------------------------------------------------------------------------------------------------------
@@ -355,6 +391,7 @@ data "aws_iam_policy_document" "certificate-requests" {
       "sqs:SendMessage",
       "sqs:SendMessageBatch",
       "sqs:ListQueues",
+      "sqs:ListQueueTags",
     ]
 
     resources = [
@@ -370,6 +407,48 @@ resource "aws_iam_role_policy" "certificate-requests" {
   policy = "${data.aws_iam_policy_document.certificate-requests.json}"
 }
 
+# ----------------------------------------------------------------------------------------------------------------------
+# OPTIONALLY CREATE A DYNAMODB TABLE TO LOCK THE PKI ACROSS SERVERS
+# This lets a hot standby (e.g. during an ASG replacement) share the request queues without corrupting the CA.
+# ----------------------------------------------------------------------------------------------------------------------
+
+resource "aws_dynamodb_table" "locks" {
+  count = "${var.create_lock_table}"
+
+  name         = "${var.name}-locks"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "LockName"
+
+  attribute {
+    name = "LockName"
+    type = "S"
+  }
+}
+
+data "aws_iam_policy_document" "locks" {
+  count = "${var.create_lock_table}"
+
+  statement {
+    sid    = "LockPki"
+    effect = "Allow"
+
+    actions = [
+      "dynamodb:PutItem",
+      "dynamodb:DeleteItem",
+    ]
+
+    resources = ["${aws_dynamodb_table.locks.*.arn}"]
+  }
+}
+
+resource "aws_iam_role_policy" "locks" {
+  count = "${var.create_lock_table}"
+
+  name   = "${var.name}-locks"
+  role   = "${aws_iam_role.openvpn.id}"
+  policy = "${element(data.aws_iam_policy_document.locks.*.json, 0)}"
+}
+
 # ----------------------------------------------------------------------------------------------------------------------
 # CREATE IAM POLICIES THAT ALLOW USERS TO REQUESTS CERTS AND ADMINS TO REVOKE CERTS
 # ----------------------------------------------------------------------------------------------------------------------
@@ -407,7 +486,7 @@ data "aws_iam_policy_document" "send-certificate-requests" {
   statement {
     sid       = "findQueue"
     effect    = "Allow"
-    actions   = ["sqs:ListQueues"]
+    actions   = ["sqs:ListQueues", "sqs:ListQueueTags"]
     resources = ["*"]
   }
 
@@ -450,7 +529,7 @@ data "aws_iam_policy_document" "send-certificate-revocations" {
   statement {
     sid       = "findQueue"
     effect    = "Allow"
-    actions   = ["sqs:ListQueues"]
+    actions   = ["sqs:ListQueues", "sqs:ListQueueTags"]
     resources = ["*"]
   }
 }
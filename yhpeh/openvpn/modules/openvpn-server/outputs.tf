@@ -49,3 +49,7 @@ output "allow_certificate_revocations_for_external_accounts_iam_role_id" {
 output "allow_certificate_revocations_for_external_accounts_iam_role_arn" {
   value = "${aws_iam_role.allow_certificate_revocations_for_external_accounts.*.arn}"
 }
+
+output "lock_table_name" {
+  value = "${element(concat(aws_dynamodb_table.locks.*.name, list("")), 0)}"
+}
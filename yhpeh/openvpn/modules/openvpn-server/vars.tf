@@ -116,3 +116,8 @@ variable "root_volume_delete_on_termination" {
   description = "If set to true, the root volume will be deleted when the Instance is terminated."
   default = true
 }
+
+variable "create_lock_table" {
+  description = "If set to true, create a DynamoDB table that openvpn-admin can use (via --lock-table) to lock the PKI and elect a leader when several OpenVPN servers share the request queues."
+  default     = false
+}
@@ -219,6 +219,8 @@ func validateInstanceRunningOpenVPNServer(t *testing.T, osName string, workingDi
 		t.Run("running testOpenVpnAdminProcessRequestsIsRunning", wrapTestCase(testOpenVpnAdminProcessRequestsIsRunning, host))
 		t.Run("running testOpenVpnAdminProcessRevokesIsRunning", wrapTestCase(testOpenVpnAdminProcessRevokesIsRunning, host))
 		t.Run("running testCrlExpirationDateUpdated", wrapTestCase(testCrlExpirationDateUpdated, host))
+		t.Run("running testCrlShow", wrapTestCase(testCrlShow, host))
+		t.Run("running testDoctor", wrapTestCase(testDoctor, host))
 		t.Run("running testCronJobExists", wrapTestCase(testCronJobExists, host))
 	})
 }
@@ -282,6 +284,31 @@ func testCrlExpirationDateUpdated(t *testing.T, host ssh.Host) {
 	assert.Contains(t, output, "default_crl_days= 3650")
 }
 
+func testCrlShow(t *testing.T, host ssh.Host) {
+	commandToTest := "sudo /usr/local/bin/openvpn-admin crl show"
+	output := ssh.CheckSshCommand(t, host, commandToTest)
+
+	// It will be convenient to see the full command output directly in logs. This will show only when there's a test failure.
+	logger.Logf(t, "Result of running \"%s\"\n", commandToTest)
+	logger.Log(t, output)
+
+	// init-openvpn revokes a dummy certificate to initialize the CRL
+	assert.Contains(t, output, "Next update:")
+	assert.NotContains(t, output, "EXPIRED")
+	assert.Contains(t, output, "dummy")
+}
+
+func testDoctor(t *testing.T, host ssh.Host) {
+	commandToTest := "sudo /usr/local/bin/openvpn-admin doctor"
+	output := ssh.CheckSshCommand(t, host, commandToTest)
+
+	// It will be convenient to see the full command output directly in logs. This will show only when there's a test failure.
+	logger.Logf(t, "Result of running \"%s\"\n", commandToTest)
+	logger.Log(t, output)
+
+	assert.Contains(t, output, "No problems found")
+}
+
 func wrapTestCase(testCase func(t *testing.T, host ssh.Host), host ssh.Host) func(t *testing.T) {
 	return func(t *testing.T) {
 		testCase(t, host)